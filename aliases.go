@@ -0,0 +1,79 @@
+/*
+ * Changing the aliases used by .git while the bot is running, e.g. from the
+ * dashboard. Once aliases have been changed they are saved in the bot's
+ * store and take precedence over those in config.yaml, in the same way as
+ * the rooms in roomlist.go.
+ *
+ * Repositories added this way are added to the index (see gitindex.go)
+ * straight away, and cloned in the background, so .git can search them once
+ * the clone has finished.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+)
+
+const (
+	// the name the aliases are saved under in the store
+	aliasStore = "aliases"
+)
+
+// The aliases as they are saved.
+type savedAliases struct {
+	Aliases map[string]string
+}
+
+// Replaces the aliases from the config with those saved in the store, if any
+// have been saved. Should be used before the bot connects.
+func (bot *Bot) LoadAliases() error {
+	var saved savedAliases
+	if err := bot.store.Load(aliasStore, &saved); err != nil {
+		return err
+	}
+	if saved.Aliases == nil {
+		return nil
+	}
+
+	bot.configMu.Lock()
+	bot.config.GitAliases = saved.Aliases
+	bot.configMu.Unlock()
+	bot.aliasesSaved = true
+	return nil
+}
+
+// Sets an alias for .git, or removes it if repo is "", and saves the
+// aliases. Should only be used from the main loop.
+func (bot *Bot) SetAlias(alias, repo string) error {
+	if !GitAliasRegex.MatchString(alias) {
+		return fmt.Errorf("%q is not a valid alias; use letters, numbers, "+
+			"_, . and - only", alias)
+	}
+	if repo != "" && !GitRepoRegex.MatchString(repo) {
+		return fmt.Errorf("%q should be of the form user/repo", repo)
+	}
+
+	// the map is copied, since copies of the config share it
+	aliases := make(map[string]string, len(bot.config.GitAliases)+1)
+	for a, r := range bot.config.GitAliases {
+		aliases[a] = r
+	}
+	if repo == "" {
+		if _, ok := aliases[alias]; !ok {
+			return fmt.Errorf("there is no alias %q", alias)
+		}
+		delete(aliases, alias)
+	} else {
+		aliases[alias] = repo
+	}
+
+	bot.configMu.Lock()
+	bot.config.GitAliases = aliases
+	bot.configMu.Unlock()
+	bot.aliasesSaved = true
+	bot.ReindexRepos()
+	return bot.store.Save(aliasStore, savedAliases{Aliases: aliases})
+}
@@ -0,0 +1,372 @@
+/*
+ * A JSON API for other programs, such as CI jobs or deploy scripts, to post
+ * to PS! through the bot and to see what is going on. Served by the bot's
+ * HTTP server when config.EnableAPI is set. Every request needs
+ * config.APIToken, given as a bearer token in the Authorization header or
+ * as ?token=.
+ *
+ *   GET  /api/rooms        the rooms the bot is in, with their titles and
+ *                          how many users are in them
+ *   GET  /api/rooms/ROOM   a single room, with its users
+ *   POST /api/messages     says something in a room, or PMs a user. The body
+ *                          should be {"room": "techcode", "text": "..."},
+ *                          using "user:name" as the room for PMs. Give
+ *                          "html" as well as or instead of "text" to send
+ *                          an !htmlbox; the text is used instead in rooms
+ *                          where the bot can't use !htmlbox
+ *   POST /api/commands     runs a command as if an owner had used it, e.g.
+ *                          {"command": ".git server"}, and replies with
+ *                          what the bot said in response
+ *   GET  /api/events       streams the messages the bot receives from PS!
+ *                          as Server-Sent Events. Give ?room=ROOM or
+ *                          ?type=TYPE (either possibly more than once) to
+ *                          only get some of them, e.g. ?type=c&type=pm
+ *
+ * Errors are given as {"error": "..."} with a suitable status.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	APIPath = "/api/"
+
+	// the prefix of the rooms commands run over the API are run in, so
+	// that their replies can be collected
+	apiRoomPrefix = "api:"
+	// how long a command run over the API is given to reply. Replies are
+	// collected until nothing more has been said for apiReplyWait, up to
+	// apiCommandTimeout in all
+	apiReplyWait      = time.Second
+	apiCommandTimeout = 10 * time.Second
+	// how often a comment is sent to event streams so that proxies don't
+	// close them
+	apiKeepAlive = 30 * time.Second
+	// how many events a slow stream can fall behind by before events are
+	// dropped
+	eventBuffer = 100
+)
+
+var (
+	// for giving each command run over the API its own room
+	apiCommandSeq int64
+)
+
+// A message received from PS!, as given to event streams.
+type ChatEvent struct {
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	Type string    `json:"type"`
+	Args []string  `json:"args"`
+}
+
+// Hands the messages the bot receives to anything that wants them, such as
+// event streams. The zero value is ready to use.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan ChatEvent]bool
+}
+
+// Returns a channel that receives every event published until it is
+// unsubscribed.
+func (h *eventHub) subscribe() chan ChatEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan ChatEvent]bool)
+	}
+	ch := make(chan ChatEvent, eventBuffer)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan ChatEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+// Hands an event to every subscriber. Subscribers that have fallen too far
+// behind miss it, so that they can't hold up the main loop.
+func (h *eventHub) publish(e ChatEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Returns true if anything is subscribed.
+func (h *eventHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// Publishes a message received from PS! to the bot's event streams.
+func (bot *Bot) PublishMessage(msg Message) {
+	if !bot.events.active() {
+		return
+	}
+	bot.events.publish(ChatEvent{
+		Time: time.Now(),
+		Room: msg.room,
+		Type: msg.msgType,
+		Args: append([]string(nil), msg.args...),
+	})
+}
+
+// Wraps a handler so that it can only be used with config.APIToken.
+func (bot *Bot) RequireAPIToken(handler http.Handler) http.Handler {
+	return requireToken(func() string {
+		return bot.Config().APIToken
+	}, handler)
+}
+
+// Serves the API. See the top of this file for what it provides.
+func (bot *Bot) ServeAPI(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, APIPath), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case parts[0] == "rooms" && len(parts) <= 2 && req.Method == "GET":
+		if len(parts) == 1 {
+			bot.apiRooms(w)
+		} else {
+			bot.apiRoom(w, parts[1])
+		}
+	case path == "messages" && req.Method == "POST":
+		bot.apiMessage(w, req)
+	case path == "commands" && req.Method == "POST":
+		bot.apiCommand(w, req)
+	case path == "events" && req.Method == "GET":
+		bot.apiEvents(w, req)
+	case parts[0] == "rooms" || path == "messages" || path == "commands" ||
+		path == "events":
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// A room as given by the API.
+type apiRoom struct {
+	ID    string `json:"id"`
+	Title string `json:"title,omitempty"`
+	// whether the bot is still waiting to join
+	Joining   bool     `json:"joining"`
+	UserCount int      `json:"userCount"`
+	Users     []string `json:"users,omitempty"`
+}
+
+func (bot *Bot) apiRooms(w http.ResponseWriter) {
+	rooms := []apiRoom{}
+	for _, id := range bot.RoomList() {
+		room, ok := bot.Room(id)
+		rooms = append(rooms, apiRoom{
+			ID:        id,
+			Title:     room.Title,
+			Joining:   !ok,
+			UserCount: len(room.Users),
+		})
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (bot *Bot) apiRoom(w http.ResponseWriter, id string) {
+	room, ok := bot.Room(toId(id))
+	if !ok {
+		if bot.InRoom(toId(id)) {
+			writeJSON(w, http.StatusOK, apiRoom{ID: toId(id), Joining: true})
+		} else {
+			apiError(w, http.StatusNotFound, "not in "+toId(id))
+		}
+		return
+	}
+
+	users := make([]string, 0, len(room.Users))
+	for _, user := range room.Users {
+		users = append(users, user)
+	}
+	sortUsers(users)
+	writeJSON(w, http.StatusOK, apiRoom{
+		ID:        room.ID,
+		Title:     room.Title,
+		UserCount: len(users),
+		Users:     users,
+	})
+}
+
+func (bot *Bot) apiMessage(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Room string
+		Text string
+		HTML string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, "could not read the body: "+
+			err.Error())
+		return
+	}
+
+	room := targetId(body.Room)
+	text := strings.TrimSpace(body.Text)
+	html := strings.TrimSpace(body.HTML)
+	switch {
+	case room == "" || room == "user:":
+		apiError(w, http.StatusBadRequest, "give a room, or user:name")
+		return
+	case text == "" && html == "":
+		apiError(w, http.StatusBadRequest, "give text or html to send")
+		return
+	case !strings.HasPrefix(room, "user:") && !bot.InRoom(room):
+		apiError(w, http.StatusNotFound, "not in "+room)
+		return
+	}
+
+	if html != "" && !strings.HasPrefix(room, "user:") &&
+		bot.CanUseHTML(room) {
+		// the text is sent instead if the server refuses the !htmlbox
+		if text != "" {
+			bot.setHTMLFallback(room, []string{text})
+		}
+		text = "!htmlbox " + strings.Replace(html, "\n", "", -1)
+	} else if text == "" {
+		apiError(w, http.StatusConflict, "the bot can't use !htmlbox in "+
+			room+"; give text to send instead")
+		return
+	}
+
+	bot.Logger(LogHTTP).Info("sending from the API", "room", room,
+		"text", text)
+	bot.QueueMessage(text, room)
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"room": room,
+		"sent": text,
+	})
+}
+
+func (bot *Bot) apiCommand(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Command string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, "could not read the body: "+
+			err.Error())
+		return
+	}
+
+	room := fmt.Sprintf("%s%d", apiRoomPrefix,
+		atomic.AddInt64(&apiCommandSeq, 1))
+	replies := make(chan string, eventBuffer)
+	bot.AddReplySink(room, func(text string) {
+		select {
+		case replies <- text:
+		default:
+		}
+	})
+	defer bot.RemoveReplySink(room)
+
+	bot.Logger(LogHTTP).Info("running command from the API",
+		"command", body.Command)
+	if err := bot.RunAsOwner(room, strings.TrimSpace(body.Command)); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// some commands reply from another goroutine, so wait a little for them
+	said := []string{}
+	deadline := time.After(apiCommandTimeout)
+	for waiting := true; waiting; {
+		select {
+		case reply := <-replies:
+			said = append(said, reply)
+		case <-time.After(apiReplyWait):
+			waiting = false
+		case <-deadline:
+			waiting = false
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"replies": said})
+}
+
+func (bot *Bot) apiEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	rooms := req.URL.Query()["room"]
+	types := req.URL.Query()["type"]
+
+	events := bot.events.subscribe()
+	defer bot.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(apiKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if (len(rooms) > 0 && !contains(rooms, e.Room)) ||
+				(len(types) > 0 && !contains(types, e.Type)) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Returns the id of a room, or of a user if it is of the form user:name.
+func targetId(room string) string {
+	room = strings.TrimSpace(room)
+	if strings.HasPrefix(room, "user:") {
+		return "user:" + toId(strings.TrimPrefix(room, "user:"))
+	}
+	return toId(room)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// Adds the API to the bot's HTTP server.
+func (bot *Bot) CreateAPI() {
+	bot.HandleHTTP(APIPath, bot.RequireAPIToken(http.HandlerFunc(
+		bot.ServeAPI)))
+}
@@ -10,38 +10,83 @@
 package gobot
 
 import (
-	"github.com/TalkTakesTime/hookserve/hookserve"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
-	"github.com/tonnerre/golang-pretty"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	BufferSize = 4096
+
+	// how long `Bot.runInMainLoop` waits for the main loop
+	mainLoopTimeout = 5 * time.Second
+	// how long `Bot.Run` waits before reconnecting. The wait doubles each
+	// time connecting fails, up to the maximum
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
 )
 
-var PingTicker *time.Ticker
+var (
+	ErrMainLoopBusy = errors.New("the bot is busy, try again")
+)
 
 type Bot struct {
 	// a Config struct representing the settings for the bot to use when it
-	// runs. A config can be loaded from file using `gobot.GetConfig()`.
-	// see config.go and main/gobot.go for more information
+	// runs. A config can be loaded from file using
+	// `gobot.GetConfig(filename)`. see config.go and main/gobot.go for more
+	// information
 	config Config
+	// guards config, templates and issues, which can be replaced when the
+	// config is reloaded. They are only ever replaced by the main loop, so
+	// it can read them without locking, but anything running in another
+	// goroutine, such as the HTTP server, must hold a read lock or use
+	// `Bot.Config()`. See reload.go
+	configMu sync.RWMutex
+	// receives SIGHUP, which reloads the config
+	reloadSignal chan os.Signal
+	// the rooms given in the config file, as opposed to the rooms the bot
+	// is in. Reloading the config only joins or leaves rooms whose entries
+	// in the file changed, so that rooms joined with .join are kept
+	configRooms map[string]int64
+	// the loggers for each part of the bot. See logging.go
+	logging *Logging
+	// rooms being joined with .join, mapped to the room to report back to
+	// once the join succeeds or fails. See roomlist.go
+	pendingJoins map[string]string
 
-	// the websocket connection for the bot to use to communicate with the
-	// server. It is created in `Bot.Start()` so there is no need to generate
-	// one yourself
-	ws *websocket.Conn
+	// whether the bot has been set up, and the error it gave. See
+	// `Bot.SetUp`
+	setUpOnce sync.Once
+	setUpErr  error
+	// the state of the connection, for health checks. See health.go
+	conn   connState
+	connMu sync.Mutex
 
 	// queues to store messages while they wait to be processed or sent.
 	// Created by `CreateBot` with a default capacity of 100, to allow
 	// delayed processing and asynchronicity.
 	inQueue  chan string
-	outQueue chan string
+	outQueue chan queuedMessage
+	// the messages in outQueue, oldest first, so that they can be shown on
+	// the dashboard. Guarded by queueMu
+	queued   []queuedMessage
+	queueSeq int64
+	queueMu  sync.Mutex
+	// functions to run in the main loop, for changes made from other
+	// goroutines such as the dashboard. See `Bot.runInMainLoop`
+	actions chan func()
+	// receives the error that stops the bot, which `Bot.Start` returns. See
+	// `Bot.Stop`
+	stopped chan error
 
 	// a map of commands, mapping the command name to a handler function. If
 	// a message is received that starts with the command character
@@ -49,8 +94,93 @@ type Bot struct {
 	// execute the handler on the given message.
 	commands map[string]func(Message)
 
-	// the server that listens for github webooks
-	hookServer *hookserve.Server
+	// the log of recent github webhook deliveries. Only created if hooks
+	// are enabled. See deliveries.go
+	deliveries *DeliveryLog
+
+	// the bot's HTTP server, which webhooks, short links etc are served
+	// from. See httpserver.go
+	httpMux *http.ServeMux
+	// the running HTTP server, if any. Replaced if the port it listens on
+	// changes
+	httpServer *http.Server
+	// whether httpMux is served by a Manager's shared HTTP server rather
+	// than one of the bot's own. See manager.go
+	sharedHTTP bool
+
+	// persistent storage for anything that should survive a restart. It is
+	// kept in the directory given by `config.DataDir`
+	store *Store
+
+	// the shortener used to shorten URLs in webhook messages. See
+	// shortener.go
+	shortener Shortener
+
+	// the parsed templates for webhook announcements, keyed by room. The
+	// templates for rooms without their own are stored under "". See
+	// templates.go
+	templates map[string]*HookTemplates
+
+	// the bot's metrics, which are served at /metrics if
+	// config.EnableMetrics is set. See metrics.go
+	metrics *Metrics
+	// when the bot started logging in, for timing it
+	loginStart time.Time
+	// rooms whose messages are handed to a function rather than sent to
+	// PS!, such as the console's. Guarded by sinksMu. See
+	// `Bot.AddReplySink`
+	replySinks map[string]func(string)
+	sinksMu    sync.RWMutex
+	// hands the messages the bot receives to the API's event streams. See
+	// api.go
+	events eventHub
+	// the outgoing webhooks events are forwarded to, or nil if there are
+	// none. See outhooks.go
+	outhooks *OutHooks
+	// the bridge to IRC, or nil if it is disabled. See irc.go
+	irc *IRCBridge
+	// when and where users were last seen, for .seen. See seen.go
+	seen *SeenLog
+	// the messages left with .tell that are waiting to be delivered, keyed
+	// by the recipient's id. Only used from the main loop. See mail.go
+	mail map[string][]Mail
+	// the commands added from chat, keyed by scope and then name. Only used
+	// from the main loop. See customcommands.go
+	customCommands map[string]map[string]CustomCommand
+	// the quotes added with .addquote. See quotes.go
+	quotes *QuoteBook
+	// the last few commands used and errors logged, for the dashboard. See
+	// dashboard.go
+	recent recentActivity
+	// whether the aliases for .git have been changed and saved, in which
+	// case they are kept when the config is reloaded. See aliases.go
+	aliasesSaved bool
+
+	// the archive of what is said in the bot's rooms, or nil if chat logs
+	// are disabled. See chatlog.go
+	chatlog *ChatLog
+
+	// the index of git repositories used by .git. See gitindex.go
+	repos RepoProvider
+
+	// looks up issues and pull requests for .issue and .pr. See issues.go
+	issues IssueProvider
+
+	// the bot's record of the rooms it is in, keyed by room id. Guarded by
+	// roomsMu, since it is also read when webhooks are announced. See
+	// rooms.go
+	rooms   map[string]*Room
+	roomsMu sync.RWMutex
+}
+
+// A message waiting to be sent.
+type queuedMessage struct {
+	id   int64
+	data string
+	// the room the message is for, as given to `Bot.QueueMessage`
+	room string
+	// when the message was queued
+	queued time.Time
 }
 
 // Simple error handler. Will probably improve it at some point.
@@ -60,36 +190,100 @@ func checkError(err error) {
 	}
 }
 
-// Receives messages from PS and queues them up to be handled. Use as a
-// goroutine or otherwise it will loop infinitely.
-func (bot *Bot) Receive() {
+// Stops the bot, making `Bot.Start` return err. Only the first error is
+// kept if this is used more than once. Safe to use from any goroutine.
+func (bot *Bot) Stop(err error) {
+	select {
+	case bot.stopped <- err:
+	default:
+	}
+}
+
+// Stops the bot because of a problem with the connection that done belongs
+// to, unless that connection has already been closed, so that an old
+// connection can't stop a new one.
+func (bot *Bot) connectionFailed(done <-chan struct{}, err error) {
+	select {
+	case <-done:
+	default:
+		bot.setConnected(false)
+		bot.Stop(err)
+	}
+}
+
+// Receives messages from PS and queues them up to be handled, until the
+// connection is lost or done is closed. Use as a goroutine.
+func (bot *Bot) Receive(ws *websocket.Conn, done <-chan struct{}) {
 	for {
-		msgType, msg, err := bot.ws.ReadMessage()
-		checkError(err)
+		msgType, msg, err := ws.ReadMessage()
+		if err != nil {
+			bot.connectionFailed(done, fmt.Errorf("lost connection to "+
+				"PS!: %s", err))
+			return
+		}
 
 		if msgType != websocket.TextMessage {
-			log.Println("unexpected message type:", msg)
+			bot.Logger(LogTransport).Error("unexpected message type",
+				"type", msgType, "message", msg)
+			bot.connectionFailed(done, fmt.Errorf("unexpected message "+
+				"type %d", msgType))
 			return
 		}
+		bot.messageReceived()
 
-		// log.Printf("\nReceived: %s.\n", msg)
+		bot.Logger(LogTransport).Debug("received", "message", string(msg))
 		bot.inQueue <- string(msg)
 	}
 }
 
+// Returns a copy of the bot's config, which is safe to use from any
+// goroutine.
+func (bot *Bot) Config() Config {
+	bot.configMu.RLock()
+	defer bot.configMu.RUnlock()
+	return bot.config
+}
+
 // Causes the bot to join the given room and record when it joined in
 // bot.config.Rooms
 func (bot *Bot) JoinRoom(room string) {
 	// track when the bot joined the room
+	bot.configMu.Lock()
 	bot.config.Rooms[room] = time.Now().Unix()
+	bot.configMu.Unlock()
 	bot.QueueMessage("/join "+room, "")
 }
 
+// Causes the bot to leave the given room and removes it from
+// bot.config.Rooms
+func (bot *Bot) LeaveRoom(room string) {
+	bot.configMu.Lock()
+	delete(bot.config.Rooms, room)
+	bot.configMu.Unlock()
+	bot.QueueMessage("/leave "+room, "")
+}
+
 // Adds a message for the given room to the outgoing queue. If the message
 // is a PM, the room should be of the form "user:name", and the message
 // will automatically get sent as a PM, so there is no need to add "/pm user, "
-// to the front.
+// to the front. Messages for a room with a reply sink are handed to the
+// sink instead.
 func (bot *Bot) QueueMessage(text, room string) {
+	if isSinkRoom(room) {
+		bot.sinksMu.RLock()
+		sink := bot.replySinks[room]
+		bot.sinksMu.RUnlock()
+		if sink != nil {
+			sink(text)
+		} else {
+			// its sink has gone, e.g. a command run over the API replied
+			// after the request finished
+			bot.Logger(LogTransport).Debug("dropped reply", "room", room,
+				"message", text)
+		}
+		return
+	}
+
 	var msgData string
 	if strings.HasPrefix(room, "user:") {
 		msgData = "|/pm " + room[strings.Index(room, "user:")+5:] +
@@ -98,95 +292,336 @@ func (bot *Bot) QueueMessage(text, room string) {
 		msgData = room + "|" + text
 	}
 
-	bot.outQueue <- msgData
+	bot.queueMu.Lock()
+	bot.queueSeq++
+	msg := queuedMessage{bot.queueSeq, msgData, room, time.Now()}
+	bot.queued = append(bot.queued, msg)
+	bot.queueMu.Unlock()
+
+	bot.outQueue <- msg
+}
+
+// Has messages for the given room handed to sink rather than sent to PS!,
+// so that replies to commands can be shown somewhere else, such as the
+// console. The room should contain a colon and not start with user:, so
+// that it can't clash with a real room or a PM.
+func (bot *Bot) AddReplySink(room string, sink func(string)) {
+	bot.sinksMu.Lock()
+	defer bot.sinksMu.Unlock()
+	if bot.replySinks == nil {
+		bot.replySinks = make(map[string]func(string))
+	}
+	bot.replySinks[room] = sink
+}
+
+// Removes the sink for the given room. Later messages for it are dropped.
+func (bot *Bot) RemoveReplySink(room string) {
+	bot.sinksMu.Lock()
+	defer bot.sinksMu.Unlock()
+	delete(bot.replySinks, room)
+}
+
+// Returns true if the given room can only be a reply sink's, since real
+// room ids can't contain colons.
+func isSinkRoom(room string) bool {
+	return strings.Contains(room, ":") && !strings.HasPrefix(room, "user:")
+}
+
+// Returns the messages waiting to be sent, oldest first.
+func (bot *Bot) queuedMessages() []queuedMessage {
+	bot.queueMu.Lock()
+	defer bot.queueMu.Unlock()
+	return append([]queuedMessage(nil), bot.queued...)
+}
+
+// Removes a message that has been taken from the out queue from
+// bot.queued.
+func (bot *Bot) dequeued(id int64) {
+	bot.queueMu.Lock()
+	defer bot.queueMu.Unlock()
+	for i, msg := range bot.queued {
+		if msg.id == id {
+			bot.queued = append(bot.queued[:i], bot.queued[i+1:]...)
+			return
+		}
+	}
 }
 
 // Sends a queued message through the websocket connection
-func (bot *Bot) SendMessage(msg string) {
-	log.Printf("\nSent message: %s\n", msg)
-	err := bot.ws.WriteMessage(websocket.TextMessage, []byte(msg))
-	checkError(err)
+func (bot *Bot) SendMessage(ws *websocket.Conn, msg queuedMessage) error {
+	bot.Logger(LogTransport).Debug("sent", "message", msg.data)
+	bot.metrics.QueueWait.Since(msg.queued)
+	err := ws.WriteMessage(websocket.TextMessage, []byte(msg.data))
+	if err != nil {
+		return err
+	}
+	bot.metrics.MessagesSent.Inc(bot.metricRoom(msg.room))
+	return nil
 }
 
 // Reads messages from the out queue and sends them to PS, one each 0.5s or so
-// to avoid the chat queue at the PS end filling up and blocking more messages
-func (bot *Bot) Send() {
+// to avoid the chat queue at the PS end filling up and blocking more messages.
+// The server is pinged once a minute to keep the connection alive. Stops the
+// bot if a message can't be sent, and returns once done is closed.
+func (bot *Bot) Send(ws *websocket.Conn, done <-chan struct{}) {
+	pingTicker := time.NewTicker(time.Minute)
+	defer pingTicker.Stop()
 	for {
 		select {
+		case <-done:
+			return
 		case msg := <-bot.outQueue:
-			bot.SendMessage(msg)
+			bot.dequeued(msg.id)
+			if err := bot.SendMessage(ws, msg); err != nil {
+				bot.connectionFailed(done, fmt.Errorf("could not send to "+
+					"PS!: %s", err))
+				return
+			}
 			time.Sleep(500 * time.Millisecond)
-		case <-PingTicker.C:
-			err := bot.ws.WriteControl(websocket.PingMessage, []byte("ping"),
+		case <-pingTicker.C:
+			err := ws.WriteControl(websocket.PingMessage, []byte("ping"),
 				time.Now().Add(10*time.Second))
 			if err != nil {
-				pretty.Log(err)
+				bot.Logger(LogTransport).Warn("could not send ping",
+					"error", err)
 			}
 		}
 	}
 }
 
-// Begins the main loop of the bot, which keeps it running indefinitely (or
-// until it crashes, since I haven't given it any form of crash handling yet.)
-func (bot *Bot) MainLoop() {
+// Begins the main loop of the bot, which keeps it running until it is
+// stopped. Returns the error it was stopped with. See `Bot.Stop`
+func (bot *Bot) MainLoop() error {
 	for {
 		select {
+		case err := <-bot.stopped:
+			return err
 		case rawMsg := <-bot.inQueue:
 			messages := bot.ParseRawMessage(rawMsg)
 			for _, msg := range messages {
-				pretty.Log(msg)
+				bot.metrics.MessagesReceived.Inc(bot.metricRoom(msg.room))
+				bot.Logger(LogParser).Debug("parsed", "room", msg.room,
+					"type", msg.msgType, "args", msg.args)
 				bot.ParseMessage(msg)
 			}
+		case <-bot.reloadSignal:
+			bot.ReloadAndReport("")
+		case action := <-bot.actions:
+			action()
+		}
+	}
+}
+
+// Runs f in the main loop and waits for it to finish, so that changes made
+// from other goroutines don't race with the main loop. Returns
+// ErrMainLoopBusy if the main loop doesn't get to it in time.
+func (bot *Bot) runInMainLoop(f func()) error {
+	done := make(chan struct{})
+	timeout := time.After(mainLoopTimeout)
+	select {
+	case bot.actions <- func() { f(); close(done) }:
+	case <-timeout:
+		return ErrMainLoopBusy
+	}
+	select {
+	case <-done:
+		return nil
+	case <-timeout:
+		return ErrMainLoopBusy
+	}
+}
+
+// Runs the bot until the process exits, reconnecting whenever it is stopped,
+// e.g. because the connection was lost. The wait before reconnecting grows
+// while connecting keeps failing. Only returns if the bot can't be set up.
+func (bot *Bot) Run() error {
+	if err := bot.SetUp(); err != nil {
+		return err
+	}
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := bot.Start()
+		if time.Since(started) > maxReconnectDelay {
+			// it was connected for a while, so start waiting afresh
+			delay = minReconnectDelay
+		}
+		bot.Logger(LogBot).Error("stopped", "error", err, "retry", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
 		}
 	}
 }
 
-// Connects to PS! and begins the bot running.
-func (bot *Bot) Start() {
+// Connects to PS! and begins the bot running, setting it up first if it
+// hasn't been already. Returns the error that stopped it, such as the
+// connection being lost. Nothing else about the process is affected, so other
+// bots keep running, and the bot can be started again to reconnect.
+func (bot *Bot) Start() error {
+	if err := bot.SetUp(); err != nil {
+		return err
+	}
+	// anything that stopped the last connection is over with
+	select {
+	case <-bot.stopped:
+	default:
+	}
+
 	conn, err := net.Dial("tcp", bot.config.Server+":"+bot.config.Port)
-	checkError(err)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("\nConnecting to %s\n\n", bot.config.URL.String())
+	bot.Logger(LogTransport).Info("connecting", "url",
+		bot.config.URL.String())
 
-	var res *http.Response
-	bot.ws, res, err = websocket.NewClient(conn, bot.config.URL, http.Header{
+	ws, res, err := websocket.NewClient(conn, bot.config.URL, http.Header{
 		"Origin": []string{"https://play.pokemonshowdown.com"},
 	}, BufferSize, BufferSize)
 	if err != nil {
-		pretty.Logf("%s: %#v\n", err.Error(), res)
-		log.Fatal()
+		status := ""
+		if res != nil {
+			status = res.Status
+		}
+		bot.Logger(LogTransport).Error("could not connect", "error", err,
+			"status", status)
+		conn.Close()
+		return err
 	}
 
-	PingTicker = time.NewTicker(time.Minute)
-	bot.ws.SetPongHandler(func(s string) error {
-		pretty.Log("received pong:", s)
+	// the rooms are joined again once the bot has logged in
+	bot.clearRooms()
+	bot.setConnected(true)
+
+	ws.SetPongHandler(func(s string) error {
+		bot.Logger(LogTransport).Debug("received pong", "data", s)
+		bot.pongReceived()
 		return nil
 	})
 
+	done := make(chan struct{})
 	defer res.Body.Close()
-	defer bot.ws.Close()
-	defer PingTicker.Stop()
+	defer ws.Close()
+	defer close(done)
+	defer bot.setConnected(false)
+
+	go bot.Receive(ws, done)
+	go bot.Send(ws, done)
+	return bot.MainLoop()
+}
 
-	go bot.Receive()
-	go bot.Send()
+// Sets up everything the bot runs apart from its connection to PS!, such as
+// its HTTP server, webhooks and IRC bridge. Only the first use does
+// anything; later ones return the same error.
+func (bot *Bot) SetUp() error {
+	bot.setUpOnce.Do(func() {
+		bot.setUpErr = bot.setUp()
+	})
+	return bot.setUpErr
+}
+
+func (bot *Bot) setUp() error {
+	if clones, ok := bot.repos.(*CloneProvider); ok {
+		go clones.Start()
+	}
 	if bot.config.EnableHooks {
-		bot.CreateHook() // creates and starts the server for github webhooks
+		bot.CreateHook() // creates the receiver for github webhooks
 	}
-
-	bot.MainLoop()
+	if bot.config.EnableMetrics {
+		if err := bot.StartMetrics(); err != nil {
+			return err
+		}
+	}
+	if bot.config.EnableHealth {
+		bot.CreateHealthChecks()
+	}
+	if bot.config.EnableDashboard {
+		bot.CreateDashboard()
+	}
+	if bot.config.EnableAPI {
+		bot.CreateAPI()
+	}
+	if bot.outhooks != nil {
+		bot.outhooks.Start()
+	}
+	if bot.irc != nil {
+		go bot.irc.Run()
+	}
+	go bot.seen.Start()
+	if bot.config.NeedsHTTP() && !bot.sharedHTTP {
+		if err := bot.StartHTTP(); err != nil {
+			return err
+		}
+	}
+	signal.Notify(bot.reloadSignal, syscall.SIGHUP)
+	return nil
 }
 
 // Creates and returns a bot using the given configuration, loading the
 // commands in commands.go
-func CreateBot(conf Config) Bot {
-	bot := Bot{
+func CreateBot(conf Config) *Bot {
+	return createBot(conf, false)
+}
+
+// Creates a bot as CreateBot does. sharedHTTP should be true if a Manager
+// serves its HTTP handlers, which has to be known before the handlers are
+// created so that links to them are right.
+func createBot(conf Config, sharedHTTP bool) *Bot {
+	// the rooms from the file are kept apart from the rooms the bot is in,
+	// which change as it joins and leaves them
+	configRooms := make(map[string]int64, len(conf.Rooms))
+	for room, joinTime := range conf.Rooms {
+		configRooms[room] = joinTime
+	}
+	bot := &Bot{
 		config:   conf,
 		inQueue:  make(chan string, 100),
-		outQueue: make(chan string, 100),
+		outQueue: make(chan queuedMessage, 100),
 		// this currently isn't actually needed I don't think, so I should
 		// probably remove it
 		commands: make(map[string]func(Message)),
+		httpMux:  http.NewServeMux(),
+		store:    NewStore(conf.DataDir),
+		rooms:    make(map[string]*Room),
+		// SIGHUP is the only signal sent here
+		reloadSignal: make(chan os.Signal, 1),
+		configRooms:  configRooms,
+		pendingJoins: make(map[string]string),
+		logging:      NewLogging(conf, LogOutput),
+		actions:      make(chan func()),
+		stopped:      make(chan error, 1),
+		sharedHTTP:   sharedHTTP,
+	}
+	bot.CreateMetrics()
+	bot.logging.OnError(bot.errorLogged)
+	bot.logConfigWarnings(conf)
+	bot.config.Rooms = make(map[string]int64, len(conf.Rooms))
+	for room, joinTime := range conf.Rooms {
+		bot.config.Rooms[room] = joinTime
+	}
+	checkError(bot.LoadRooms())
+	checkError(bot.LoadAliases())
+	bot.shortener = bot.CreateShortener()
+	var err error
+	bot.chatlog, err = bot.CreateChatLog()
+	checkError(err)
+	bot.outhooks, err = bot.CreateOutHooks()
+	checkError(err)
+	bot.irc = bot.CreateIRCBridge()
+	bot.seen, err = bot.CreateSeenLog()
+	checkError(err)
+	checkError(bot.LoadMail())
+	checkError(bot.LoadCustomCommands())
+	bot.quotes, err = bot.CreateQuoteBook()
+	checkError(err)
+	if conf.EnableHooks {
+		bot.deliveries = NewDeliveryLog(bot.store, conf.HookLogSize,
+			bot.Logger(LogHooks))
 	}
+	checkError(bot.LoadTemplates())
+	bot.repos = bot.CreateRepoProvider()
+	bot.issues = bot.CreateIssueProvider()
 	bot.LoadCommands()
 	return bot
 }
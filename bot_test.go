@@ -0,0 +1,42 @@
+package gobot
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// Creates a bot for tests, which keeps its data in a temporary directory and
+// queues its messages without sending them anywhere.
+func newTestBot(t *testing.T, conf Config) *Bot {
+	if conf.CommandChar == "" {
+		conf.CommandChar = "."
+	}
+	if conf.Nick == "" {
+		conf.Nick = "gobot"
+	}
+	bot := &Bot{
+		config:   conf,
+		outQueue: make(chan queuedMessage, 100),
+		store:    NewStore(t.TempDir()),
+		rooms:    make(map[string]*Room),
+		logging:  NewLogging(conf, ioutil.Discard),
+		metrics:  NewMetrics(),
+		stopped:  make(chan error, 1),
+	}
+	bot.LoadCommands()
+	return bot
+}
+
+// Returns what the bot has queued to send since it was last asked, as it
+// would be sent to PS!.
+func sentMessages(bot *Bot) []string {
+	sent := []string{}
+	for {
+		select {
+		case msg := <-bot.outQueue:
+			sent = append(sent, msg.data)
+		default:
+			return sent
+		}
+	}
+}
@@ -11,11 +11,13 @@ package gobot
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var (
@@ -41,6 +43,16 @@ func toId(str string) string {
 	return IdRegex.ReplaceAllString(strings.ToLower(str), "")
 }
 
+// Returns the id of the given room. Unlike toId, the dashes between the
+// parts of battle and groupchat ids, e.g. battle-gen7ou-1234, are kept.
+func toRoomId(str string) string {
+	parts := strings.Split(str, "-")
+	for i, part := range parts {
+		parts[i] = toId(part)
+	}
+	return strings.Trim(strings.Join(parts, "-"), "-")
+}
+
 // Takes a single raw message from PS! and breaks it up into individual
 // messages to respond to, returning a slice of Messages to be dealt with
 // by the main parser.
@@ -49,6 +61,7 @@ func (bot *Bot) ParseRawMessage(rawMsg string) []Message {
 	msgList := strings.Split(rawMsg, "\n")
 
 	var room string
+	initialising := false
 	for _, msg := range msgList {
 		if strings.HasPrefix(msg, ">") {
 			// a message of the form ">ROOMID"
@@ -56,12 +69,17 @@ func (bot *Bot) ParseRawMessage(rawMsg string) []Message {
 			continue
 		}
 
+		if initialising && !strings.HasPrefix(msg, "|title|") &&
+			!strings.HasPrefix(msg, "|users|") {
+			// apart from the room's title and users, we don't actually care
+			// about the rest of the messages in this -- they're all messages
+			// from before the joining, so we don't want to respond to them
+			continue
+		}
+
 		messages = append(messages, NewMessage(room, msg))
 		if strings.HasPrefix(msg, "|init|") {
-			// we don't actually care about the rest of the messages in this
-			// they're all messages from before the joining, so we don't want
-			// to respond to them
-			break
+			initialising = true
 		}
 	}
 
@@ -71,6 +89,19 @@ func (bot *Bot) ParseRawMessage(rawMsg string) []Message {
 // Parses a non-raw message and determines what action to take in reponse.
 // Currently most messages are ignored.
 func (bot *Bot) ParseMessage(msg Message) {
+	if bot.chatlog != nil {
+		bot.ArchiveMessage(msg)
+	}
+	bot.PublishMessage(msg)
+	if bot.outhooks != nil {
+		bot.SendToOutHooks(msg)
+	}
+	if bot.irc != nil {
+		bot.irc.RelayToIRC(msg)
+	}
+	bot.RecordSighting(msg)
+	bot.DeliverMail(msg)
+
 	switch msg.msgType {
 	case "challstr":
 		bot.LogIn(msg)
@@ -81,22 +112,42 @@ func (bot *Bot) ParseMessage(msg Message) {
 		}
 		if strings.HasPrefix(msg.args[1], bot.config.CommandChar) {
 			bot.RunCommand(msg)
+		} else if bot.config.ExpandIssues {
+			bot.ExpandIssues(msg)
 		}
 	case "updateuser":
+		bot.setLoggedIn(msg.args[1] == "1", msg.args[0])
 		if msg.args[1] == "1" { // the bot is logged in
+			if !bot.loginStart.IsZero() {
+				bot.metrics.LoginDuration.Since(bot.loginStart)
+				bot.loginStart = time.Time{}
+			}
 			for room := range bot.config.Rooms {
 				bot.JoinRoom(room)
 			}
 		}
+	case "init", "deinit", "title", "users", "j", "J", "join", "l", "L",
+		"leave", "n", "N", "name":
+		bot.UpdateRoom(msg)
+		if msg.msgType == "init" {
+			bot.roomJoined(msg.room)
+		} else if msg.msgType == "deinit" {
+			bot.roomLeft(msg.room)
+		}
+	case "noinit":
+		bot.JoinFailed(msg)
+	case "error", "":
+		bot.CheckHTMLDenied(msg)
 	}
 }
 
-// Checks if the given command exists and executes the function it refers
+// Checks if the given command exists, either as one of the bot's own
+// commands or a custom one for the room, and executes the function it refers
 // to if it does. Otherwise ignores the command.
 func (bot *Bot) RunCommand(msg Message) {
 	cmd := bot.GetCommand(msg.args[1])
 	if cmd != "" && msg.args[0] != bot.config.Nick {
-		if _, ok := bot.commands[cmd]; ok {
+		if run, ok := bot.lookupCommand(msg.room, cmd); ok {
 			// trim the command name from the args and add it as the third
 			// element in msg.args
 			msg.args[1] = strings.TrimSpace(strings.TrimPrefix(msg.args[1],
@@ -104,7 +155,21 @@ func (bot *Bot) RunCommand(msg Message) {
 			msg.args = append(msg.args[:2], append([]string{cmd},
 				msg.args[2:]...)...)
 
-			bot.commands[cmd](msg)
+			start := time.Now()
+			run(msg)
+			bot.metrics.Commands.Inc(cmd)
+			bot.metrics.CommandDuration.Since(start, cmd)
+			bot.recent.addCommand(recentCommand{
+				Time:     start,
+				Room:     msg.room,
+				User:     msg.args[0],
+				Command:  cmd,
+				Args:     msg.args[1],
+				Duration: time.Since(start),
+			})
+			if bot.outhooks != nil {
+				bot.SendCommandToOutHooks(msg)
+			}
 		}
 	}
 }
@@ -125,10 +190,12 @@ func (bot *Bot) GetCommand(msg string) string {
 }
 
 // Log in to PS! under the given name and password. See PS! documentation
-// if you want to understand exactly what is required for login.
+// if you want to understand exactly what is required for login. The bot is
+// stopped if it can't log in.
 func (bot *Bot) LogIn(challstr Message) {
 	var res *http.Response
 	var err error
+	bot.loginStart = time.Now()
 
 	// NOTE: This part does not match the PS! documentation.
 	//
@@ -155,11 +222,17 @@ func (bot *Bot) LogIn(challstr Message) {
 			"challenge":      {challstr.args[1]},
 		})
 	}
-	checkError(err)
+	if err != nil {
+		bot.Stop(fmt.Errorf("could not log in: %s", err))
+		return
+	}
 	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
-	checkError(err)
+	if err != nil {
+		bot.Stop(fmt.Errorf("could not log in: %s", err))
+		return
+	}
 
 	// NOTE: This part does not match the PS! documentation.
 	//
@@ -171,16 +244,19 @@ func (bot *Bot) LogIn(challstr Message) {
 	// in the `assertion` field. Because of this, the body of the HTTP response
 	// can be used directly in /trn without needing to parse it as JSON.
 	if bot.config.Pass == "" {
-		bot.outQueue <- "|/trn " + bot.config.Nick + ",0," + string(body)
+		bot.QueueMessage("/trn "+bot.config.Nick+",0,"+string(body), "")
 	} else {
 		type LoginDetails struct {
 			Assertion string
 		}
 		data := LoginDetails{}
 		err = json.Unmarshal(body[1:], &data)
-		checkError(err)
+		if err != nil {
+			bot.Stop(fmt.Errorf("could not log in: %s", err))
+			return
+		}
 
-		bot.outQueue <- "|/trn " + bot.config.Nick + ",0," + data.Assertion
+		bot.QueueMessage("/trn "+bot.config.Nick+",0,"+data.Assertion, "")
 	}
 }
 
@@ -0,0 +1,470 @@
+/*
+ * Archives what is said in the rooms the bot is in. Every chat message, join,
+ * leave and rename is written to a file per room per day, in
+ * config.ChatLogDir, as lines of text such as
+ *   [12:00:00] @Name: hello
+ *   [12:00:05] *** Name joined
+ * and, if config.ChatLogJSON is set, as JSON Lines alongside them. Files older
+ * than config.ChatLogDays are deleted.
+ *
+ * Staff can get the log for a day with .logs, which PMs them a link to it on
+ * the bot's HTTP server. Links are signed and only work for an hour, so they
+ * can't be guessed or passed around for long.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChatLogPath = "/chatlogs/"
+
+	// the rank needed to use .logs if config.ChatLogRank isn't given
+	DefaultChatLogRank = "%"
+	// how long links given by .logs work for
+	chatLogLinkLife = time.Hour
+	// the name the key used to sign links is saved under in the store
+	chatLogKeyStore = "chatlogkey"
+
+	chatLogDate = "2006-01-02"
+)
+
+const (
+	ChatLogChat   = "chat"
+	ChatLogJoin   = "join"
+	ChatLogLeave  = "leave"
+	ChatLogRename = "rename"
+)
+
+var (
+	ErrBadChatLogDate = errors.New("dates should be given as YYYY-MM-DD")
+
+	// matches the file names chat logs are served as, e.g.
+	// techcode/2015-06-01.txt or battle-gen7ou-1234/2015-06-01.txt
+	chatLogFileRegex = regexp.MustCompile(
+		`^([a-z0-9]+(?:-[a-z0-9]+)*)/([0-9]{4}-[0-9]{2}-[0-9]{2})\.(txt|jsonl)$`)
+)
+
+// A single line of a chat log.
+type ChatLogEntry struct {
+	Time time.Time
+	Room string
+	// one of chat, join, leave or rename
+	Type string
+	// the user, including their rank, e.g. "@Name"
+	User string
+	// what was said, for chat
+	Message string `json:",omitempty"`
+	// the user's old id, for rename
+	OldID string `json:",omitempty"`
+}
+
+// Formats the entry as a line of text, without a trailing newline.
+func (e *ChatLogEntry) String() string {
+	line := "[" + e.Time.Format("15:04:05") + "] "
+	_, name := splitUser(e.User)
+	switch e.Type {
+	case ChatLogJoin:
+		return line + "*** " + name + " joined"
+	case ChatLogLeave:
+		return line + "*** " + name + " left"
+	case ChatLogRename:
+		return line + "*** " + e.OldID + " is now known as " + name
+	}
+	// multi-line messages such as /code are kept on one line, so that every
+	// line of the file starts with a time
+	return line + strings.TrimSpace(e.User) + ": " +
+		strings.Replace(e.Message, "\n", " ", -1)
+}
+
+// The open files for a room's log for a day.
+type chatLogFiles struct {
+	day  string
+	text *os.File
+	json *os.File
+}
+
+// A ChatLog writes chat log entries to a file per room per day.
+type ChatLog struct {
+	dir  string
+	json bool
+	// how many days of logs to keep. 0 keeps them forever
+	days int
+	// the key links to logs are signed with
+	key []byte
+	log *slog.Logger
+
+	mu    sync.Mutex
+	files map[string]*chatLogFiles
+	// the latest day an entry has been written for
+	today string
+}
+
+// Creates a ChatLog that writes to dir, also writing JSON Lines if json is
+// set and keeping logs for the given number of days. Links to logs are
+// signed with key.
+func NewChatLog(dir string, json bool, days int, key []byte,
+	logger *slog.Logger) *ChatLog {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ChatLog{
+		dir:   dir,
+		json:  json,
+		days:  days,
+		key:   key,
+		log:   logger,
+		files: make(map[string]*chatLogFiles),
+	}
+}
+
+// Returns the path of the log for the given room and day, with the given
+// extension: txt or jsonl.
+func (l *ChatLog) Path(room, day, ext string) string {
+	return filepath.Join(l.dir, room, day+"."+ext)
+}
+
+// Writes an entry to its room's log, starting a new file if the day has
+// changed. Failures are logged rather than returned, since there is nothing
+// the bot can do about them.
+func (l *ChatLog) Write(e ChatLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	day := e.Time.Format(chatLogDate)
+	files, err := l.open(e.Room, day)
+	if err != nil {
+		l.log.Error("could not open chat log", "room", e.Room, "error", err)
+		return
+	}
+
+	if _, err = files.text.WriteString(e.String() + "\n"); err != nil {
+		l.log.Error("could not write chat log", "room", e.Room, "error", err)
+	}
+	if files.json != nil {
+		line, _ := json.Marshal(e)
+		if _, err = files.json.Write(append(line, '\n')); err != nil {
+			l.log.Error("could not write chat log", "room", e.Room,
+				"error", err)
+		}
+	}
+
+	if day > l.today {
+		l.today = day
+		// rooms left without a deinit, such as when the connection
+		// drops, would otherwise keep their files open for good
+		for room, files := range l.files {
+			if files.day != day {
+				files.close()
+				delete(l.files, room)
+			}
+		}
+		if l.days > 0 {
+			go l.Prune(e.Time)
+		}
+	}
+}
+
+// Closes the files for the given room's log, once the bot has left it. They
+// are opened again if anything more is written to it.
+func (l *ChatLog) Close(room string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if files, ok := l.files[room]; ok {
+		files.close()
+		delete(l.files, room)
+	}
+}
+
+// Returns the files for the given room and day, opening them and closing
+// the previous day's if needed. l.mu must be held.
+func (l *ChatLog) open(room, day string) (*chatLogFiles, error) {
+	files, ok := l.files[room]
+	if ok && files.day == day {
+		return files, nil
+	}
+	if ok {
+		files.close()
+		delete(l.files, room)
+	}
+
+	if err := os.MkdirAll(filepath.Join(l.dir, room), 0755); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	files = &chatLogFiles{day: day}
+
+	var err error
+	files.text, err = os.OpenFile(l.Path(room, day, "txt"), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if l.json {
+		files.json, err = os.OpenFile(l.Path(room, day, "jsonl"), flags,
+			0644)
+		if err != nil {
+			files.close()
+			return nil, err
+		}
+	}
+
+	l.files[room] = files
+	return files, nil
+}
+
+func (files *chatLogFiles) close() {
+	if files.text != nil {
+		files.text.Close()
+	}
+	if files.json != nil {
+		files.json.Close()
+	}
+}
+
+// Deletes the logs of every room from more than l.days days before now.
+func (l *ChatLog) Prune(now time.Time) {
+	cutoff := now.AddDate(0, 0, -l.days).Format(chatLogDate)
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*", "*"))
+	if err != nil {
+		return
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+		day := strings.TrimSuffix(name, filepath.Ext(name))
+		if _, err := time.Parse(chatLogDate, day); err != nil {
+			continue // not a log
+		}
+		if day < cutoff {
+			if err := os.Remove(path); err != nil {
+				l.log.Warn("could not delete old chat log", "path", path,
+					"error", err)
+			}
+		}
+	}
+}
+
+// Creates the bot's ChatLog if chat logs are enabled, and serves the logs
+// on the bot's HTTP server.
+func (bot *Bot) CreateChatLog() (*ChatLog, error) {
+	if !bot.config.ChatLogs {
+		return nil, nil
+	}
+
+	dir := bot.config.ChatLogDir
+	if dir == "" {
+		dir = filepath.Join(bot.store.dir, "chatlogs")
+	}
+	key, err := loadChatLogKey(bot.store)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the chat log key: %s", err)
+	}
+
+	bot.HandleHTTP(ChatLogPath, http.HandlerFunc(bot.ServeChatLog))
+	return NewChatLog(dir, bot.config.ChatLogJSON, bot.config.ChatLogDays,
+		key, bot.Logger(LogBot)), nil
+}
+
+// Archives the message if it is one that goes in the chat logs.
+func (bot *Bot) ArchiveMessage(msg Message) {
+	if msg.msgType == "deinit" {
+		// the bot has left the room, so its files aren't needed any more
+		bot.chatlog.Close(msg.room)
+		return
+	}
+	if strings.HasPrefix(msg.room, "user:") || len(msg.args) == 0 {
+		// PMs are private
+		return
+	}
+
+	e := ChatLogEntry{Time: time.Now(), Room: msg.room, User: msg.args[0]}
+	if e.Room == "" {
+		e.Room = "lobby"
+	}
+	switch msg.msgType {
+	case "c", "chat":
+		e.Type = ChatLogChat
+	case "c:":
+		e.Type = ChatLogChat
+		if len(msg.args) > 2 {
+			if ts, err := strconv.ParseInt(msg.args[2], 10, 64); err == nil {
+				e.Time = time.Unix(ts, 0)
+			}
+		}
+	case "j", "J", "join":
+		e.Type = ChatLogJoin
+	case "l", "L", "leave":
+		e.Type = ChatLogLeave
+	case "n", "N", "name":
+		e.Type = ChatLogRename
+		if len(msg.args) > 1 {
+			e.OldID = msg.args[1]
+		}
+	default:
+		return
+	}
+	if e.Type == ChatLogChat && len(msg.args) > 1 {
+		e.Message = msg.args[1]
+	}
+
+	bot.chatlog.Write(e)
+}
+
+// Loads the key used to sign links to chat logs from the store, creating it
+// the first time. The key is kept so that links still work after a restart.
+func loadChatLogKey(store *Store) ([]byte, error) {
+	var saved struct{ Key string }
+	if err := store.Load(chatLogKeyStore, &saved); err != nil {
+		return nil, err
+	}
+	if saved.Key == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		saved.Key = hex.EncodeToString(key)
+		if err := store.Save(chatLogKeyStore, saved); err != nil {
+			return nil, err
+		}
+	}
+	return hex.DecodeString(saved.Key)
+}
+
+// Signs the given file name and expiry time.
+func (l *ChatLog) sign(file string, expires int64) string {
+	mac := hmac.New(sha256.New, l.key)
+	fmt.Fprintf(mac, "%s\n%d", file, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a signed link to the log for the given room and day, which works
+// until it expires.
+func (bot *Bot) ChatLogURL(room, day string) string {
+	file := room + "/" + day + ".txt"
+	expires := time.Now().Add(chatLogLinkLife).Unix()
+	return fmt.Sprintf("%s%s%s?expires=%d&sig=%s", bot.PublicURL(),
+		ChatLogPath, file, expires, bot.chatlog.sign(file, expires))
+}
+
+// Serves a chat log, given a link made by ChatLogURL.
+func (bot *Bot) ServeChatLog(w http.ResponseWriter, req *http.Request) {
+	file := strings.TrimPrefix(req.URL.Path, ChatLogPath)
+	matches := chatLogFileRegex.FindStringSubmatch(file)
+	if matches == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	expires, err := strconv.ParseInt(req.URL.Query().Get("expires"), 10, 64)
+	sig := req.URL.Query().Get("sig")
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(sig), []byte(bot.chatlog.sign(file, expires))) {
+		http.Error(w, "this link is invalid or has expired",
+			http.StatusForbidden)
+		return
+	}
+
+	path := bot.chatlog.Path(matches[1], matches[2], matches[3])
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if matches[3] == "txt" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	http.ServeFile(w, req, path)
+}
+
+// Parses a date given to .logs: YYYY-MM-DD, today or yesterday. Returns it
+// as YYYY-MM-DD.
+func parseChatLogDate(date string) (string, error) {
+	switch strings.ToLower(date) {
+	case "", "today":
+		return time.Now().Format(chatLogDate), nil
+	case "yesterday":
+		return time.Now().AddDate(0, 0, -1).Format(chatLogDate), nil
+	}
+	if _, err := time.Parse(chatLogDate, date); err != nil {
+		return "", ErrBadChatLogDate
+	}
+	return date, nil
+}
+
+// PMs the user a link to a room's chat log for a day. Only users with at
+// least config.ChatLogRank in the room, and owners, can use it.
+//
+// Syntax: .logs [room,] [date]
+// The room defaults to the one the command is used in, and the date, given
+// as YYYY-MM-DD, today or yesterday, defaults to today
+func (bot *Bot) LogsCommand(msg Message) {
+	if bot.chatlog == nil {
+		bot.QueueMessage("Chat logs are disabled.", msg.room)
+		return
+	}
+
+	room, date := msg.room, msg.args[1]
+	if parts := strings.SplitN(msg.args[1], ",", 2); len(parts) == 2 {
+		room, date = toRoomId(parts[0]), strings.TrimSpace(parts[1])
+	} else if _, err := parseChatLogDate(date); err != nil {
+		// a room on its own
+		room, date = toRoomId(date), ""
+	}
+	if room == "" || strings.HasPrefix(room, "user:") {
+		bot.QueueMessage(bot.config.CommandChar+"logs room, [date]",
+			msg.room)
+		return
+	}
+
+	_, name := splitUser(msg.args[0])
+	minRank := bot.config.ChatLogRank
+	if minRank == "" {
+		minRank = DefaultChatLogRank
+	}
+	r, _ := bot.Room(room)
+	if !bot.IsOwner(name) && !RankAtLeast(r.Rank(toId(name)), minRank[0]) {
+		bot.QueueMessage("Only "+minRank+" and above can get the logs of "+
+			room+".", msg.room)
+		return
+	}
+
+	day, err := parseChatLogDate(date)
+	if err != nil {
+		bot.QueueMessage(err.Error(), msg.room)
+		return
+	}
+	// the HTTP server may be a Manager's, so the bot's own isn't checked
+	if !bot.config.NeedsHTTP() || bot.config.PublicURL == "" {
+		bot.QueueMessage("Chat logs can't be linked to, since the HTTP "+
+			"server or publicurl isn't set up.", msg.room)
+		return
+	}
+	if _, err = os.Stat(bot.chatlog.Path(room, day, "txt")); err != nil {
+		bot.QueueMessage("There are no logs of "+room+" for "+day+".",
+			msg.room)
+		return
+	}
+
+	bot.QueueMessage("Logs of "+room+" for "+day+" (the link works for an "+
+		"hour): "+bot.ChatLogURL(room, day), "user:"+toId(name))
+}
@@ -9,20 +9,14 @@
 package gobot
 
 import (
-	"net/http"
-	"regexp"
+	"errors"
+	"fmt"
 	"strconv"
-	"strings"
 	"time"
 )
 
-const (
-	GitHubBaseURL = "https://github.com/"
-)
-
 var (
-	GitSHARegex  = regexp.MustCompile("^[a-f0-9]{7,40}$")
-	GitLineRegex = regexp.MustCompile("(#L?)?([0-9]+)")
+	ErrNoOwners = errors.New("the bot has no owners")
 )
 
 // Loads the commands that are specified within the function. A command can
@@ -58,141 +52,109 @@ func (bot *Bot) LoadCommands() {
 			bot.QueueMessage(toId(msg.args[1]), msg.room)
 		},
 
+		// describes recent webhook deliveries, or replays one. See
+		// deliveries.go. Owner only
+		"hooklog": bot.HookLogCommand,
+
+		// reloads the config without reconnecting. See reload.go. Owner
+		// only
+		"reload": bot.ReloadCommand,
+
+		// join or leave a room, or list the rooms the bot is in. Rooms
+		// joined or left are remembered across restarts. See roomlist.go.
+		// Owner only
+		// Syntax: .join room
+		//         .leave [room]
+		//         .rooms
+		"join":  bot.JoinCommand,
+		"leave": bot.LeaveCommand,
+		"rooms": bot.RoomsCommand,
+
+		// PMs a link to a room's chat log for a day. See chatlog.go. Staff
+		// only
+		// Syntax: .logs [room,] [date]
+		"logs": bot.LogsCommand,
+
 		// gets the link to a git repository matching the criteria given.
-		// TODO: if none can be found, attempts to find a close match
+		// See gitcommand.go
+		"git": bot.GitCommand,
+
+		// say the title, state, author and URL of an issue or pull
+		// request. See issues.go
 		//
-		// Syntax: .git (user/repo|alias) (key:value){0,}
-		// Valid keys are:
-		//  - branch/b: the branch to look in. Defaults to master if excluded
-		//  - commit/c: the SHA-1 hash of the commit. Should match the regex
-		//      `[a-f0-9]{7,40}`
-		//  - file/f: the file to link to. If in a directory other than the
-		//      base directory, give the full path
-		//  - line/l: the line number, in one of the forms number, #number, or
-		//      #Lnumber
+		// Syntax: .issue (user/repo|alias) number
+		//         .pr (user/repo|alias) number
+		"issue": bot.IssueCommand(false),
+		"pr":    bot.IssueCommand(true),
+
+		// say when and where a user was last seen, and what they were
+		// doing. See seen.go
 		//
-		// Examples:
-		// > .git server file:data/moves.js line:200
-		// < https://github.com/Zarel/Pokemon-Showdown/blob/master/data/moves.js#L200
-		// > .git bot
-		// < https://github.com/TalkTakesTime/gobot
-		// > .git server c:53e9c8b
-		// < https://github.com/Zarel/Pokemon-Showdown/tree/53e9c8b
-		// > .git client b:client-overhaul
-		// < https://github.com/Zarel/Pokemon-Showdown-Client/tree/client-overhaul
-		// > .git client b:client-overhaul f:README.md
-		// < https://github.com/Zarel/Pokemon-Showdown-Client/blob/client-overhaul/README.md
+		// Syntax: .seen user
+		"seen": bot.SeenCommand,
+
+		// leave a message for a user, to be PMed to them the next time they
+		// join, rename or speak, and list or cancel the messages left that
+		// haven't been delivered yet. See mail.go
 		//
-		// Notes:
-		//  - if a key is present more than once the first instance will be
-		//      used and all others ignored
-		//  - key:value should not have spaces
-		//  - most values are case sensitive
-		"git": func(msg Message) {
-			if toId(msg.args[1]) == "" || toId(msg.args[1]) == "help" {
-				bot.QueueMessage(bot.config.CommandChar+
-					"git (user/repo|alias) (key:value){0,}. More detailed"+
-					" help can be found at http://git.io/hRt9", msg.room)
-				return
-			}
-
-			details := map[string]string{
-				"branch": "",
-				"file":   "",
-				"commit": "",
-				"line":   "",
-			}
-			// options should be separated by a space
-			args := strings.Split(msg.args[1], " ")
-
-			repo, ok := bot.config.GitAliases[args[0]]
-			if !ok { // if it's not a known alias take the literal value
-				repo = args[0]
-			}
-
-			// test if the repository exists
-			res, err := http.Get(GitHubBaseURL + repo)
-			defer res.Body.Close()
-			if err != nil || res.StatusCode != 200 {
-				bot.QueueMessage("Unknown repository: "+repo, msg.room)
-				return
-			}
-
-			if len(args) == 1 {
-				// they just want the repo so exit here
-				bot.QueueMessage(GitHubBaseURL+repo, msg.room)
-				return
-			}
-
-			// otherwise, they gave some options
-			unknownKey := []string{}
-			view := "tree"
-			for _, arg := range args[1:] {
-				option := strings.Split(arg, ":")
-				if len(option) == 1 || option[1] == "" {
-					continue
-				}
-				if len(option) > 2 {
-					option = append(option[:1], strings.Join(option[1:], ":"))
-				}
-
-				switch strings.ToLower(option[0]) {
-				case "branch", "b":
-					details["branch"] = option[1]
-				case "file", "f":
-					view = "blob"
-					details["file"] = option[1]
-				case "commit", "c":
-					valid := GitSHARegex.MatchString(option[1])
-					if !valid {
-						continue
-					}
-					details["commit"] = option[1]
-				case "line", "l":
-					matches := GitLineRegex.FindStringSubmatch(option[1])
-					if matches[0] == "" {
-						continue
-					}
-					details["line"] = matches[2]
-				default:
-					// unknown key
-					unknownKey = append(unknownKey, option[0])
-				}
-			}
-
-			var response string
-			if len(unknownKey) > 0 {
-				response += "Unknown key"
-				if len(unknownKey) > 1 {
-					response += "s"
-				}
-				response += ": " + strings.Join(unknownKey, ", ") + ". "
-			}
-			response += GitHubBaseURL + repo + "/"
-			// if a commit is given the branch is actually ignored
-			if details["commit"] != "" {
-				response += view + "/" + details["commit"]
-				if details["file"] != "" {
-					response += "/" + details["file"]
-					if details["line"] != "" {
-						response += "#L" + details["line"]
-					}
-				}
-			} else {
-				if details["branch"] != "" {
-					response += view + "/" + details["branch"]
-				} else if details["file"] != "" {
-					response += view + "/master"
-				}
-				if details["file"] != "" {
-					response += "/" + details["file"]
-					if details["line"] != "" {
-						response += "#L" + details["line"]
-					}
-				}
-			}
-
-			bot.QueueMessage(response, msg.room)
-		},
+		// Syntax: .tell user, message
+		//         .mailbox [cancel user]
+		"tell":    bot.TellCommand,
+		"mailbox": bot.MailboxCommand,
+
+		// add, change, remove or list the commands added from chat, for a
+		// room or for everywhere. See customcommands.go. Staff only in the
+		// room, or owner only for global commands
+		//
+		// Syntax: .addcmd [room|global] name, response
+		//         .editcmd [room|global] name, response
+		//         .delcmd [room|global] name
+		//         .listcmds [room|global]
+		"addcmd":   bot.SetCustomCommand(false),
+		"editcmd":  bot.SetCustomCommand(true),
+		"delcmd":   bot.DeleteCustomCommand,
+		"listcmds": bot.ListCustomCommands,
+
+		// add, say, remove or count a room's quotes. In PMs the room is
+		// given first. See quotes.go
+		//
+		// Syntax: .addquote [room,] text
+		//         .quote [room,] [id|words]
+		//         .delquote [room,] id
+		//         .quotes [room]
+		"addquote": bot.AddQuoteCommand,
+		"quote":    bot.QuoteCommand,
+		"delquote": bot.DeleteQuoteCommand,
+		"quotes":   bot.QuotesCommand,
+	}
+}
+
+// Runs a command as if the first of the bot's owners had used it in the
+// given room, which is normally a reply sink's (see `Bot.AddReplySink`).
+// Used by the console and the API. Safe to use from any goroutine.
+func (bot *Bot) RunAsOwner(room, line string) error {
+	conf := bot.Config()
+	if len(conf.Owners) == 0 {
+		return ErrNoOwners
+	}
+	if bot.GetCommand(line) == "" {
+		return fmt.Errorf("commands start with %s", conf.CommandChar)
+	}
+
+	msg := NewMessage(room, "|c|~"+conf.Owners[0]+"|"+line)
+	return bot.runInMainLoop(func() {
+		bot.RunCommand(msg)
+	})
+}
+
+// Returns true if the given user, as given in a message, is one of the bot's
+// owners.
+func (bot *Bot) IsOwner(user string) bool {
+	userId := toId(user)
+	for _, owner := range bot.config.Owners {
+		if toId(owner) == userId {
+			return true
+		}
 	}
+	return false
 }
@@ -2,7 +2,9 @@
  * Configuration management for the bot.
  *
  * The default config can be found in main/config-example.yaml and should
- * be copied into main/config.yaml, then edited to meet requirements.
+ * be copied into main/config.yaml, then edited to meet requirements. Any
+ * setting can also be given in the environment; see configenv.go. Configs
+ * are checked for problems when they are read; see configcheck.go.
  *
  * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
  */
@@ -10,10 +12,13 @@
 package gobot
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
+	"strings"
 )
 
 type Config struct {
@@ -23,59 +28,365 @@ type Config struct {
 	// The password associated with the given nick. Blank if
 	// the nick is unregistered
 	Pass string
+	// A file to read the password from instead, e.g. a Docker secret
+	PassFile string
 	// The server to connect to. PS! main's server is sim.smogon.com
 	Server string
 	// The port the given server uses. Default should be 8000
 	Port string
 	// The websocket URL to connect to. Generate automatically from
 	// the given settings using Config.GenerateURL
-	URL *url.URL
+	URL *url.URL `yaml:"-"`
+	// The file the config was read from, used when reloading it. Set by
+	// ReadConfig
+	File string `yaml:"-"`
 	// The character that indicates that the message received is for the bot
-	// to respond to. TODO: add validation for command char
+	// to respond to. Should be a single ASCII punctuation character
 	CommandChar string
 	// The rooms the bot is in. Initially loaded from the config file, and
-	// updated whenever the bot joins a room.
+	// updated whenever the bot joins or leaves a room. Once the bot has
+	// saved its rooms (see roomlist.go), the saved rooms are used instead of
+	// those in the config file
 	Rooms map[string]int64
+	// Rooms whose goings-on aren't told to users outside them, e.g. by
+	// .seen, as ids. Battles and groupchats are always treated as hidden
+	HiddenRooms []string
+	// The users who can use owner only commands such as .hooklog, as ids
+	Owners []string
+	// The token needed to use the bot's admin pages over HTTP, such as
+	// /hooklog/. Those pages are disabled if this is blank
+	AdminToken string
+	// Whether to serve the admin dashboard at /admin/, which needs
+	// AdminToken. See dashboard.go
+	EnableDashboard bool
+	// Whether to serve the JSON API at /api/, for other programs to post
+	// through the bot. See api.go
+	EnableAPI bool
+	// The token needed to use the API
+	APIToken string
+	// The directory the bot keeps its persistent data in, such as short
+	// links. Defaults to ./data
+	DataDir string
+	// The URL the bot's HTTP server can be reached at from outside, e.g.
+	// http://example.com:8080. Used for links to pages the bot serves
+	PublicURL string
+	// The bot's name when several are run from one config file, used in its
+	// logs and for its pages on the shared HTTP server, e.g. /main/api/.
+	// Defaults to the id of Nick. See manager.go
+	Name string
+	// Several bots to run at once, e.g. on different servers. Each is given
+	// like a config of its own, and uses the settings given outside Bots for
+	// anything it doesn't set. If any are given, only they are run
+	Bots []yaml.MapSlice
+	// The name of the bot this config is for if it came from Bots, or ""
+	// if the file doesn't list any. Set by ReadConfigs
+	Instance string `yaml:"-"`
+	// Problems with the config that don't stop it being used, such as
+	// GOBOT_ variables that aren't settings. Set by ParseConfig
+	Warnings []ConfigProblem `yaml:"-"`
+
+	/**** Chat log config ****/
+	// Whether to archive what is said in the bot's rooms. See chatlog.go
+	ChatLogs bool
+	// The directory to keep chat logs in. Defaults to the chatlogs
+	// directory in DataDir
+	ChatLogDir string
+	// Whether to write chat logs as JSON Lines as well as text
+	ChatLogJSON bool
+	// How many days of chat logs to keep. 0 keeps them forever
+	ChatLogDays int
+	// The lowest rank that can use .logs. Defaults to %
+	ChatLogRank string
 
 	/**** Git config ****/
 	// Whether or not the bot should listen for webhooks
 	EnableHooks bool
-	// The port that the bot should listen on for incoming GitHub webhooks
+	// The port that the bot's HTTP server listens on. GitHub webhooks, short
+	// links and any other pages the bot serves all use this port
 	HookPort int
+	// Whether the bot should run its HTTP server even when webhooks are
+	// disabled, e.g. to serve short links
+	EnableHTTP bool
 	// The secret given during the creation of the webhook. Must match the
 	// secret on GitHub
 	HookSecret string
+	// A file to read the webhook secret from instead
+	HookSecretFile string
 	// A list of rooms to update when a webhook is received
 	HookRooms []string
-	// Aliases for .git, of the form alias: user/repo
+	// The number of webhook deliveries to keep a record of. Defaults to 20
+	HookLogSize int
+	// Aliases for .git, of the form alias: user/repo. Once aliases have been
+	// changed on the dashboard, the saved aliases are used instead
 	GitAliases map[string]string
+	// Whether .git should keep a local index of repositories, so that it can
+	// check branches, commits, files and lines. Every repository in
+	// GitAliases is indexed, along with any in GitRepos
+	IndexRepos bool
+	// Repositories to index as well as those in GitAliases, as user/repo
+	GitRepos []string
+	// Where to keep the clones of indexed repositories. Defaults to the
+	// repos directory in DataDir
+	GitRepoDir string
+	// The URL repositories are cloned from. Defaults to https://github.com/
+	GitRemote string
+	// How often to update indexed repositories, in minutes. Defaults to 60
+	GitRefresh int
+	// The URL of the GitHub API, used by .issue and .pr. Defaults to
+	// https://api.github.com
+	GitHubAPI string
+	// An optional GitHub access token, which raises GitHub's rate limit
+	GitHubToken string
+	// Whether mentions of issues such as server#123 in chat should be
+	// expanded. Only repositories with aliases or in the index are expanded
+	ExpandIssues bool
+	// The lowest rank that can use !htmlbox. Webhooks are announced in plain
+	// text in rooms where the bot's rank is lower than this. Defaults to *
+	HTMLRank string
+	// The templates used to announce webhooks. See templates.go
+	HookTemplates TemplateConfig
+	// Templates for particular rooms, keyed by room id. Anything not given
+	// falls back to HookTemplates
+	RoomTemplates map[string]TemplateConfig
+
+	/**** URL shortener config ****/
+	// The shortener to use for URLs in webhook messages: none, service or
+	// local. Defaults to none
+	Shortener string
+	// The URL used to create short links when Shortener is service. If it
+	// contains {url}, a GET request is made with the long URL in its place,
+	// otherwise the long URL is POSTed as the form field `url`
+	ShortenerURL string
+	// For service, the prefix to add if the service only replies with a
+	// code. For local, the URL the bot's HTTP server can be reached at from
+	// outside, e.g. http://example.com:8080. Defaults to PublicURL for local
+	ShortenerBase string
+	// Whether service falls back to shortening URLs itself, as local does,
+	// when the service can't shorten them. Links start with PublicURL
+	ShortenerFallback bool
+
+	/**** Metrics config ****/
+	// Whether to serve Prometheus metrics at /metrics. See metrics.go
+	EnableMetrics bool
+	// The port to serve metrics on. If 0, they are served by the bot's HTTP
+	// server on HookPort, which is started even if webhooks and EnableHTTP
+	// are disabled. Metrics include room names, so use a port that isn't
+	// public if that matters
+	MetricsPort int
+
+	/**** Health check config ****/
+	// Whether to serve /healthz and /readyz from the bot's HTTP server, for
+	// container health checks. See health.go
+	EnableHealth bool
+	// How long the bot can go without hearing from the server before
+	// /healthz fails, in seconds. Defaults to 180
+	HealthTimeout int
+
+	/**** Seen config ****/
+	// How many days .seen remembers users for. Defaults to 90
+	SeenDays int
+
+	/**** Mail config ****/
+	// How many messages left with .tell each user can have waiting to be
+	// delivered at once. Defaults to 5
+	TellLimit int
+	// How many days messages left with .tell wait to be delivered before
+	// they are dropped. Defaults to 30
+	TellDays int
+
+	/**** Custom command config ****/
+	// The lowest rank that can add, change and remove a room's custom
+	// commands. Defaults to %
+	CustomCommandRank string
+
+	/**** Quote config ****/
+	// The lowest rank that can add quotes. Defaults to +
+	QuoteRank string
+	// The lowest rank that can remove quotes other users added. Defaults
+	// to %
+	QuoteDeleteRank string
+	// Whether to serve each room's quotes as a page at /quotes/room. See
+	// quotes.go
+	EnableQuotePage bool
+
+	/**** Outgoing webhook config ****/
+	// Endpoints to forward chat events to, such as mentions of the bot and
+	// commands being used. See outhooks.go
+	OutHooks []OutHookConfig
+
+	/**** IRC bridge config ****/
+	// Whether to relay rooms to and from IRC channels. See irc.go
+	EnableIRC bool
+	// The IRC server to connect to, as host:port
+	IRCServer string
+	// Whether to connect to the IRC server using TLS
+	IRCTLS bool
+	// The nick to use on IRC. Defaults to Nick
+	IRCNick string
+	// The IRC server's password, if it needs one
+	IRCPass string
+	// A file to read the IRC server's password from instead
+	IRCPassFile string
+	// The rooms to relay, as ids, and the channel each is relayed to, e.g.
+	// techcode: "#techcode"
+	IRCChannels map[string]string
+	// IRC nicks to show under a different name on PS!, and the other way
+	// around, e.g. ttt: TalkTakesTime
+	IRCNicks map[string]string
+
+	/**** Logging config ****/
+	// How to write logs: text or json. Defaults to text
+	LogFormat string
+	// The lowest level to log: debug, info, warn or error. Every message
+	// sent and received is logged at debug, so use info or higher to keep
+	// them out of the logs. Defaults to info
+	LogLevel string
+	// Levels for particular subsystems, overriding LogLevel, e.g.
+	// transport: debug. See logging.go for the subsystems
+	LogLevels map[string]string
+	// Whether text logs should be coloured: auto, always or never. auto
+	// colours them if they are written to a terminal. Defaults to auto
+	LogColour string
 }
 
-// Reads the bot's config from file and converts it to a Config
-// object for use by a Bot.
-func GetConfig() Config {
-	contents, err := ioutil.ReadFile("./config.yaml")
-	if err != nil {
-		// no config file, so we'll create a new one
-		log.Println("No config file found, trying to use config-example" +
-			" instead...")
-		// read from the example config
-		contents, err = ioutil.ReadFile("./config-example.yaml")
-		checkError(err)
-
-		// and write it to the new config file
-		err = ioutil.WriteFile("./config.yaml", contents, 0644)
-		checkError(err)
-	}
+// Returns true if the bot's HTTP server needs to run.
+func (conf *Config) NeedsHTTP() bool {
+	return conf.EnableHooks || conf.EnableHTTP || conf.EnableHealth ||
+		conf.EnableDashboard || conf.EnableAPI ||
+		conf.EnableQuotePage || (conf.EnableMetrics && conf.MetricsPort == 0)
+}
 
-	// and convert the YAML to a Config object
-	var config Config
-	err = yaml.Unmarshal(contents, &config)
+// Reads the bot's config from the given file and converts it to a Config
+// object for use by a Bot, applying any overrides from the environment (see
+// configenv.go). Exits if the file is missing or the config has any problems.
+func GetConfig(filename string) Config {
+	config, err := ReadConfig(filename)
+	if os.IsNotExist(err) {
+		log.Fatalf("No config file found at %s. Copy config-example.yaml "+
+			"there and edit it, or run with -init-config to do so", filename)
+	}
 	checkError(err)
 
 	return config
 }
 
+// Reads the configs for every bot listed in the given file, or the single
+// bot it describes if it doesn't list any, exiting if there are problems as
+// GetConfig does.
+func GetConfigs(filename string) []Config {
+	configs, err := ReadConfigs(filename)
+	if os.IsNotExist(err) {
+		log.Fatalf("No config file found at %s. Copy config-example.yaml "+
+			"there and edit it, or run with -init-config to do so", filename)
+	}
+	checkError(err)
+
+	return configs
+}
+
+// Reads the config in the given file, applies any overrides from the
+// environment and reads any secrets files, then checks it for problems. If
+// there are any, a *ConfigError describing all of them is returned.
+func ReadConfig(filename string) (Config, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// convert the YAML to a Config object
+	config, err := ParseConfig(contents, os.Environ())
+	config.File = filename
+	return config, err
+}
+
+// Reads the configs for every bot listed under bots in the given file, as
+// ReadConfig does. A file that doesn't list any gives a single config.
+func ReadConfigs(filename string) ([]Config, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := ParseConfigs(contents, os.Environ())
+	for i := range configs {
+		configs[i].File = filename
+	}
+	return configs, err
+}
+
+// Reads the config for a single bot from the given file: the one named
+// instance under bots, or the whole file if instance is "".
+func ReadBotConfig(filename, instance string) (Config, error) {
+	if instance == "" {
+		return ReadConfig(filename)
+	}
+
+	configs, err := ReadConfigs(filename)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, config := range configs {
+		if config.Instance == instance {
+			return config, nil
+		}
+	}
+	return Config{}, fmt.Errorf("%s no longer lists a bot named %q",
+		filename, instance)
+}
+
+// Creates a new config file by copying the example config to it. The file
+// is only readable by its owner, since it will hold passwords, and an
+// existing config is never overwritten.
+func InitConfig(filename, example string) error {
+	contents, err := ioutil.ReadFile(example)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Reads Pass and HookSecret from PassFile and HookSecretFile, if they are
+// given. Surrounding whitespace, such as a trailing newline, is trimmed.
+func (conf *Config) ReadSecrets() []ConfigProblem {
+	problems := []ConfigProblem{}
+	secrets := []struct {
+		field, fileField string
+		file             string
+		value            *string
+	}{
+		{"pass", "passfile", conf.PassFile, &conf.Pass},
+		{"hooksecret", "hooksecretfile", conf.HookSecretFile, &conf.HookSecret},
+		{"ircpass", "ircpassfile", conf.IRCPassFile, &conf.IRCPass},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		contents, err := ioutil.ReadFile(secret.file)
+		if err != nil {
+			problems = append(problems, ConfigProblem{
+				Field:   secret.fileField,
+				Message: err.Error(),
+			})
+			continue
+		}
+		*secret.value = strings.TrimSpace(string(contents))
+	}
+
+	return problems
+}
+
 // Generates a websocket URL to use for connecting, based on the given
 // parameters.
 // The websocket URL has the following format:
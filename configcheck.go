@@ -0,0 +1,736 @@
+/*
+ * Validation of the bot's config. Every problem found is reported at once,
+ * along with the line of config.yaml it is on where possible, so that a
+ * config can be fixed in one go rather than one restart at a time.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// the longest nick PS! allows
+	MaxNickLength = 16
+)
+
+var (
+	GitAliasRegex = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+	// matches the line numbers yaml gives in its errors
+	yamlLineRegex = regexp.MustCompile(`^(?:yaml: )?line ([0-9]+): (.*)$`)
+)
+
+// A single problem with a config.
+type ConfigProblem struct {
+	// the line of the config file the problem is on, or 0 if unknown
+	Line int
+	// the path to the setting with the problem, e.g. rooms.techcode
+	Field   string
+	Message string
+	// whether the setting was given in the environment rather than the file
+	fromEnv bool
+}
+
+func (p ConfigProblem) String() string {
+	s := ""
+	if p.Line > 0 {
+		s += "line " + strconv.Itoa(p.Line) + ": "
+	}
+	if p.Field != "" {
+		s += p.Field + ": "
+	}
+	return s + p.Message
+}
+
+// The error returned when a config has problems, listing all of them.
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("%d problem(s) with config:\n  %s", len(lines),
+		strings.Join(lines, "\n  "))
+}
+
+// Parses a config from YAML, applies any overrides in the given environment
+// (see Config.ApplyEnv), reads any secrets files and checks it, returning a
+// *ConfigError listing every problem found if there are any. The config is
+// still returned if it could be parsed at all, so that callers can choose to
+// carry on regardless.
+func ParseConfig(contents []byte, environ []string) (Config, error) {
+	config, problems := parseConfig(contents, envOverrides{EnvPrefix,
+		environ})
+	for i, p := range problems {
+		if p.Line == 0 && p.Field != "" && !p.fromEnv {
+			problems[i].Line = findLine(contents, strings.Split(p.Field, "."))
+		}
+	}
+	return config, configError(problems)
+}
+
+// Parses a config that may list several bots under bots, returning a config
+// for each of them. Each bot uses the settings given outside bots for
+// anything it doesn't set itself, except that it keeps its data in its own
+// directory inside datadir unless it sets datadir, and is named after its
+// nick unless it sets name. A config without bots gives a single config, as
+// ParseConfig does. Problems with any of the bots are returned together.
+//
+// GOBOT_ variables only override settings that a bot doesn't give itself,
+// while variables starting with the bot's own prefix, such as GOBOT_MAIN_,
+// override its settings whether it gives them or not. See configenv.go.
+func ParseConfigs(contents []byte, environ []string) ([]Config, error) {
+	var file struct {
+		Bots []yaml.MapSlice
+	}
+	var shared yaml.MapSlice
+	if yaml.Unmarshal(contents, &file) != nil || yaml.Unmarshal(contents,
+		&shared) != nil || len(file.Bots) == 0 {
+		config, err := ParseConfig(contents, environ)
+		return []Config{config}, err
+	}
+
+	// the prefix of each bot's own variables, which are kept apart from
+	// those for every bot
+	prefixes := make([]string, len(file.Bots))
+	for i, bot := range file.Bots {
+		prefixes[i] = botEnvPrefix(fileBotName(bot, shared))
+	}
+
+	configs := []Config{}
+	problems := []ConfigProblem{}
+	seen := make(map[ConfigProblem]bool)
+	names := make(map[string]int)
+	nicks := make(map[string]int)
+	metricsPorts := make(map[int]int)
+	for i, bot := range file.Bots {
+		path := []string{"bots", strconv.Itoa(i)}
+		prefix := strings.Join(path, ".") + "."
+		given := make(map[string]bool)
+		for _, item := range bot {
+			key := strings.ToLower(fmt.Sprint(item.Key))
+			given[key] = true
+			switch key {
+			case "bots", "hookport":
+				problems = append(problems, ConfigProblem{
+					Line:    findLine(contents, append(path, key)),
+					Field:   prefix + key,
+					Message: "can only be given outside bots",
+				})
+			}
+		}
+
+		merged := yaml.MapSlice{}
+		for _, item := range shared {
+			key := strings.ToLower(fmt.Sprint(item.Key))
+			if key != "bots" && !given[key] {
+				merged = append(merged, item)
+			}
+		}
+		merged = append(merged, bot...)
+		out, err := yaml.Marshal(merged)
+		if err != nil {
+			problems = append(problems, ConfigProblem{
+				Line:    findLine(contents, path),
+				Field:   prefix[:len(prefix)-1],
+				Message: err.Error(),
+			})
+			continue
+		}
+
+		sharedEnv, botEnv := []string{}, []string{}
+		for _, kv := range environ {
+			name := strings.SplitN(kv, "=", 2)[0]
+			switch owner := envOwner(name, prefixes); {
+			case owner == i:
+				botEnv = append(botEnv, kv)
+			case owner == -1 && !given[envSettingName(name, EnvPrefix)]:
+				sharedEnv = append(sharedEnv, kv)
+			}
+		}
+
+		config, found := parseConfig(out, envOverrides{EnvPrefix, sharedEnv},
+			envOverrides{prefixes[i], botEnv})
+		for _, p := range found {
+			field := strings.Split(p.Field, ".")
+			switch {
+			case p.fromEnv:
+			case p.Field == "":
+				// yaml's lines are for the merged config, so point at the
+				// bot instead
+				p.Line = findLine(contents, path)
+			case given[field[0]]:
+				p.Line = findLine(contents, append(path, field...))
+				if p.Line == 0 {
+					// e.g. the first setting, which is on the same line
+					// as the bot's "- "
+					p.Line = findLine(contents, path)
+				}
+				p.Field = prefix + p.Field
+			default:
+				// a shared setting, which is only reported once
+				p.Line = findLine(contents, field)
+			}
+			if !seen[p] {
+				seen[p] = true
+				problems = append(problems, p)
+			}
+		}
+
+		if config.Name == "" {
+			config.Name = toId(config.Nick)
+		}
+		if !given["datadir"] {
+			base := config.DataDir
+			if base == "" {
+				base = DefaultDataDir
+			}
+			config.DataDir = filepath.Join(base, config.Name)
+		}
+		config.Instance = config.Name
+
+		if other, ok := names[config.Name]; ok {
+			problems = append(problems, ConfigProblem{
+				Line:  findLine(contents, path),
+				Field: prefix[:len(prefix)-1],
+				Message: fmt.Sprintf("has the same name as bots.%d; give "+
+					"one of them a name", other),
+			})
+		}
+		names[config.Name] = i
+		account := toId(config.Nick) + "@" + config.Server
+		if other, ok := nicks[account]; ok {
+			problems = append(problems, ConfigProblem{
+				Line:  findLine(contents, path),
+				Field: prefix[:len(prefix)-1],
+				Message: fmt.Sprintf("uses the same nick on the same server "+
+					"as bots.%d", other),
+			})
+		}
+		nicks[account] = i
+		if config.EnableMetrics && config.MetricsPort != 0 {
+			if other, ok := metricsPorts[config.MetricsPort]; ok {
+				problems = append(problems, ConfigProblem{
+					Line:  findLine(contents, path),
+					Field: prefix + "metricsport",
+					Message: fmt.Sprintf("%d is also used by bots.%d; use 0 "+
+						"to serve metrics from the shared HTTP server",
+						config.MetricsPort, other),
+				})
+			}
+			metricsPorts[config.MetricsPort] = i
+		}
+		configs = append(configs, config)
+	}
+	return configs, configError(problems)
+}
+
+// Returns the name a bot in a config's bots is given, from the file alone:
+// its name if it sets one, or otherwise its nick.
+func fileBotName(bot, shared yaml.MapSlice) string {
+	if name, ok := yamlSetting(bot, "name"); ok {
+		return name
+	}
+	nick, ok := yamlSetting(bot, "nick")
+	if !ok {
+		nick, _ = yamlSetting(shared, "nick")
+	}
+	return toId(nick)
+}
+
+// Returns the value of a top-level setting, as text, and whether it is given.
+func yamlSetting(settings yaml.MapSlice, key string) (string, bool) {
+	for _, item := range settings {
+		if strings.ToLower(fmt.Sprint(item.Key)) == key {
+			return fmt.Sprint(item.Value), true
+		}
+	}
+	return "", false
+}
+
+// Returns the index of the bot whose own variables include the one with the
+// given name, or -1 if it is for every bot. If several prefixes match, such
+// as GOBOT_MAIN_ and GOBOT_MAIN_TEST_, the longest wins.
+func envOwner(name string, prefixes []string) int {
+	owner := -1
+	for i, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) && (owner == -1 ||
+			len(prefix) > len(prefixes[owner])) {
+			owner = i
+		}
+	}
+	return owner
+}
+
+// Variables that override settings, all starting with prefix.
+type envOverrides struct {
+	prefix  string
+	environ []string
+}
+
+// Parses and checks a config as ParseConfig does, applying each set of
+// overrides in turn, and returns the problems found. Only problems found by
+// yaml have lines.
+func parseConfig(contents []byte, envs ...envOverrides) (Config,
+	[]ConfigProblem) {
+	var config Config
+	problems := []ConfigProblem{}
+
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		problems = append(problems, yamlProblems(err)...)
+	} else if err = yaml.UnmarshalStrict(contents, &Config{}); err != nil {
+		// the config is usable, but anything strict parsing complains about
+		// is likely a typo
+		problems = append(problems, yamlProblems(err)...)
+	}
+
+	overridden := make(map[string]string)
+	for _, env := range envs {
+		vars, envProblems := config.applyEnv(env.environ, env.prefix)
+		for field, name := range vars {
+			overridden[field] = name
+		}
+		problems = append(problems, envProblems...)
+	}
+	for _, p := range append(config.ReadSecrets(), config.Validate()...) {
+		// settings from the environment aren't in the file, so point at the
+		// variable instead
+		if name := overriddenBy(overridden, p.Field); name != "" {
+			p.Message += " (set by " + name + ")"
+			p.fromEnv = true
+		}
+		problems = append(problems, p)
+	}
+	return config, problems
+}
+
+// Logs the warnings found in the given config, which the bot carries on
+// regardless of.
+func (bot *Bot) logConfigWarnings(conf Config) {
+	for _, p := range conf.Warnings {
+		bot.Logger(LogBot).Warn("config problem", "problem", p.String())
+	}
+}
+
+// Returns a *ConfigError listing the given problems in the order they appear
+// in the file, or nil if there are none.
+func configError(problems []ConfigProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		// problems without a line go last
+		return problems[j].Line == 0 && problems[i].Line != 0 ||
+			problems[i].Line != 0 && problems[i].Line < problems[j].Line
+	})
+	return &ConfigError{problems}
+}
+
+// Returns the environment variable that set the given setting or one of its
+// parents, or "" if it came from the config file.
+func overriddenBy(overridden map[string]string, field string) string {
+	path := strings.Split(field, ".")
+	for i := len(path); i > 0; i-- {
+		if name, ok := overridden[strings.Join(path[:i], ".")]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Turns an error from yaml into problems, taking out the line numbers.
+func yamlProblems(err error) []ConfigProblem {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+
+	problems := make([]ConfigProblem, len(messages))
+	for i, msg := range messages {
+		problems[i].Message = msg
+		if matches := yamlLineRegex.FindStringSubmatch(msg); matches != nil {
+			problems[i].Line, _ = strconv.Atoi(matches[1])
+			problems[i].Message = matches[2]
+		}
+	}
+	return problems
+}
+
+// Finds the line a setting is on, given the path to it, e.g. ["rooms",
+// "techcode"] or ["hookrooms", "2"] for the third hook room. Returns 0 if it
+// can't be found. This only understands the block style YAML used by
+// config-example.yaml, which is all that's needed to point people in the
+// right direction.
+func findLine(contents []byte, path []string) int {
+	lines := strings.Split(string(contents), "\n")
+	start, indent := 0, -1
+	found := 0
+	for _, key := range path {
+		index, isIndex := -1, false
+		if n, err := strconv.Atoi(key); err == nil {
+			index, isIndex = n, true
+		}
+
+		found = 0
+		childIndent := -1
+		for i := start; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " ")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			lineIndent := len(lines[i]) - len(trimmed)
+			if lineIndent <= indent {
+				break // we've left the parent
+			}
+			if childIndent == -1 {
+				childIndent = lineIndent
+			}
+			if lineIndent != childIndent {
+				continue
+			}
+
+			if isIndex && strings.HasPrefix(trimmed, "- ") {
+				if index == 0 {
+					found = i + 1
+					break
+				}
+				index--
+			} else if lineKey := strings.SplitN(trimmed, ":", 2); len(
+				lineKey) == 2 && strings.EqualFold(
+				strings.Trim(lineKey[0], `"' `), key) {
+				found = i + 1
+				break
+			}
+		}
+
+		if found == 0 {
+			return 0
+		}
+		start, indent = found, childIndent
+	}
+	return found
+}
+
+// Returns true if port is a valid port number.
+func validPort(port int) bool {
+	return port > 0 && port < 65536
+}
+
+// Checks the config for problems, returning all of those found. The problems
+// don't have line numbers, since the config doesn't know where it came from.
+func (conf *Config) Validate() []ConfigProblem {
+	problems := []ConfigProblem{}
+	problem := func(field, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	checkId := func(field, id string) {
+		if id != toId(id) || id == "" {
+			problem(field, "%q should be given as an id, i.e. %q", id,
+				toId(id))
+		}
+	}
+	checkRank := func(field, rank string) {
+		if rank != "" && (len(rank) != 1 || !strings.Contains(Ranks, rank)) {
+			problem(field, "%q should be one of %q", rank,
+				strings.TrimSpace(Ranks))
+		}
+	}
+	checkURL := func(field, value string) {
+		if u, err := url.Parse(value); value != "" && (err != nil ||
+			u.Scheme == "" || u.Host == "") {
+			problem(field, "%q is not a valid URL", value)
+		}
+	}
+
+	/**** General config ****/
+	if toId(conf.Nick) == "" {
+		problem("nick", "a nick is needed")
+	} else if utf8.RuneCountInString(conf.Nick) > MaxNickLength {
+		problem("nick", "%q is longer than %d characters", conf.Nick,
+			MaxNickLength)
+	}
+	if conf.Name != "" {
+		checkId("name", conf.Name)
+	}
+	if conf.Server == "" {
+		problem("server", "a server is needed, e.g. sim.smogon.com")
+	}
+	if port, err := strconv.Atoi(conf.Port); err != nil || !validPort(port) {
+		problem("port", "%q is not a valid port", conf.Port)
+	}
+
+	// commands are cut from messages a byte at a time, so the command
+	// character has to be a single ASCII one
+	if c := conf.CommandChar; len(c) != 1 || c[0] >= utf8.RuneSelf ||
+		!unicode.IsPunct(rune(c[0])) && !unicode.IsSymbol(rune(c[0])) {
+		problem("commandchar", "%q should be a single ASCII punctuation "+
+			"character, such as %q", c, ".")
+	}
+
+	for room := range conf.Rooms {
+		checkId("rooms."+room, room)
+	}
+	for i, room := range conf.HiddenRooms {
+		checkId("hiddenrooms."+strconv.Itoa(i), room)
+	}
+	for i, owner := range conf.Owners {
+		if toId(owner) == "" {
+			problem("owners."+strconv.Itoa(i), "%q is not a valid user", owner)
+		}
+	}
+	checkURL("publicurl", conf.PublicURL)
+	if conf.EnableDashboard && conf.AdminToken == "" {
+		problem("enabledashboard", "the dashboard needs admintoken to be set")
+	}
+	if conf.EnableAPI && conf.APIToken == "" {
+		problem("apitoken", "needed by the API")
+	}
+
+	/**** Chat log config ****/
+	if conf.ChatLogDays < 0 {
+		problem("chatlogdays", "should not be negative")
+	}
+	checkRank("chatlogrank", conf.ChatLogRank)
+
+	/**** HTTP and git config ****/
+	if conf.NeedsHTTP() {
+		if !validPort(conf.HookPort) {
+			problem("hookport", "%d is not a valid port", conf.HookPort)
+		}
+		local := conf.Server == "localhost" || conf.Server == "127.0.0.1"
+		if local && strconv.Itoa(conf.HookPort) == conf.Port {
+			problem("hookport", "%d is already used by the server",
+				conf.HookPort)
+		}
+	}
+	if conf.EnableHooks && conf.HookSecret == "" {
+		problem("hooksecret", "a secret is needed so that webhooks can be "+
+			"checked")
+	}
+	for i, room := range conf.HookRooms {
+		checkId("hookrooms."+strconv.Itoa(i), room)
+	}
+	if conf.HookLogSize < 0 {
+		problem("hooklogsize", "should not be negative")
+	}
+
+	for alias, repo := range conf.GitAliases {
+		if !GitAliasRegex.MatchString(alias) {
+			problem("gitaliases."+alias, "%q is not a valid alias; use "+
+				"letters, numbers, _, . and - only", alias)
+		}
+		if !GitRepoRegex.MatchString(repo) {
+			problem("gitaliases."+alias, "%q should be of the form user/repo",
+				repo)
+		}
+	}
+	for i, repo := range conf.GitRepos {
+		if !GitRepoRegex.MatchString(repo) {
+			problem("gitrepos."+strconv.Itoa(i), "%q should be of the form "+
+				"user/repo", repo)
+		}
+	}
+	checkURL("gitremote", conf.GitRemote)
+	checkURL("githubapi", conf.GitHubAPI)
+	if conf.GitRefresh < 0 {
+		problem("gitrefresh", "should not be negative")
+	}
+
+	checkRank("htmlrank", conf.HTMLRank)
+
+	if _, err := NewHookTemplates(conf.HookTemplates,
+		TemplateConfig{}); err != nil {
+		problem("hooktemplates", "%s", err)
+	}
+	checkFormat := func(field, format string) {
+		switch strings.ToLower(format) {
+		case "", FormatHTML, FormatText:
+		default:
+			problem(field, "%q should be html or text", format)
+		}
+	}
+	checkFormat("hooktemplates.format", conf.HookTemplates.Format)
+	for room, templates := range conf.RoomTemplates {
+		checkId("roomtemplates."+room, room)
+		checkFormat("roomtemplates."+room+".format", templates.Format)
+		if _, err := NewHookTemplates(templates,
+			conf.HookTemplates); err != nil {
+			problem("roomtemplates."+room, "%s", err)
+		}
+	}
+
+	/**** URL shortener config ****/
+	switch strings.ToLower(conf.Shortener) {
+	case "", "none":
+	case "service":
+		if conf.ShortenerURL == "" {
+			problem("shortenerurl", "needed by the service shortener")
+		}
+		checkURL("shortenerurl", conf.ShortenerURL)
+		if conf.ShortenerFallback && conf.PublicURL == "" {
+			problem("shortenerfallback", "needs publicurl for the "+
+				"local shortener's links")
+		}
+		if conf.ShortenerFallback && !conf.EnableHooks &&
+			!conf.EnableHTTP {
+			problem("shortenerfallback", "needs the HTTP server; "+
+				"set enablehttp or enablehooks")
+		}
+	case "local":
+		if conf.ShortenerBase == "" && conf.PublicURL == "" {
+			problem("shortenerbase", "needed by the local shortener, unless "+
+				"publicurl is set")
+		}
+		checkURL("shortenerbase", conf.ShortenerBase)
+		if !conf.EnableHooks && !conf.EnableHTTP {
+			problem("shortener", "the local shortener needs the HTTP "+
+				"server; set enablehttp or enablehooks")
+		}
+	default:
+		problem("shortener", "%q should be none, service or local",
+			conf.Shortener)
+	}
+
+	/**** Metrics config ****/
+	if conf.EnableMetrics && conf.MetricsPort != 0 {
+		if !validPort(conf.MetricsPort) {
+			problem("metricsport", "%d is not a valid port", conf.MetricsPort)
+		} else if conf.NeedsHTTP() && conf.MetricsPort == conf.HookPort {
+			problem("metricsport", "%d is already used by the HTTP server; "+
+				"use 0 to serve metrics from it", conf.MetricsPort)
+		}
+	}
+
+	/**** Health check config ****/
+	if conf.HealthTimeout < 0 {
+		problem("healthtimeout", "should not be negative")
+	}
+
+	/**** Seen config ****/
+	if conf.SeenDays < 0 {
+		problem("seendays", "should not be negative")
+	}
+
+	/**** Mail config ****/
+	if conf.TellLimit < 0 {
+		problem("telllimit", "should not be negative")
+	}
+	if conf.TellDays < 0 {
+		problem("telldays", "should not be negative")
+	}
+
+	/**** Custom command config ****/
+	checkRank("customcommandrank", conf.CustomCommandRank)
+
+	/**** Quote config ****/
+	checkRank("quoterank", conf.QuoteRank)
+	checkRank("quotedeleterank", conf.QuoteDeleteRank)
+
+	/**** Outgoing webhook config ****/
+	for i, hook := range conf.OutHooks {
+		field := "outhooks." + strconv.Itoa(i)
+		if hook.URL == "" {
+			problem(field+".url", "needed for every outgoing webhook")
+		}
+		checkURL(field+".url", hook.URL)
+		for _, event := range hook.Events {
+			if !contains(OutHookEvents, event) {
+				problem(field+".events", "%q should be one of %s", event,
+					strings.Join(OutHookEvents, ", "))
+			}
+		}
+		for _, room := range hook.Rooms {
+			if strings.HasPrefix(room, "user:") {
+				checkId(field+".rooms", strings.TrimPrefix(room, "user:"))
+			} else {
+				checkId(field+".rooms", room)
+			}
+		}
+		for _, user := range hook.Users {
+			checkId(field+".users", user)
+		}
+		if _, err := regexp.Compile(hook.Match); err != nil {
+			problem(field+".match", "%s", err)
+		}
+		if hook.Retries < -1 {
+			problem(field+".retries", "should be -1 to never retry, or more")
+		}
+	}
+
+	/**** IRC bridge config ****/
+	if conf.EnableIRC {
+		if conf.IRCServer == "" {
+			problem("ircserver", "needed by the IRC bridge")
+		} else if _, port, err := net.SplitHostPort(conf.IRCServer); err != nil {
+			problem("ircserver", "%q should be of the form host:port",
+				conf.IRCServer)
+		} else if n, err := strconv.Atoi(port); err != nil || !validPort(n) {
+			problem("ircserver", "%q is not a valid port", port)
+		}
+		if len(conf.IRCChannels) == 0 {
+			problem("ircchannels", "give at least one room to relay")
+		}
+	}
+	if strings.ContainsAny(conf.IRCNick, " ,:!@") {
+		problem("ircnick", "%q is not a valid IRC nick", conf.IRCNick)
+	}
+	channels := map[string]string{}
+	for room, channel := range conf.IRCChannels {
+		checkId("ircchannels."+room, room)
+		if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel,
+			"&") || strings.ContainsAny(channel, " ,\x07") {
+			problem("ircchannels."+room, "%q is not a valid IRC channel",
+				channel)
+		} else if other, ok := channels[strings.ToLower(channel)]; ok {
+			problem("ircchannels."+room, "%s is already relayed to %s",
+				channel, other)
+		}
+		channels[strings.ToLower(channel)] = room
+	}
+
+	/**** Logging config ****/
+	switch strings.ToLower(conf.LogFormat) {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		problem("logformat", "%q should be text or json", conf.LogFormat)
+	}
+	if _, err := ParseLogLevel(conf.LogLevel); err != nil {
+		problem("loglevel", "%s", err)
+	}
+	for subsystem, level := range conf.LogLevels {
+		if !contains(LogSubsystems, subsystem) {
+			problem("loglevels."+subsystem, "%q is not a subsystem; use one "+
+				"of %s", subsystem, strings.Join(LogSubsystems, ", "))
+		} else if _, err := ParseLogLevel(level); err != nil {
+			problem("loglevels."+subsystem, "%s", err)
+		}
+	}
+	switch strings.ToLower(conf.LogColour) {
+	case "", LogColourAuto, LogColourAlways, LogColourNever:
+	default:
+		problem("logcolour", "%q should be auto, always or never",
+			conf.LogColour)
+	}
+
+	return problems
+}
@@ -0,0 +1,116 @@
+package gobot
+
+import (
+	"strings"
+	"testing"
+)
+
+// Two bots with their own nicks, sharing everything else.
+const twoBots = `
+server: sim.psim.us
+port: "8000"
+commandchar: "."
+owners: [alice]
+hookport: 3420
+bots:
+  - name: main
+    nick: gobot
+    pass: mainpass
+  - name: test
+    nick: gobottest
+    server: localhost
+`
+
+func TestParseConfigsEnv(t *testing.T) {
+	tests := []struct {
+		environ []string
+		// the nick, pass and server each bot should end up with
+		main, test [3]string
+		problem    string
+	}{
+		{
+			main: [3]string{"gobot", "mainpass", "sim.psim.us"},
+			test: [3]string{"gobottest", "", "localhost"},
+		},
+		{
+			// both bots give their own nick, so GOBOT_NICK is ignored,
+			// but the shared server is changed for the bot that uses it
+			environ: []string{"GOBOT_NICK=other", "GOBOT_PASS=secret",
+				"GOBOT_SERVER=example.com"},
+			main: [3]string{"gobot", "mainpass", "example.com"},
+			test: [3]string{"gobottest", "secret", "localhost"},
+		},
+		{
+			environ: []string{"GOBOT_MAIN_NICK=renamed",
+				"GOBOT_TEST_SERVER=test.example.com", "GOBOT_TEST_PASS=x"},
+			main: [3]string{"renamed", "mainpass", "sim.psim.us"},
+			test: [3]string{"gobottest", "x", "test.example.com"},
+		},
+		{
+			environ: []string{"GOBOT_TEST_NICK=gobot",
+				"GOBOT_TEST_SERVER=sim.psim.us"},
+			problem: "bots.1: uses the same nick on the same server as " +
+				"bots.0",
+		},
+		{
+			environ: []string{"GOBOT_MAIN_PORT=none"},
+			problem: "GOBOT_MAIN_PORT",
+		},
+	}
+
+	for _, test := range tests {
+		configs, err := ParseConfigs([]byte(twoBots), test.environ)
+		if test.problem != "" {
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("%v: got error %v, want %q", test.environ, err,
+					test.problem)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.environ, err)
+			continue
+		}
+		for i, want := range [][3]string{test.main, test.test} {
+			conf := configs[i]
+			got := [3]string{conf.Nick, conf.Pass, conf.Server}
+			if got != want {
+				t.Errorf("%v: bots.%d has nick, pass and server %q, want %q",
+					test.environ, i, got, want)
+			}
+		}
+	}
+}
+
+func TestValidateCommandChar(t *testing.T) {
+	tests := map[string]bool{
+		".": true, "!": true, "~": true, "$": true,
+		"": false, "a": false, "1": false, " ": false, "..": false,
+		"§": false, "！": false,
+	}
+	for char, valid := range tests {
+		conf := Config{Nick: "gobot", Server: "sim.psim.us", Port: "8000",
+			CommandChar: char}
+		got := true
+		for _, p := range conf.Validate() {
+			if p.Field == "commandchar" {
+				got = false
+			}
+		}
+		if got != valid {
+			t.Errorf("commandchar %q: got valid %v, want %v", char, got, valid)
+		}
+	}
+}
+
+func TestParseConfigEnvWarnings(t *testing.T) {
+	conf, err := ParseConfig([]byte(twoBots), []string{"GOBOT_VERSION=1.2",
+		"GOBOT_NICK=gobot"})
+	if err != nil {
+		t.Fatalf("unknown variables should only be warned about: %v", err)
+	}
+	if len(conf.Warnings) != 1 || conf.Warnings[0].Field != "GOBOT_VERSION" {
+		t.Errorf("got warnings %v, want one about GOBOT_VERSION",
+			conf.Warnings)
+	}
+}
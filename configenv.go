@@ -0,0 +1,253 @@
+/*
+ * Overrides for the bot's config from environment variables, so that it can
+ * be configured without editing config.yaml, e.g. when running in a
+ * container.
+ *
+ * A setting can be overridden with GOBOT_ followed by its name in upper
+ * case, e.g. GOBOT_NICK or GOBOT_HOOKPORT. Settings inside others are joined
+ * with underscores, e.g. GOBOT_HOOKTEMPLATES_HTML_PUSH. Lists are separated
+ * by commas, e.g. GOBOT_OWNERS=alice,bob, and maps are given as key=value
+ * pairs separated by commas, e.g.
+ *   GOBOT_GITALIASES=server=Zarel/Pokemon-Showdown,bot=TalkTakesTime/gobot
+ * Rooms can be given without values, e.g. GOBOT_ROOMS=techcode,lobby.
+ *
+ * Adding _FILE to the name of any text setting reads its value from that file
+ * instead, e.g. GOBOT_PASS_FILE=/run/secrets/pass, which is how Docker and
+ * systemd pass secrets around. Surrounding whitespace is trimmed.
+ *
+ * Bots, OutHooks and RoomTemplates can't be overridden, since there's no
+ * sensible way to give them in a single variable. Variables starting with
+ * GOBOT_ that don't name a setting, such as GOBOT_VERSION set by an image,
+ * are only warned about, since they may be meant for something else.
+ *
+ * When the config lists several bots under bots (see ParseConfigs), GOBOT_
+ * variables only override the settings shared by the bots: a bot that gives
+ * a setting itself keeps its own value. A single bot's settings can be
+ * overridden with GOBOT_, its name in upper case with - replaced by _, and
+ * the setting, e.g. GOBOT_MAIN_NICK or GOBOT_TEST_PASS_FILE.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	EnvPrefix = "GOBOT_"
+	// added to the name of a variable to read its value from a file
+	EnvFileSuffix = "_FILE"
+)
+
+// A setting that can be overridden from the environment.
+type envSetting struct {
+	// the path to the setting, as used in ConfigProblem.Field
+	field string
+	value reflect.Value
+}
+
+// Overrides the config with any GOBOT_ variables in the given environment,
+// which should be in the form returned by os.Environ. Returns the variable
+// used for each setting that was overridden, keyed by the setting's path,
+// along with any problems found in the variables. Variables that aren't
+// settings are added to conf.Warnings instead.
+func (conf *Config) ApplyEnv(environ []string) (map[string]string,
+	[]ConfigProblem) {
+	return conf.applyEnv(environ, EnvPrefix)
+}
+
+// Overrides the config as ApplyEnv does, using the variables that start with
+// the given prefix rather than EnvPrefix.
+func (conf *Config) applyEnv(environ []string, prefix string) (
+	map[string]string, []ConfigProblem) {
+	settings := make(map[string]envSetting)
+	envSettings(reflect.ValueOf(conf).Elem(), prefix, "", settings)
+
+	vars := make(map[string]string)
+	names := []string{}
+	for _, kv := range environ {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 && strings.HasPrefix(pair[0], prefix) {
+			vars[pair[0]] = pair[1]
+			names = append(names, pair[0])
+		}
+	}
+	sort.Strings(names)
+
+	overridden := make(map[string]string)
+	problems := []ConfigProblem{}
+	problem := func(name, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{
+			Field:   name,
+			Message: fmt.Sprintf(format, args...),
+			fromEnv: true,
+		})
+	}
+
+	for _, name := range names {
+		value := vars[name]
+		setting, ok := settings[name]
+		if !ok && strings.HasSuffix(name, EnvFileSuffix) {
+			setting, ok = settings[strings.TrimSuffix(name, EnvFileSuffix)]
+			if !ok || setting.value.Kind() != reflect.String {
+				problem(name, "only text settings can be read from a file")
+				continue
+			}
+			if _, both := vars[strings.TrimSuffix(name,
+				EnvFileSuffix)]; both {
+				problem(name, "%s is also set; use one or the other",
+					strings.TrimSuffix(name, EnvFileSuffix))
+				continue
+			}
+
+			contents, err := ioutil.ReadFile(value)
+			if err != nil {
+				problem(name, "could not read %s: %s", value, err)
+				continue
+			}
+			value = strings.TrimSpace(string(contents))
+		} else if !ok {
+			conf.Warnings = append(conf.Warnings, ConfigProblem{
+				Field:   name,
+				Message: "there is no such setting, so it is ignored",
+				fromEnv: true,
+			})
+			continue
+		}
+
+		if err := setFromString(setting.value, value); err != nil {
+			problem(name, "%s", err)
+			continue
+		}
+		overridden[setting.field] = name
+	}
+
+	return overridden, problems
+}
+
+// Returns the prefix of the variables that override the settings of the bot
+// with the given name, e.g. GOBOT_MAIN_ for main.
+func botEnvPrefix(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_",
+		-1)) + "_"
+}
+
+// Returns the setting, at the top level of the config, that the variable
+// with the given name overrides once prefix is taken off, e.g. hooktemplates
+// for GOBOT_HOOKTEMPLATES_HTML_PUSH.
+func envSettingName(name, prefix string) string {
+	name = strings.TrimPrefix(name, prefix)
+	return strings.ToLower(strings.SplitN(name, "_", 2)[0])
+}
+
+// Finds the settings in v that can be overridden, recursing into structs.
+// Fields of kinds that can't be given as a string are skipped.
+func envSettings(v reflect.Value, prefix, path string,
+	settings map[string]envSetting) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || field.Tag.Get("yaml") == "-" {
+			continue // unexported, or not a setting
+		}
+		name := prefix + strings.ToUpper(field.Name)
+		fieldPath := path + strings.ToLower(field.Name)
+
+		value := v.Field(i)
+		switch {
+		case value.Kind() == reflect.Struct:
+			envSettings(value, name+"_", fieldPath+".", settings)
+		case settable(value.Type()):
+			settings[name] = envSetting{fieldPath, value}
+		}
+	}
+}
+
+// Returns true if values of the given type can be set by setFromString.
+func settable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		return true
+	case reflect.Slice:
+		return settable(t.Elem()) && t.Elem().Kind() != reflect.Slice
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && settable(t.Elem()) &&
+			t.Elem().Kind() != reflect.Slice
+	}
+	return false
+}
+
+// Sets v to the value given in s, converting it as described at the top of
+// this file.
+func setFromString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q should be true or false", s)
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return fmt.Errorf("%q is not a valid number", s)
+		}
+		v.SetInt(n)
+
+	case reflect.Slice:
+		items := splitList(s)
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromString(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitList(s) {
+			pair := strings.SplitN(item, "=", 2)
+			elem := reflect.New(v.Type().Elem()).Elem()
+			switch {
+			case len(pair) == 2:
+				if err := setFromString(elem, strings.TrimSpace(
+					pair[1])); err != nil {
+					return err
+				}
+			case elem.Kind() == reflect.Int || elem.Kind() == reflect.Int64:
+				// for rooms, where the value doesn't matter
+				elem.SetInt(1)
+			default:
+				return fmt.Errorf("%q should be of the form key=value", item)
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(pair[0])), elem)
+		}
+		v.Set(m)
+
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+	return nil
+}
+
+// Splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,276 @@
+/*
+ * An operator console, for controlling the bot from the terminal it runs in
+ * without having to be in its rooms. Started with -console; see
+ * main/gobot.go. Lines are edited as in a shell, with history on the up and
+ * down arrows and tab completion of commands and room names.
+ *
+ * The console understands:
+ *   say ROOM TEXT   says TEXT in ROOM, or PMs it to a user with user:name
+ *   raw LINE        sends LINE to PS! as it is, e.g. |/cmd roomlist or
+ *                   techcode|/roomauth
+ *   rooms           lists the rooms the bot is in
+ *   room ROOM       shows a room's title and users
+ *   queue           shows the messages waiting to be sent
+ *   status          shows the state of the connection
+ *   help            lists these
+ *   quit            stops the bot
+ * Anything starting with the command character is run as a bot command, as
+ * if the first of config.Owners had used it, and the reply is shown in the
+ * console.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ConsolePrompt = "gobot> "
+	// the room commands run from the console are run in. Replies to it are
+	// shown in the console rather than sent to PS!
+	ConsoleRoom = "console:"
+)
+
+var (
+	consoleCommands = []string{"say", "raw", "rooms", "room", "queue",
+		"status", "help", "quit"}
+)
+
+// An operator console running on a terminal.
+type Console struct {
+	term *term.Terminal
+	bot  *Bot
+}
+
+// Creates a console that reads from and writes to rw, which should be a
+// terminal in raw mode. Anything written to the console, such as logs, is
+// shown above the line being edited.
+func NewConsole(rw io.ReadWriter) *Console {
+	c := &Console{term: term.NewTerminal(rw, ConsolePrompt)}
+	c.term.AutoCompleteCallback = c.complete
+	return c
+}
+
+// Writes to the terminal without disturbing the line being edited.
+func (c *Console) Write(p []byte) (int, error) {
+	return c.term.Write(p)
+}
+
+// Prints a line to the console.
+func (c *Console) Print(format string, args ...interface{}) {
+	fmt.Fprintf(c.term, format+"\n", args...)
+}
+
+// Makes the console control the given bot, and has replies to commands run
+// from the console shown in it. Should be used before the bot starts.
+func (bot *Bot) AttachConsole(c *Console) {
+	c.bot = bot
+	bot.AddReplySink(ConsoleRoom, func(text string) {
+		c.Print("%s", text)
+	})
+}
+
+// Reads and runs lines from the console until it is closed or quit is used.
+// The console should be attached to a bot first.
+func (c *Console) Run() error {
+	for {
+		line, err := c.term.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if line != "" {
+			c.run(line)
+		}
+	}
+}
+
+// Runs a single line typed into the console.
+func (c *Console) run(line string) {
+	bot := c.bot
+	conf := bot.Config()
+	if strings.HasPrefix(line, conf.CommandChar) {
+		c.runCommand(line)
+		return
+	}
+
+	parts := strings.SplitN(line, " ", 2)
+	arg := ""
+	if len(parts) > 1 {
+		arg = strings.TrimSpace(parts[1])
+	}
+
+	switch parts[0] {
+	case "say":
+		words := strings.SplitN(arg, " ", 2)
+		if len(words) < 2 || strings.TrimSpace(words[1]) == "" {
+			c.Print("say ROOM TEXT")
+			return
+		}
+		bot.QueueMessage(strings.TrimSpace(words[1]), words[0])
+	case "raw":
+		if arg == "" {
+			c.Print("raw LINE, e.g. raw |/cmd roomlist")
+			return
+		}
+		if !strings.Contains(arg, "|") {
+			// a command for no room in particular
+			arg = "|" + arg
+		}
+		i := strings.Index(arg, "|")
+		bot.QueueMessage(arg[i+1:], arg[:i])
+	case "rooms":
+		c.printRooms()
+	case "room":
+		c.printRoom(toId(arg))
+	case "queue":
+		queued := bot.queuedMessages()
+		if len(queued) == 0 {
+			c.Print("Nothing is waiting to be sent.")
+		}
+		for _, msg := range queued {
+			c.Print("%s (waiting %s)", msg.data,
+				time.Since(msg.queued).Round(time.Millisecond))
+		}
+	case "status":
+		c.printStatus()
+	case "help":
+		c.Print("say ROOM TEXT, raw LINE, rooms, room ROOM, queue, status, "+
+			"quit, or %sCOMMAND to run a command as an owner", conf.CommandChar)
+	default:
+		c.Print("Unknown command %q; try help.", parts[0])
+	}
+}
+
+// Runs a bot command as the first of the bot's owners, in the console room
+// so that the reply comes back to the console.
+func (c *Console) runCommand(line string) {
+	if err := c.bot.RunAsOwner(ConsoleRoom, line); err == ErrNoOwners {
+		c.Print("Add yourself to owners to run commands from the console.")
+	} else if err != nil {
+		c.Print("%s", err)
+	}
+}
+
+func (c *Console) printRooms() {
+	rooms := c.bot.RoomList()
+	if len(rooms) == 0 {
+		c.Print("Not in any rooms.")
+	}
+	for _, id := range rooms {
+		if room, ok := c.bot.Room(id); ok {
+			c.Print("%s (%s): %d users", id, room.Title, len(room.Users))
+		} else {
+			c.Print("%s: joining", id)
+		}
+	}
+}
+
+func (c *Console) printRoom(id string) {
+	room, ok := c.bot.Room(id)
+	if !ok {
+		if c.bot.InRoom(id) {
+			c.Print("Still joining %s.", id)
+		} else {
+			c.Print("Not in %q.", id)
+		}
+		return
+	}
+
+	users := make([]string, 0, len(room.Users))
+	for _, user := range room.Users {
+		users = append(users, user)
+	}
+	sortUsers(users)
+	c.Print("%s (%s), %d users: %s", room.ID, room.Title, len(users),
+		strings.Join(users, ", "))
+	html := "can"
+	if !c.bot.CanUseHTML(id) {
+		html = "can't"
+	}
+	c.Print("The bot's rank is %q, so it %s use !htmlbox.",
+		string(room.Rank(toId(c.bot.Config().Nick))), html)
+}
+
+func (c *Console) printStatus() {
+	health := c.bot.Health(true)
+	if health.OK {
+		c.Print("Ready.")
+	} else {
+		c.Print("Not ready: %s.", strings.Join(health.Problems, ", "))
+	}
+	if health.LoggedIn {
+		c.Print("Logged in as %s.", health.Name)
+	}
+	if health.LastMessage != nil {
+		c.Print("Last heard from the server %s ago.",
+			time.Since(*health.LastMessage).Round(time.Second))
+	}
+	c.Print("%d message(s) waiting to be sent.", len(c.bot.queuedMessages()))
+}
+
+// Completes the word before the cursor when tab is pressed: console commands
+// and bot commands at the start of the line, and room names elsewhere.
+func (c *Console) complete(line string, pos int, key rune) (string, int,
+	bool) {
+	if key != '\t' || c.bot == nil {
+		return "", 0, false
+	}
+
+	start := strings.LastIndex(line[:pos], " ") + 1
+	prefix := line[start:pos]
+	var candidates []string
+	if start == 0 {
+		candidates = append(candidates, consoleCommands...)
+		commandChar := c.bot.Config().CommandChar
+		for name := range c.bot.commands {
+			candidates = append(candidates, commandChar+name)
+		}
+	} else {
+		candidates = c.bot.RoomList()
+	}
+
+	matches := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return "", 0, false
+	case 1:
+		completed := matches[0] + " "
+		return line[:start] + completed + line[pos:], start + len(completed),
+			true
+	}
+
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if common == prefix {
+		// nothing more can be filled in, so show the choices
+		c.Print("%s", strings.Join(matches, "  "))
+		return "", 0, false
+	}
+	return line[:start] + common + line[pos:], start + len(common), true
+}
@@ -0,0 +1,337 @@
+/*
+ * Commands added from chat, such as .rules or .discord, which reply with a
+ * fixed response. Each is either for a single room or global, in which case
+ * it can be used anywhere, including PMs, unless the room has its own command
+ * of the same name. They can't have the same name as the bot's own commands.
+ *
+ * A response is plain text, or HTML if it starts with !htmlbox or
+ * /addhtmlbox. It can contain these placeholders:
+ *   {user}  the name of the user using the command
+ *   {room}  the room it is used in
+ *   {args}  whatever follows the command name
+ * which are escaped in HTML responses. Plain text responses are never sent
+ * as commands, even if {args} starts with / or !.
+ *
+ * Users of at least config.CustomCommandRank in a room can manage its
+ * commands. Global commands can only be managed by the bot's owners. The
+ * commands are saved in the bot's store.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the rank needed to manage a room's commands if
+	// config.CustomCommandRank isn't given
+	DefaultCustomCommandRank = "%"
+	// how many commands each room, and the global scope, can have
+	MaxCustomCommands = 100
+
+	// the scope global commands are kept under
+	globalScope = "*"
+	// the name custom commands are saved under in the store
+	customCommandStore = "customcommands"
+)
+
+// A command added from chat.
+type CustomCommand struct {
+	Response string
+	// the name of the user who last added or edited it
+	Author  string
+	Updated time.Time
+}
+
+// Returns true if the command's response is HTML.
+func (c CustomCommand) HTML() bool {
+	return strings.HasPrefix(c.Response, "!htmlbox ") ||
+		strings.HasPrefix(c.Response, "/addhtmlbox ")
+}
+
+// Returns the response to the command for the given user, room and args.
+func (c CustomCommand) Expand(user, room, args string) string {
+	if c.HTML() {
+		user, room, args = html.EscapeString(user), html.EscapeString(room),
+			html.EscapeString(args)
+	}
+	text := strings.NewReplacer("{user}", user, "{room}", room,
+		"{args}", args).Replace(c.Response)
+	if !c.HTML() {
+		// so that {args} can't be used to make the bot run a command
+		text = strings.TrimLeft(text, "/! ")
+	}
+	return text
+}
+
+// The custom commands, keyed by scope (a room id or globalScope) and then by
+// name.
+type savedCustomCommands struct {
+	Commands map[string]map[string]CustomCommand
+}
+
+// Loads the custom commands from the store. Should be used before the bot
+// connects.
+func (bot *Bot) LoadCustomCommands() error {
+	var saved savedCustomCommands
+	if err := bot.store.Load(customCommandStore, &saved); err != nil {
+		return err
+	}
+	bot.customCommands = saved.Commands
+	if bot.customCommands == nil {
+		bot.customCommands = make(map[string]map[string]CustomCommand)
+	}
+	return nil
+}
+
+// Saves the custom commands. Failures are only logged, since the commands
+// still work unless the bot restarts.
+func (bot *Bot) saveCustomCommands() {
+	err := bot.store.Save(customCommandStore,
+		savedCustomCommands{bot.customCommands})
+	if err != nil {
+		bot.Logger(LogCommands).Error("could not save custom commands",
+			"error", err)
+	}
+}
+
+// Returns the scope of a room's commands. Messages without a room are from
+// the lobby, and PMs only have global commands.
+func customCommandScope(room string) string {
+	switch {
+	case room == "":
+		return "lobby"
+	case strings.HasPrefix(room, "user:"):
+		return globalScope
+	}
+	return room
+}
+
+// Returns the custom command with the given name that can be used in the
+// given room, if there is one. The room's own commands take precedence over
+// global ones.
+func (bot *Bot) CustomCommand(room, name string) (CustomCommand, bool) {
+	if c, ok := bot.customCommands[customCommandScope(room)][name]; ok {
+		return c, true
+	}
+	c, ok := bot.customCommands[globalScope][name]
+	return c, ok
+}
+
+// Returns the function that runs the command with the given name in the
+// given room, whether it is one of the bot's own commands or a custom one.
+func (bot *Bot) lookupCommand(room, name string) (func(Message), bool) {
+	if f, ok := bot.commands[name]; ok {
+		return f, true
+	}
+	if c, ok := bot.CustomCommand(room, name); ok {
+		return func(msg Message) {
+			bot.runCustomCommand(c, msg)
+		}, true
+	}
+	return nil, false
+}
+
+// Sends a custom command's response. HTML responses are only sent where the
+// bot can use !htmlbox.
+func (bot *Bot) runCustomCommand(c CustomCommand, msg Message) {
+	if c.HTML() && !strings.HasPrefix(msg.room, "user:") &&
+		!bot.CanUseHTML(msg.room) {
+		bot.QueueMessage("I need to be able to use !htmlbox here to "+
+			"respond to "+bot.config.CommandChar+msg.args[2]+".", msg.room)
+		return
+	}
+	_, user := splitUser(msg.args[0])
+	room := msg.room
+	if strings.HasPrefix(room, "user:") {
+		room = "PM"
+	} else if room == "" {
+		room = "lobby"
+	}
+	bot.QueueMessage(c.Expand(user, room, msg.args[1]), msg.room)
+}
+
+// Works out the scope and name of the command a message is about, from
+// arguments of the form "[room|global] name", and checks that the user can
+// manage the commands in that scope. Replies and returns false if not.
+func (bot *Bot) customCommandTarget(msg Message, target,
+	usage string) (string, string, bool) {
+	fields := strings.Fields(target)
+	scope := customCommandScope(msg.room)
+	switch {
+	case len(fields) == 2 && toId(fields[0]) == "global":
+		scope = globalScope
+	case len(fields) == 2:
+		scope = toId(fields[0])
+	case len(fields) != 1 || strings.HasPrefix(msg.room, "user:"):
+		// PMs need a scope, so that global commands aren't added by mistake
+		bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+		return "", "", false
+	}
+	name := toId(fields[len(fields)-1])
+	if name == "" || scope == "" {
+		bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+		return "", "", false
+	}
+
+	_, user := splitUser(msg.args[0])
+	if bot.IsOwner(user) {
+		return scope, name, true
+	}
+	if scope == globalScope {
+		bot.QueueMessage("Only the bot's owners can manage global commands.",
+			msg.room)
+		return "", "", false
+	}
+	minRank := bot.config.CustomCommandRank
+	if minRank == "" {
+		minRank = DefaultCustomCommandRank
+	}
+	r, _ := bot.Room(scope)
+	if !RankAtLeast(r.Rank(toId(user)), minRank[0]) {
+		bot.QueueMessage("Only "+minRank+" and above can manage the "+
+			"commands in "+scope+".", msg.room)
+		return "", "", false
+	}
+	return scope, name, true
+}
+
+// Describes a scope for replies, e.g. "techcode" or "global".
+func scopeName(scope string) string {
+	if scope == globalScope {
+		return "global"
+	}
+	return scope
+}
+
+// Returns a function that adds a command, or edits an existing one,
+// depending on edit.
+//
+// Syntax: .addcmd [room|global] name, response, and the same for .editcmd
+func (bot *Bot) SetCustomCommand(edit bool) func(Message) {
+	cmd := "addcmd"
+	if edit {
+		cmd = "editcmd"
+	}
+	usage := cmd + " [room|global] name, response"
+
+	return func(msg Message) {
+		parts := strings.SplitN(msg.args[1], ",", 2)
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+			return
+		}
+		scope, name, ok := bot.customCommandTarget(msg, parts[0], usage)
+		if !ok {
+			return
+		}
+		response := strings.TrimSpace(parts[1])
+
+		_, exists := bot.customCommands[scope][name]
+		switch {
+		case bot.commands[name] != nil:
+			bot.QueueMessage(bot.config.CommandChar+name+" is one of the "+
+				"bot's own commands.", msg.room)
+			return
+		case edit && !exists:
+			bot.QueueMessage(fmt.Sprintf("There is no %s%s command for %s. "+
+				"Use %saddcmd to add it.", bot.config.CommandChar, name,
+				scopeName(scope), bot.config.CommandChar), msg.room)
+			return
+		case !edit && exists:
+			bot.QueueMessage(fmt.Sprintf("There is already a %s%s command "+
+				"for %s. Use %seditcmd to change it.", bot.config.CommandChar,
+				name, scopeName(scope), bot.config.CommandChar), msg.room)
+			return
+		case !edit && len(bot.customCommands[scope]) >= MaxCustomCommands:
+			bot.QueueMessage(fmt.Sprintf("%s already has %d commands.",
+				scopeName(scope), MaxCustomCommands), msg.room)
+			return
+		}
+		c := CustomCommand{Response: response}
+		if !c.HTML() && strings.TrimLeft(response, "/! ") != response {
+			bot.QueueMessage("Responses can't be commands, apart from "+
+				"!htmlbox and /addhtmlbox.", msg.room)
+			return
+		}
+
+		_, c.Author = splitUser(msg.args[0])
+		c.Updated = time.Now()
+		if bot.customCommands[scope] == nil {
+			bot.customCommands[scope] = make(map[string]CustomCommand)
+		}
+		bot.customCommands[scope][name] = c
+		bot.saveCustomCommands()
+
+		done := "Added"
+		if edit {
+			done = "Changed"
+		}
+		bot.QueueMessage(fmt.Sprintf("%s %s%s for %s.", done,
+			bot.config.CommandChar, name, scopeName(scope)), msg.room)
+	}
+}
+
+// Removes a custom command.
+//
+// Syntax: .delcmd [room|global] name
+func (bot *Bot) DeleteCustomCommand(msg Message) {
+	scope, name, ok := bot.customCommandTarget(msg, msg.args[1],
+		"delcmd [room|global] name")
+	if !ok {
+		return
+	}
+	if _, exists := bot.customCommands[scope][name]; !exists {
+		bot.QueueMessage(fmt.Sprintf("There is no %s%s command for %s.",
+			bot.config.CommandChar, name, scopeName(scope)), msg.room)
+		return
+	}
+
+	delete(bot.customCommands[scope], name)
+	if len(bot.customCommands[scope]) == 0 {
+		delete(bot.customCommands, scope)
+	}
+	bot.saveCustomCommands()
+	bot.QueueMessage(fmt.Sprintf("Removed %s%s from %s.",
+		bot.config.CommandChar, name, scopeName(scope)), msg.room)
+}
+
+// Lists the custom commands that can be used in a room, which defaults to
+// the current one, or the global commands.
+//
+// Syntax: .listcmds [room|global]
+func (bot *Bot) ListCustomCommands(msg Message) {
+	scope := customCommandScope(msg.room)
+	if arg := toId(msg.args[1]); arg == "global" {
+		scope = globalScope
+	} else if arg != "" {
+		scope = arg
+	}
+
+	names := []string{}
+	for name := range bot.customCommands[scope] {
+		names = append(names, bot.config.CommandChar+name)
+	}
+	if scope != globalScope {
+		for name := range bot.customCommands[globalScope] {
+			if _, ok := bot.customCommands[scope][name]; !ok {
+				names = append(names, bot.config.CommandChar+name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		bot.QueueMessage("There are no custom commands for "+
+			scopeName(scope)+".", msg.room)
+		return
+	}
+	sort.Strings(names)
+	bot.QueueMessage("Custom commands for "+scopeName(scope)+": "+
+		strings.Join(names, ", "), msg.room)
+}
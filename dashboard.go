@@ -0,0 +1,436 @@
+/*
+ * A web dashboard for looking after the bot, served at /admin/ when
+ * config.EnableDashboard is set. Like the other admin pages it needs
+ * config.AdminToken, given as ?token= or as a bearer token, e.g.
+ *   http://localhost:8080/admin/?token=TOKEN
+ *
+ * The dashboard shows the state of the connection, the rooms the bot is in
+ * and who is in them, the messages waiting to be sent, recent commands and
+ * errors, and webhook deliveries, refreshing every few seconds. It also has
+ * forms to:
+ *   POST /admin/say    say something in a room, or PM a user with user:name
+ *   POST /admin/join   join a room
+ *   POST /admin/leave  leave a room
+ *   POST /admin/alias  add or change an alias for .git, or remove it if no
+ *                      repository is given
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DashboardPath = "/admin/"
+
+	// how many commands and errors the dashboard shows
+	recentSize = 20
+	// how often the dashboard refreshes, in seconds
+	dashboardRefresh = 5
+)
+
+// A command that has been used, as shown on the dashboard.
+type recentCommand struct {
+	Time     time.Time
+	Room     string
+	User     string
+	Command  string
+	Args     string
+	Duration time.Duration
+}
+
+// A warning or error that has been logged, as shown on the dashboard.
+type recentError struct {
+	Time      time.Time
+	Subsystem string
+	Level     string
+	Message   string
+}
+
+// The last few commands used and errors logged, newest first.
+type recentActivity struct {
+	mu       sync.Mutex
+	commands []recentCommand
+	errors   []recentError
+}
+
+func (r *recentActivity) addCommand(c recentCommand) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append([]recentCommand{c}, r.commands...)
+	if len(r.commands) > recentSize {
+		r.commands = r.commands[:recentSize]
+	}
+}
+
+func (r *recentActivity) addError(e recentError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append([]recentError{e}, r.errors...)
+	if len(r.errors) > recentSize {
+		r.errors = r.errors[:recentSize]
+	}
+}
+
+// A room as shown on the dashboard.
+type dashboardRoom struct {
+	ID    string
+	Title string
+	// whether the bot is still waiting to join
+	Joining bool
+	Users   []string
+}
+
+// A queued message as shown on the dashboard.
+type dashboardMessage struct {
+	Room    string
+	Data    string
+	Waiting time.Duration
+}
+
+// An alias for .git as shown on the dashboard.
+type dashboardAlias struct {
+	Alias string
+	Repo  string
+}
+
+// Everything shown on the dashboard.
+type dashboardPage struct {
+	Token   string
+	Flash   string
+	Refresh int
+
+	Health     HealthReport
+	Rooms      []dashboardRoom
+	Queue      []dashboardMessage
+	Commands   []recentCommand
+	Errors     []recentError
+	Hooks      bool
+	Deliveries []string
+	Aliases    []dashboardAlias
+}
+
+// Gathers what is shown on the dashboard. Safe to use from any goroutine.
+func (bot *Bot) dashboardPage(req *http.Request) dashboardPage {
+	page := dashboardPage{
+		Token:   req.URL.Query().Get("token"),
+		Flash:   req.URL.Query().Get("flash"),
+		Refresh: dashboardRefresh * 1000,
+		Health:  bot.Health(true),
+		Hooks:   bot.deliveries != nil,
+	}
+
+	for _, id := range bot.RoomList() {
+		room, ok := bot.Room(id)
+		view := dashboardRoom{ID: id, Title: room.Title, Joining: !ok}
+		for _, user := range room.Users {
+			view.Users = append(view.Users, user)
+		}
+		sortUsers(view.Users)
+		page.Rooms = append(page.Rooms, view)
+	}
+
+	for _, msg := range bot.queuedMessages() {
+		page.Queue = append(page.Queue, dashboardMessage{
+			Room:    msg.room,
+			Data:    msg.data,
+			Waiting: time.Since(msg.queued).Round(time.Millisecond),
+		})
+	}
+
+	bot.recent.mu.Lock()
+	page.Commands = append(page.Commands, bot.recent.commands...)
+	page.Errors = append(page.Errors, bot.recent.errors...)
+	bot.recent.mu.Unlock()
+
+	if bot.deliveries != nil {
+		for _, d := range bot.deliveries.List() {
+			page.Deliveries = append(page.Deliveries, d.Summary())
+		}
+	}
+
+	conf := bot.Config()
+	for alias, repo := range conf.GitAliases {
+		page.Aliases = append(page.Aliases, dashboardAlias{alias, repo})
+	}
+	sort.Slice(page.Aliases, func(i, j int) bool {
+		return page.Aliases[i].Alias < page.Aliases[j].Alias
+	})
+	return page
+}
+
+// Sorts users as given in Room.Users by rank, highest first, then by name.
+func sortUsers(users []string) {
+	sort.Slice(users, func(i, j int) bool {
+		rankI, nameI := splitUser(users[i])
+		rankJ, nameJ := splitUser(users[j])
+		if rankI != rankJ {
+			return RankAtLeast(rankI, rankJ)
+		}
+		return toId(nameI) < toId(nameJ)
+	})
+}
+
+// Serves the dashboard. See the top of this file for what it provides.
+func (bot *Bot) ServeDashboard(w http.ResponseWriter, req *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, DashboardPath),
+		"/")
+	if action == "" {
+		if req.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := "page"
+		if req.URL.Query().Get("live") != "" {
+			// just the parts that are refreshed
+			name = "live"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.ExecuteTemplate(w, name,
+			bot.dashboardPage(req)); err != nil {
+			bot.Logger(LogHTTP).Error("could not show dashboard",
+				"error", err)
+		}
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var flash string
+	switch action {
+	case "say":
+		flash = bot.dashboardSay(req.FormValue("room"),
+			req.FormValue("text"))
+	case "join":
+		flash = bot.dashboardJoin(toId(req.FormValue("room")))
+	case "leave":
+		flash = bot.dashboardLeave(toId(req.FormValue("room")))
+	case "alias":
+		flash = bot.dashboardAlias(strings.TrimSpace(req.FormValue("alias")),
+			strings.TrimSpace(req.FormValue("repo")))
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	query := url.Values{"flash": {flash}}
+	if token := req.URL.Query().Get("token"); token != "" {
+		query.Set("token", token)
+	}
+	// the redirect is relative, since the dashboard may be served under a
+	// bot's name by a Manager
+	w.Header().Set("Location", "./?"+query.Encode())
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// Says text in a room, or PMs it to a user if room is of the form
+// user:name. Returns what happened, to show on the dashboard.
+func (bot *Bot) dashboardSay(room, text string) string {
+	room = targetId(room)
+	text = strings.TrimSpace(text)
+	if room == "" || room == "user:" || text == "" {
+		return "Give a room and something to say."
+	}
+
+	bot.Logger(LogHTTP).Info("saying from the dashboard", "room", room,
+		"text", text)
+	bot.QueueMessage(text, room)
+	return "Queued message for " + room + "."
+}
+
+// Joins a room, returning what happened to show on the dashboard.
+func (bot *Bot) dashboardJoin(room string) string {
+	if room == "" {
+		return "Give a room to join."
+	}
+	var flash string
+	err := bot.runInMainLoop(func() {
+		if bot.InRoom(room) {
+			flash = "Already in " + room + "."
+			return
+		}
+		bot.Logger(LogHTTP).Info("joining from the dashboard", "room", room)
+		bot.JoinRoom(room)
+		bot.SaveRooms()
+		flash = "Joining " + room + "."
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return flash
+}
+
+// Leaves a room, returning what happened to show on the dashboard.
+func (bot *Bot) dashboardLeave(room string) string {
+	if room == "" {
+		return "Give a room to leave."
+	}
+	var flash string
+	err := bot.runInMainLoop(func() {
+		if !bot.InRoom(room) {
+			flash = "Not in " + room + "."
+			return
+		}
+		bot.Logger(LogHTTP).Info("leaving from the dashboard", "room", room)
+		bot.LeaveRoom(room)
+		bot.SaveRooms()
+		flash = "Left " + room + "."
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return flash
+}
+
+// Sets or removes an alias, returning what happened to show on the
+// dashboard.
+func (bot *Bot) dashboardAlias(alias, repo string) string {
+	var flash string
+	err := bot.runInMainLoop(func() {
+		if err := bot.SetAlias(alias, repo); err != nil {
+			flash = "Could not change the alias: " + err.Error()
+			return
+		}
+		bot.Logger(LogHTTP).Info("alias changed from the dashboard",
+			"alias", alias, "repo", repo)
+		if repo == "" {
+			flash = "Removed " + alias + "."
+		} else {
+			flash = alias + " is now " + repo + "."
+		}
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return flash
+}
+
+// Adds the dashboard to the bot's HTTP server.
+func (bot *Bot) CreateDashboard() {
+	bot.HandleHTTP(DashboardPath,
+		bot.RequireToken(http.HandlerFunc(bot.ServeDashboard)))
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(
+	template.FuncMap{
+		"time": func(t time.Time) string {
+			return t.Format("15:04:05")
+		},
+	}).Parse(`
+{{define "page"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{with .Health.Name}}{{.}} - {{end}}gobot</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left;
+	vertical-align: top; }
+.ok { color: green; } .bad { color: #c00; }
+.flash { background: #ffd; padding: 4px; }
+form { display: inline-block; margin: 0 1em 1em 0; }
+</style>
+</head>
+<body>
+<h1>gobot</h1>
+{{with .Flash}}<p class="flash">{{.}}</p>{{end}}
+
+<form method="post" action="say?token={{.Token}}">
+<input name="room" placeholder="room or user:name" size="15">
+<input name="text" placeholder="message" size="40">
+<button>Say</button>
+</form>
+<form method="post" action="join?token={{.Token}}">
+<input name="room" placeholder="room" size="10"> <button>Join</button>
+</form>
+<form method="post" action="leave?token={{.Token}}">
+<input name="room" placeholder="room" size="10"> <button>Leave</button>
+</form>
+
+<div id="live">{{template "live" .}}</div>
+
+<h2>Aliases</h2>
+<table>
+<tr><th>Alias</th><th>Repository</th></tr>
+{{range .Aliases}}<tr><td>{{.Alias}}</td><td>{{.Repo}}</td></tr>
+{{end}}</table>
+<form method="post" action="alias?token={{.Token}}">
+<input name="alias" placeholder="alias" size="10">
+<input name="repo" placeholder="user/repo (blank to remove)" size="25">
+<button>Set alias</button>
+</form>
+
+<script>
+setInterval(function() {
+	fetch("?live=1&token=" + encodeURIComponent({{.Token}}))
+		.then(function(res) { return res.ok ? res.text() : null; })
+		.then(function(html) {
+			if (html !== null) {
+				document.getElementById("live").innerHTML = html;
+			}
+		});
+}, {{.Refresh}});
+</script>
+</body>
+</html>
+{{end}}
+
+{{define "live"}}
+<h2>Connection</h2>
+<p>{{if .Health.OK}}<span class="ok">Ready</span>{{else}}<span class="bad">Not
+ready: {{range $i, $p := .Health.Problems}}{{if $i}}, {{end}}{{$p}}{{end}}</span>{{end}}</p>
+<table>
+<tr><th>Connected</th><td>{{.Health.Connected}}{{with .Health.ConnectedAt}}
+	since {{.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+<tr><th>Logged in</th><td>{{.Health.LoggedIn}}{{with .Health.Name}} as {{.}}{{end}}</td></tr>
+<tr><th>Last message</th><td>{{with .Health.LastMessage}}{{time .}}{{end}}</td></tr>
+<tr><th>Last pong</th><td>{{with .Health.LastPong}}{{time .}}{{end}}</td></tr>
+</table>
+
+<h2>Rooms</h2>
+<table>
+<tr><th>Room</th><th>Users</th></tr>
+{{range .Rooms}}<tr><td>{{.ID}}{{if and .Title (ne .Title .ID)}} ({{.Title}}){{end}}</td>
+<td>{{if .Joining}}joining...{{else}}{{len .Users}}:
+{{range $i, $u := .Users}}{{if $i}}, {{end}}{{$u}}{{end}}{{end}}</td></tr>
+{{end}}</table>
+
+<h2>Waiting to be sent ({{len .Queue}})</h2>
+<table>
+<tr><th>Room</th><th>Message</th><th>Waiting</th></tr>
+{{range .Queue}}<tr><td>{{.Room}}</td><td>{{.Data}}</td><td>{{.Waiting}}</td></tr>
+{{end}}</table>
+
+<h2>Recent commands</h2>
+<table>
+<tr><th>Time</th><th>Room</th><th>User</th><th>Command</th><th>Took</th></tr>
+{{range .Commands}}<tr><td>{{time .Time}}</td><td>{{.Room}}</td><td>{{.User}}</td>
+<td>{{.Command}} {{.Args}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Level</th><th>Subsystem</th><th>Message</th></tr>
+{{range .Errors}}<tr><td>{{time .Time}}</td><td>{{.Level}}</td><td>{{.Subsystem}}</td>
+<td>{{.Message}}</td></tr>
+{{end}}</table>
+
+<h2>Webhook deliveries</h2>
+{{if .Hooks}}<ul>
+{{range .Deliveries}}<li>{{.}}</li>
+{{else}}<li>None yet.</li>
+{{end}}</ul>{{else}}<p>Webhooks are disabled.</p>{{end}}
+{{end}}
+`))
@@ -0,0 +1,488 @@
+/*
+ * Keeps a log of the last few GitHub webhook deliveries, so that missing
+ * announcements can be debugged. Each delivery records the request GitHub
+ * sent, whether hookserve accepted it, and the messages it produced. Stored
+ * deliveries can be replayed through the webhook handlers, which is handy for
+ * trying out templates.
+ *
+ * Deliveries with bad signatures, which anyone can send, are kept apart from
+ * the real ones so that they can't push them out of the log. Only the last
+ * few are kept, without their payloads, and they aren't saved. Payloads too
+ * big to be worth saving aren't kept either, so those deliveries can't be
+ * replayed.
+ *
+ * The log can be viewed using the .hooklog command, or over HTTP at
+ * /hooklog/ if config.AdminToken is set:
+ *   GET  /hooklog/          the stored deliveries, without their payloads
+ *   GET  /hooklog/ID        a single delivery, in full
+ *   POST /hooklog/ID/replay replays a delivery. Give ?room=ROOM (possibly
+ *                           more than once) to only announce it in those rooms
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TalkTakesTime/hookserve/hookserve"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the number of deliveries kept if config.HookLogSize isn't given
+	DefaultHookLogSize = 20
+
+	// the name the delivery log is saved under in the store
+	deliveryStore = "deliveries"
+
+	// the largest payload the bot will accept. GitHub caps payloads at 25MB,
+	// but anything near that is far bigger than the bot will ever announce
+	maxPayloadSize = 5 << 20
+	// the largest payload kept in the log. Bigger ones are dropped, so that
+	// saving the log stays cheap
+	maxStoredPayload = 256 << 10
+	// the number of deliveries with bad signatures kept
+	unverifiedLogSize = 5
+)
+
+var (
+	ErrNoDelivery     = errors.New("no such delivery")
+	ErrPayloadNotKept = errors.New("the delivery's payload wasn't kept")
+)
+
+// A message produced in response to a webhook.
+type HookMessage struct {
+	Room string
+	Text string
+}
+
+// A single webhook delivery, as received from GitHub.
+type Delivery struct {
+	ID   int64
+	Time time.Time
+	// the ID of the delivery this replayed, if it is a replay
+	ReplayOf int64 `json:",omitempty"`
+
+	// the request GitHub sent
+	Headers http.Header
+	Payload string `json:",omitempty"`
+	// the size of the payload in bytes, which is still known if the payload
+	// wasn't kept
+	PayloadSize int
+
+	// the response hookserve gave, and whether it accepted the signature
+	Status   int
+	Response string
+	Verified bool
+
+	// the type of event, e.g. push
+	Event string
+	// the rooms the event was announced in, and what was said there
+	Rooms    []string
+	Messages []HookMessage
+}
+
+// The last few webhook deliveries, oldest first.
+type DeliveryLog struct {
+	store *Store
+	size  int
+	log   *slog.Logger
+
+	mu         sync.Mutex
+	next       int64
+	deliveries []*Delivery
+	// the last few deliveries with bad signatures, oldest first
+	unverified []*Delivery
+}
+
+// the form the delivery log is saved in
+type savedDeliveries struct {
+	Next       int64
+	Deliveries []*Delivery
+}
+
+// Creates a log that keeps the last size deliveries, loading any that were
+// saved by a previous run. Problems loading or saving the log are reported
+// to logger.
+func NewDeliveryLog(store *Store, size int,
+	logger *slog.Logger) *DeliveryLog {
+	if size <= 0 {
+		size = DefaultHookLogSize
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var saved savedDeliveries
+	if err := store.Load(deliveryStore, &saved); err != nil {
+		logger.Error("could not load the webhook delivery log", "error", err)
+	}
+	if len(saved.Deliveries) > size {
+		saved.Deliveries = saved.Deliveries[len(saved.Deliveries)-size:]
+	}
+
+	return &DeliveryLog{
+		store:      store,
+		size:       size,
+		log:        logger,
+		next:       saved.Next + 1,
+		deliveries: saved.Deliveries,
+	}
+}
+
+// Adds a delivery to the log, giving it an ID, and forgets the oldest if
+// there are too many. Deliveries with bad signatures have their payloads
+// dropped and are kept apart from the rest.
+func (l *DeliveryLog) Add(d *Delivery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d.ID = l.next
+	l.next++
+	if !d.Verified {
+		d.Payload = ""
+		l.unverified = append(l.unverified, d)
+		if len(l.unverified) > unverifiedLogSize {
+			l.unverified = l.unverified[1:]
+		}
+		return
+	}
+	if len(d.Payload) > maxStoredPayload {
+		d.Payload = ""
+	}
+
+	l.deliveries = append(l.deliveries, d)
+	if len(l.deliveries) > l.size {
+		l.deliveries = l.deliveries[len(l.deliveries)-l.size:]
+	}
+
+	err := l.store.Save(deliveryStore, savedDeliveries{
+		Next:       d.ID,
+		Deliveries: l.deliveries,
+	})
+	if err != nil {
+		l.log.Error("could not save the webhook delivery log", "error", err)
+	}
+}
+
+// Returns the delivery with the given ID, if it is still in the log.
+func (l *DeliveryLog) Get(id int64) (*Delivery, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, list := range [][]*Delivery{l.deliveries, l.unverified} {
+		for _, d := range list {
+			if d.ID == id {
+				return d, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Returns the deliveries in the log, including those with bad signatures,
+// newest first.
+func (l *DeliveryLog) List() []*Delivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]*Delivery, 0, len(l.deliveries)+len(l.unverified))
+	list = append(list, l.deliveries...)
+	list = append(list, l.unverified...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+	return list
+}
+
+// records the response hookserve gives to a delivery
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// Writes the recorded response to w.
+func (r *responseRecorder) writeTo(w http.ResponseWriter) {
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
+
+// Receives a webhook from GitHub, announcing it in the hook rooms and adding
+// it to the delivery log.
+func (bot *Bot) ReceiveHook(w http.ResponseWriter, req *http.Request) {
+	payload, ok := readPayload(w, req)
+	if !ok {
+		return
+	}
+	bot.receiveDelivery(req.Header, payload).writeTo(w)
+}
+
+// Reads the payload of a webhook, replying with an error if it can't be
+// read.
+func readPayload(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body,
+		maxPayloadSize))
+	if err != nil {
+		http.Error(w, "could not read payload", http.StatusBadRequest)
+		return nil, false
+	}
+	return payload, true
+}
+
+// Handles a webhook that has been received, announcing it and adding it to
+// the delivery log. Returns the response to give.
+func (bot *Bot) receiveDelivery(headers http.Header,
+	payload []byte) *responseRecorder {
+	d := &Delivery{
+		Time:        time.Now(),
+		Headers:     headers,
+		Payload:     string(payload),
+		PayloadSize: len(payload),
+	}
+	rec := bot.processDelivery(d, bot.Config().HookRooms)
+	bot.deliveries.Add(d)
+	return rec
+}
+
+// Runs a delivery through hookserve and, if it is accepted, announces the
+// event in the given rooms. The outcome is recorded in the delivery, and the
+// response hookserve gave is returned.
+func (bot *Bot) processDelivery(d *Delivery, rooms []string) *responseRecorder {
+	// a server of our own means the event hookserve parses can't get mixed
+	// up with any other delivery's
+	server := hookserve.NewServer()
+	server.Secret = bot.Config().HookSecret
+	server.Events = make(chan hookserve.Event, 1)
+
+	req, _ := http.NewRequest("POST", server.Path,
+		strings.NewReader(d.Payload))
+	req.Header = d.Headers
+	rec := &responseRecorder{header: make(http.Header)}
+	server.ServeHTTP(rec, req)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	d.Status = rec.status
+	d.Response = strings.TrimSpace(rec.body.String())
+	d.Verified = rec.status != http.StatusForbidden
+	d.Event = d.Headers.Get("X-GitHub-Event")
+	event := d.Event
+	if !d.Verified {
+		// anyone can send these, so the event they give isn't trusted
+		event = "unverified"
+	}
+	bot.metrics.WebhookDeliveries.Inc(event, strconv.Itoa(d.Status))
+
+	select {
+	case event := <-server.Events:
+		d.Rooms = rooms
+		d.Messages = bot.HandleHook(event, rooms)
+	default:
+		// hookserve rejected it, or it was an event we don't get told about
+	}
+
+	return rec
+}
+
+// Replays the delivery with the given ID through the webhook handlers,
+// announcing it in the given rooms, or the hook rooms if none are given.
+// The replay is added to the log as a new delivery.
+func (bot *Bot) ReplayDelivery(id int64, rooms []string) (*Delivery, error) {
+	if bot.deliveries == nil {
+		return nil, ErrNoDelivery
+	}
+	original, ok := bot.deliveries.Get(id)
+	if !ok {
+		return nil, ErrNoDelivery
+	}
+	if original.Payload == "" && original.PayloadSize > 0 {
+		return nil, ErrPayloadNotKept
+	}
+	if len(rooms) == 0 {
+		rooms = bot.Config().HookRooms
+	}
+
+	d := &Delivery{
+		Time:        time.Now(),
+		ReplayOf:    original.ID,
+		Headers:     original.Headers,
+		Payload:     original.Payload,
+		PayloadSize: original.PayloadSize,
+	}
+	bot.processDelivery(d, rooms)
+	bot.deliveries.Add(d)
+	return d, nil
+}
+
+// Serves the delivery log over HTTP. See the top of this file for the
+// endpoints it provides.
+func (bot *Bot) ServeHookLog(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/hooklog"), "/")
+	parts := strings.Split(path, "/")
+
+	var result interface{}
+	switch {
+	case path == "" && req.Method == "GET":
+		list := bot.deliveries.List()
+		summaries := make([]Delivery, len(list))
+		for i, d := range list {
+			summaries[i] = *d
+			summaries[i].Payload = ""
+		}
+		result = summaries
+	case len(parts) <= 2:
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+
+		if len(parts) == 1 && req.Method == "GET" {
+			d, ok := bot.deliveries.Get(id)
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			result = d
+		} else if len(parts) == 2 && parts[1] == "replay" &&
+			req.Method == "POST" {
+			d, err := bot.ReplayDelivery(id, req.URL.Query()["room"])
+			if err == ErrPayloadNotKept {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.NotFound(w, req)
+				return
+			}
+			result = d
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Describes a delivery in a single line, for the .hooklog command.
+func (d *Delivery) Summary() string {
+	summary := fmt.Sprintf("#%d: %s at %s, status %d", d.ID, d.Event,
+		d.Time.Format("2006-01-02 15:04:05"), d.Status)
+	if !d.Verified {
+		summary += " (bad signature)"
+	} else if d.Payload == "" && d.PayloadSize > 0 {
+		summary += " (payload not kept)"
+	}
+	if d.ReplayOf != 0 {
+		summary += fmt.Sprintf(", replay of #%d", d.ReplayOf)
+	}
+	return summary + fmt.Sprintf(", %d message(s) to %s", len(d.Messages),
+		strings.Join(d.Rooms, ", "))
+}
+
+// Handles the .hooklog command. Owner only.
+//
+// Syntax:
+//
+//	.hooklog -- lists the last few deliveries
+//	.hooklog ID -- describes a delivery and the messages it produced
+//	.hooklog replay ID[, room, room...] -- replays a delivery, optionally
+//	    only in the given rooms
+func (bot *Bot) HookLogCommand(msg Message) {
+	if !bot.IsOwner(msg.args[0]) {
+		return
+	}
+	if bot.deliveries == nil {
+		bot.QueueMessage("Webhooks are disabled.", msg.room)
+		return
+	}
+
+	args := strings.Fields(strings.Replace(msg.args[1], ",", " ", -1))
+	switch {
+	case len(args) == 0:
+		list := bot.deliveries.List()
+		if len(list) == 0 {
+			bot.QueueMessage("No webhooks have been received.", msg.room)
+			return
+		}
+		if len(list) > 5 {
+			list = list[:5]
+		}
+		for _, d := range list {
+			bot.QueueMessage(d.Summary(), msg.room)
+		}
+	case args[0] == "replay" && len(args) > 1:
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if err != nil {
+			bot.QueueMessage("Invalid delivery: "+args[1], msg.room)
+			return
+		}
+		rooms := make([]string, 0, len(args)-2)
+		for _, room := range args[2:] {
+			rooms = append(rooms, toId(room))
+		}
+
+		// shortening URLs can take a while, so don't hold up other messages
+		go func() {
+			d, err := bot.ReplayDelivery(id, rooms)
+			if err != nil {
+				bot.QueueMessage(err.Error()+": #"+args[1], msg.room)
+				return
+			}
+			bot.QueueMessage("Replayed as "+d.Summary(), msg.room)
+		}()
+	default:
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+		d, ok := bot.deliveries.Get(id)
+		if err != nil || !ok {
+			bot.QueueMessage("No such delivery: "+args[0], msg.room)
+			return
+		}
+
+		bot.QueueMessage(d.Summary(), msg.room)
+		if d.Response != "" {
+			bot.QueueMessage("Response: "+truncate(200, d.Response), msg.room)
+		}
+		for _, m := range d.Messages {
+			bot.QueueMessage("To "+m.Room+": "+truncate(200, m.Text),
+				msg.room)
+		}
+	}
+}
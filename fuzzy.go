@@ -0,0 +1,110 @@
+/*
+ * Fuzzy matching of names, used to suggest what someone probably meant when
+ * they give something that doesn't exist, such as a mistyped repository
+ * alias or file name.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"path"
+	"strings"
+)
+
+// Returns the Levenshtein distance between two strings, ignoring case -- that
+// is, the number of characters that need to be inserted, deleted or changed
+// to turn one into the other.
+func editDistance(a, b string) int {
+	s, t := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+
+	// only the previous row of the table is needed at any time
+	prev := make([]int, len(t)+1)
+	curr := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		curr[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			// delete, insert or change a character, whichever is cheapest
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(t)]
+}
+
+// Returns the largest edit distance at which a candidate is still considered
+// a likely match for the given name. Longer names allow more mistakes.
+func maxDistance(name string) int {
+	if len(name) < 6 {
+		return 2
+	}
+	return len(name) / 3
+}
+
+// Returns the candidate closest to name, and whether it is close enough to
+// be worth suggesting. Ties go to whichever candidate comes first.
+func closestMatch(name string, candidates []string) (string, bool) {
+	best, bestDist := "", -1
+	for _, candidate := range candidates {
+		dist := editDistance(name, candidate)
+		if bestDist == -1 || dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best, bestDist != -1 && bestDist <= maxDistance(name)
+}
+
+// Returns the file path closest to name, and whether it is close enough to be
+// worth suggesting. The file names are compared first, so that mistakes in
+// the name matter more than a missing or slightly wrong directory, then any
+// directories given are compared segment by segment.
+func closestPath(files []string, name string) (string, bool) {
+	base := path.Base(name)
+	dirs := strings.Split(path.Dir(name), "/")
+	if path.Dir(name) == "." {
+		dirs = nil
+	}
+
+	best, bestBase, bestDirs := "", -1, -1
+	for _, file := range files {
+		baseDist := editDistance(base, path.Base(file))
+		if baseDist > maxDistance(base) {
+			continue
+		}
+
+		// how badly the directories given match the end of the file's
+		// directories
+		fileDirs := strings.Split(path.Dir(file), "/")
+		dirDist := 0
+		for i := range dirs {
+			j := len(fileDirs) - len(dirs) + i
+			if j < 0 || fileDirs[j] == "." {
+				dirDist += len(dirs[i])
+			} else {
+				dirDist += editDistance(dirs[i], fileDirs[j])
+			}
+		}
+
+		if bestBase == -1 || baseDist < bestBase ||
+			(baseDist == bestBase && dirDist < bestDirs) ||
+			(baseDist == bestBase && dirDist == bestDirs &&
+				len(file) < len(best)) {
+			best, bestBase, bestDirs = file, baseDist, dirDist
+		}
+	}
+	return best, bestBase != -1
+}
@@ -0,0 +1,359 @@
+/*
+ * The .git command, which links to GitHub repositories, branches, commits,
+ * files and lines. Repositories in the bot's local index (see gitindex.go)
+ * are checked before linking, so mistakes such as a missing file or a line
+ * past the end of a file are caught without needing to ask GitHub. When
+ * something can't be found, the closest match is suggested instead (see
+ * fuzzy.go).
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	GitHubBaseURL = "https://github.com/"
+
+	// the most candidates listed when a file name is ambiguous
+	maxFileCandidates = 3
+)
+
+var (
+	GitSHARegex  = regexp.MustCompile("^[a-f0-9]{7,40}$")
+	GitLineRegex = regexp.MustCompile("^#?L?([0-9]+)(?:-L?([0-9]+))?$")
+	GitRepoRegex = regexp.MustCompile("^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$")
+)
+
+// The details of a .git request.
+type gitRequest struct {
+	repo   string
+	branch string
+	commit string
+	file   string
+	// the lines to link to. end is 0 if only one line is wanted
+	start, end int
+
+	unknownKeys []string
+}
+
+// Parses the arguments to .git. args[0] should be the repository, and any
+// other arguments should be of the form key:value.
+func (bot *Bot) parseGitArgs(args []string) gitRequest {
+	req := gitRequest{}
+	repo, ok := bot.config.GitAliases[args[0]]
+	if !ok { // if it's not a known alias take the literal value
+		repo = args[0]
+	}
+	req.repo = repo
+
+	for _, arg := range args[1:] {
+		option := strings.SplitN(arg, ":", 2)
+		if len(option) == 1 || option[1] == "" {
+			continue
+		}
+
+		// if a key is present more than once the first instance is used
+		switch strings.ToLower(option[0]) {
+		case "branch", "b":
+			if req.branch == "" {
+				req.branch = option[1]
+			}
+		case "file", "f":
+			if req.file == "" {
+				req.file = strings.TrimPrefix(option[1], "/")
+			}
+		case "commit", "c":
+			if req.commit == "" && GitSHARegex.MatchString(option[1]) {
+				req.commit = option[1]
+			}
+		case "line", "l":
+			matches := GitLineRegex.FindStringSubmatch(option[1])
+			if matches == nil || req.start != 0 {
+				continue
+			}
+			req.start, _ = strconv.Atoi(matches[1])
+			if matches[2] != "" {
+				req.end, _ = strconv.Atoi(matches[2])
+			}
+		default:
+			// unknown key
+			req.unknownKeys = append(req.unknownKeys, option[0])
+		}
+	}
+
+	return req
+}
+
+// Returns the branch or commit the request refers to, or "" if neither was
+// given.
+func (req *gitRequest) ref() string {
+	// if a commit is given the branch is actually ignored
+	if req.commit != "" {
+		return req.commit
+	}
+	return req.branch
+}
+
+// Checks the request against the bot's repository index, filling in the
+// default branch, full commit SHA and full file path where they are needed.
+// Returns a message explaining what is wrong if the request can't be
+// satisfied, or "" if it can. Requests for repositories that aren't in the
+// index can't be checked, so they are assumed to be right unless they are
+// close to one that is.
+func (bot *Bot) checkGitRequest(req *gitRequest) string {
+	repos := bot.repos
+	if !repos.HasRepo(req.repo) {
+		// GitHub ignores case, so Zarel/pokemon-showdown is still a known
+		// repository
+		for _, repo := range repos.Repos() {
+			if strings.EqualFold(repo, req.repo) {
+				req.repo = repo
+				break
+			}
+		}
+	}
+	if !repos.HasRepo(req.repo) {
+		if !GitRepoRegex.MatchString(req.repo) {
+			if suggestion := bot.suggestRepo(req.repo); suggestion != "" {
+				return "Did you mean " + suggestion + "?"
+			}
+			return "Unknown repository: " + req.repo
+		}
+		// a mistyped user/repo looks like any other repository, so it is
+		// only assumed to be one that isn't indexed if it isn't close to one
+		// that is
+		if repo, ok := closestMatch(req.repo, repos.Repos()); ok {
+			return "Did you mean " + repo + "?"
+		}
+		if req.file != "" && req.ref() == "" {
+			req.branch = "master"
+		}
+		return ""
+	}
+
+	if req.commit != "" {
+		commit, err := repos.ResolveCommit(req.repo, req.commit)
+		if err == ErrAmbiguousRef {
+			return "Ambiguous commit: " + req.commit
+		} else if err != nil {
+			return "Unknown commit: " + req.commit
+		}
+		req.commit = commit
+	} else if req.branch != "" {
+		branches, err := repos.Branches(req.repo)
+		if err != nil {
+			return "Unknown branch: " + req.branch
+		}
+		if !contains(branches, req.branch) {
+			if branch, ok := closestMatch(req.branch, branches); ok {
+				return "Did you mean branch " + branch + "?"
+			}
+			return "Unknown branch: " + req.branch
+		}
+	}
+
+	if req.file == "" {
+		return ""
+	}
+	if req.ref() == "" {
+		branch, err := repos.DefaultBranch(req.repo)
+		if err != nil {
+			return "Could not find the default branch of " + req.repo
+		}
+		req.branch = branch
+	}
+
+	files, err := repos.Files(req.repo, req.ref())
+	if err != nil {
+		return "Could not list the files in " + req.repo
+	}
+	candidates := findFile(files, req.file)
+	switch {
+	case len(candidates) == 0:
+		if file, ok := closestPath(files, req.file); ok {
+			return "Did you mean " + file + "?"
+		}
+		return "Unknown file: " + req.file
+	case len(candidates) > 1:
+		if len(candidates) > maxFileCandidates {
+			candidates = append(candidates[:maxFileCandidates], "...")
+		}
+		return "Ambiguous file " + req.file + ": " +
+			strings.Join(candidates, ", ")
+	}
+	req.file = candidates[0]
+
+	if req.start == 0 {
+		return ""
+	}
+	lines, err := repos.LineCount(req.repo, req.ref(), req.file)
+	if err != nil {
+		return "Could not read " + req.file
+	}
+	if req.end != 0 && req.end < req.start {
+		req.start, req.end = req.end, req.start
+	}
+	if req.start > lines || req.end > lines {
+		return req.file + " only has " + strconv.Itoa(lines) + " lines"
+	}
+	return ""
+}
+
+// Suggests the alias or known repository closest to the given name, or
+// returns "" if none are close enough.
+func (bot *Bot) suggestRepo(name string) string {
+	aliases := make([]string, 0, len(bot.config.GitAliases))
+	for alias := range bot.config.GitAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	if alias, ok := closestMatch(name, aliases); ok {
+		return alias + " (" + bot.config.GitAliases[alias] + ")"
+	}
+
+	// people often leave out the user, so compare against the repository
+	// names as well as the full user/repo
+	repos := bot.repos.Repos()
+	if repo, ok := closestMatch(name, repos); ok {
+		return repo
+	}
+	for _, repo := range repos {
+		repoName := repo[strings.Index(repo, "/")+1:]
+		if editDistance(name, repoName) <= maxDistance(name) {
+			return repo
+		}
+	}
+	return ""
+}
+
+// Finds the files matching the given name. An exact match is preferred, but
+// otherwise any files whose paths end with the name are matched, so that
+// moves.js matches data/moves.js. If that fails too, case is ignored.
+func findFile(files []string, name string) []string {
+	if contains(files, name) {
+		return []string{name}
+	}
+
+	matches := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file, "/"+name) {
+			matches = append(matches, file)
+		}
+	}
+	if len(matches) > 0 {
+		return matches
+	}
+
+	lowerName := strings.ToLower(name)
+	for _, file := range files {
+		lowerFile := strings.ToLower(file)
+		if lowerFile == lowerName ||
+			strings.HasSuffix(lowerFile, "/"+lowerName) {
+			matches = append(matches, file)
+		}
+	}
+	return matches
+}
+
+// Returns true if list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the GitHub URL the request refers to.
+func (req *gitRequest) URL() string {
+	url := GitHubBaseURL + req.repo
+	if req.ref() == "" {
+		return url
+	}
+
+	view := "tree"
+	if req.file != "" {
+		view = "blob"
+	}
+	url += "/" + view + "/" + req.ref()
+	if req.file != "" {
+		url += "/" + req.file
+		if req.start != 0 {
+			url += "#L" + strconv.Itoa(req.start)
+			if req.end != 0 && req.end != req.start {
+				url += "-L" + strconv.Itoa(req.end)
+			}
+		}
+	}
+	return url
+}
+
+// Gets the link to a git repository matching the criteria given.
+//
+// Syntax: .git (user/repo|alias) (key:value){0,}
+// Valid keys are:
+//   - branch/b: the branch to look in. Defaults to the repository's default
+//     branch if excluded
+//   - commit/c: the SHA-1 hash of the commit. Should match the regex
+//     `[a-f0-9]{7,40}`
+//   - file/f: the file to link to. If in a directory other than the
+//     base directory, either give the full path or enough of the end of it
+//     to identify the file
+//   - line/l: the line number, in one of the forms number, #number, or
+//     #Lnumber, or a range of lines, such as 10-20 or #L10-L20
+//
+// Examples:
+// > .git server file:data/moves.js line:200
+// < https://github.com/Zarel/Pokemon-Showdown/blob/master/data/moves.js#L200
+// > .git server f:moves.js l:200-210
+// < https://github.com/Zarel/Pokemon-Showdown/blob/master/data/moves.js#L200-L210
+// > .git bot
+// < https://github.com/TalkTakesTime/gobot
+// > .git server c:53e9c8b
+// < https://github.com/Zarel/Pokemon-Showdown/tree/53e9c8b...
+// > .git client b:client-overhaul
+// < https://github.com/Zarel/Pokemon-Showdown-Client/tree/client-overhaul
+// > .git client b:client-overhaul f:README.md
+// < https://github.com/Zarel/Pokemon-Showdown-Client/blob/client-overhaul/README.md
+//
+// Notes:
+//   - if a key is present more than once the first instance will be
+//     used and all others ignored
+//   - key:value should not have spaces
+//   - most values are case sensitive
+//   - commits are given in full when the repository is in the bot's index
+func (bot *Bot) GitCommand(msg Message) {
+	if toId(msg.args[1]) == "" || toId(msg.args[1]) == "help" {
+		bot.QueueMessage(bot.config.CommandChar+
+			"git (user/repo|alias) (key:value){0,}. More detailed"+
+			" help can be found at http://git.io/hRt9", msg.room)
+		return
+	}
+
+	// options should be separated by a space
+	req := bot.parseGitArgs(strings.Fields(msg.args[1]))
+
+	var response string
+	if len(req.unknownKeys) > 0 {
+		response += "Unknown key"
+		if len(req.unknownKeys) > 1 {
+			response += "s"
+		}
+		response += ": " + strings.Join(req.unknownKeys, ", ") + ". "
+	}
+
+	if problem := bot.checkGitRequest(&req); problem != "" {
+		bot.QueueMessage(response+problem, msg.room)
+		return
+	}
+	bot.QueueMessage(response+req.URL(), msg.room)
+}
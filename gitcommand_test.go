@@ -0,0 +1,202 @@
+package gobot
+
+import (
+	"testing"
+)
+
+// A repository with a couple of branches and commits, for testing .git
+// without cloning anything.
+func testRepos() *MemoryProvider {
+	return &MemoryProvider{Repositories: map[string]*MemoryRepo{
+		"Zarel/Pokemon-Showdown": {
+			DefaultBranch: "master",
+			Branches: map[string]string{
+				"master":  "53e9c8b0a1b2c3d4e5f60718293a4b5c6d7e8f90",
+				"release": "53e9c8bffffffffffffffffffffffffffffffff0",
+			},
+			Files: map[string]map[string]int{
+				"53e9c8b0a1b2c3d4e5f60718293a4b5c6d7e8f90": {
+					"data/moves.js":   500,
+					"data/items.js":   300,
+					"README.md":       40,
+					"tools/README.md": 10,
+				},
+				"53e9c8bffffffffffffffffffffffffffffffff0": {
+					"data/moves.js": 450,
+				},
+				"aaaaaaa1111111111111111111111111111111111": {
+					"data/moves.js": 100,
+				},
+			},
+		},
+	}}
+}
+
+func newGitTestBot(t *testing.T) *Bot {
+	bot := newTestBot(t, Config{
+		GitAliases: map[string]string{"server": "Zarel/Pokemon-Showdown"},
+	})
+	bot.repos = testRepos()
+	return bot
+}
+
+func TestCheckGitRequest(t *testing.T) {
+	tests := []struct {
+		args    []string
+		problem string
+		url     string
+	}{
+		{
+			args: []string{"server"},
+			url:  "https://github.com/Zarel/Pokemon-Showdown",
+		},
+		{
+			// repositories ignore case, as on GitHub
+			args: []string{"zarel/pokemon-showdown", "b:release"},
+			url:  "https://github.com/Zarel/Pokemon-Showdown/tree/release",
+		},
+		{
+			args:    []string{"server", "b:nonexistent"},
+			problem: "Unknown branch: nonexistent",
+		},
+		{
+			args:    []string{"server", "b:relase"},
+			problem: "Did you mean branch release?",
+		},
+		{
+			args: []string{"server", "c:aaaaaaa"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/tree/" +
+				"aaaaaaa1111111111111111111111111111111111",
+		},
+		{
+			// both the master and release heads start with this
+			args:    []string{"server", "c:53e9c8b"},
+			problem: "Ambiguous commit: 53e9c8b",
+		},
+		{
+			args:    []string{"server", "c:bbbbbbb"},
+			problem: "Unknown commit: bbbbbbb",
+		},
+		{
+			args: []string{"server", "f:moves.js"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"data/moves.js",
+		},
+		{
+			args: []string{"server", "f:MOVES.JS"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"data/moves.js",
+		},
+		{
+			args:    []string{"server", "f:moevs.js"},
+			problem: "Did you mean data/moves.js?",
+		},
+		{
+			args: []string{"server", "f:README.md"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"README.md",
+		},
+		{
+			args:    []string{"server", "f:nothing-like-it.txt"},
+			problem: "Unknown file: nothing-like-it.txt",
+		},
+		{
+			args:    []string{"server", "b:release", "f:items.js"},
+			problem: "Unknown file: items.js",
+		},
+		{
+			args: []string{"server", "f:moves.js", "l:10-20"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"data/moves.js#L10-L20",
+		},
+		{
+			// ranges given backwards are turned around
+			args: []string{"server", "f:moves.js", "l:20-10"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"data/moves.js#L10-L20",
+		},
+		{
+			args: []string{"server", "f:moves.js", "l:#L500"},
+			url: "https://github.com/Zarel/Pokemon-Showdown/blob/master/" +
+				"data/moves.js#L500",
+		},
+		{
+			args:    []string{"server", "f:moves.js", "l:501"},
+			problem: "data/moves.js only has 500 lines",
+		},
+		{
+			args:    []string{"server", "f:moves.js", "l:490-510"},
+			problem: "data/moves.js only has 500 lines",
+		},
+		{
+			// the release branch's copy is shorter
+			args:    []string{"server", "b:release", "f:moves.js", "l:460"},
+			problem: "data/moves.js only has 450 lines",
+		},
+		{
+			args:    []string{"Zarel/Pokemon-Showdwn", "f:moves.js"},
+			problem: "Did you mean Zarel/Pokemon-Showdown?",
+		},
+		{
+			// repositories that aren't indexed are assumed to be right
+			args: []string{"someone/else", "f:a.txt"},
+			url:  "https://github.com/someone/else/blob/master/a.txt",
+		},
+		{
+			args:    []string{"sever"},
+			problem: "Did you mean server (Zarel/Pokemon-Showdown)?",
+		},
+	}
+
+	bot := newGitTestBot(t)
+	for _, test := range tests {
+		req := bot.parseGitArgs(test.args)
+		problem := bot.checkGitRequest(&req)
+		if problem != test.problem {
+			t.Errorf("%v: got problem %q, want %q", test.args, problem,
+				test.problem)
+			continue
+		}
+		if problem == "" && req.URL() != test.url {
+			t.Errorf("%v: got %s, want %s", test.args, req.URL(), test.url)
+		}
+	}
+}
+
+func TestGitCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{
+			args: "server f:moves.js l:10-20",
+			want: "techcode|https://github.com/Zarel/Pokemon-Showdown/blob/" +
+				"master/data/moves.js#L10-L20",
+		},
+		{
+			args: "server f:moves.js l:600",
+			want: "techcode|data/moves.js only has 500 lines",
+		},
+		{
+			args: "server b:nonexistent",
+			want: "techcode|Unknown branch: nonexistent",
+		},
+		{
+			args: "server x:1 f:moves.js",
+			want: "techcode|Unknown key: x. https://github.com/Zarel/" +
+				"Pokemon-Showdown/blob/master/data/moves.js",
+		},
+	}
+
+	bot := newGitTestBot(t)
+	for _, test := range tests {
+		bot.GitCommand(Message{
+			room: "techcode",
+			args: []string{" user", test.args, "git"},
+		})
+		sent := sentMessages(bot)
+		if len(sent) != 1 || sent[0] != test.want {
+			t.Errorf(".git %s: sent %q, want %q", test.args, sent, test.want)
+		}
+	}
+}
@@ -5,6 +5,9 @@
  * For information on the hookserve module which deals with receiving and
  * parsing the hooks, see https://github.com/TalkTakesTime/hookserve
  *
+ * The messages announcing each hook are rendered using the templates in
+ * templates.go, and every delivery is recorded in the log in deliveries.go.
+ *
  * Note that the bot will panic if the port given in config.yaml is already
  * in use, so be careful.
  *
@@ -14,146 +17,106 @@
 package gobot
 
 import (
-	"errors"
 	"fmt"
 	"github.com/TalkTakesTime/hookserve/hookserve" // credits to phayes for the original
-	"github.com/tonnerre/golang-pretty"
 	"html"
-	"io/ioutil"
 	"net/http"
-	"net/url"
-	"strings"
-	"time"
 )
 
 const (
-	GitIOBase   = "http://git.io/"
-	GitIOCreate = "http://git.io/create"
-
-	// template for push messages
-	// [repo] user pushed number new commits? to branch: URL
-	PushTemplate = "[%s] %s pushed %s new commit%s to %s: %s"
-	// template for commit messages
-	// repo/branch SHA user: commit message
-	CommitTemplate = "%s/%s %s %s: %s"
-	// template for pull request messages
-	// [repo] user action pull request #number: message (upstream...base) URL
-	PullReqTemplate = "[%s] %s %s pull request #%s: %s (%s...%s) %s"
-)
-
-var (
-	ErrShortenURL = errors.New("could not shorten the URL")
+	// the path GitHub webhooks should be sent to
+	HookPath = "/postreceive"
 )
 
-// Error encountered when a URL can't be shortened using a URL shortener
-// such as git.io or goo.gl
-type ShortURLError struct {
-	URL string // the URL trying to be shortened
-	Err error
-}
-
-func (e *ShortURLError) Error() string {
-	return e.URL + ": " + e.Err.Error()
-}
-
-// Generates the GitHub webhook receiver and starts a goroutine to deal
-// with received events
+// Adds the GitHub webhook receiver to the bot's HTTP server, along with the
+// delivery log if config.AdminToken is set
 func (bot *Bot) CreateHook() {
-	bot.hookServer = hookserve.NewServer()
-	bot.hookServer.Port = bot.config.HookPort
-	bot.hookServer.Secret = bot.config.HookSecret
-	bot.hookServer.GoListenAndServe()
-
-	go bot.ListenForHooks()
+	bot.HandleHTTP(HookPath, http.HandlerFunc(bot.ReceiveHook))
+	if bot.config.AdminToken != "" {
+		bot.HandleHTTP("/hooklog/",
+			bot.RequireToken(http.HandlerFunc(bot.ServeHookLog)))
+	}
 }
 
-// Listens for GitHub webhook events and delegates them to handlers, such as
-// `HandlePushHook`. Currently only push and pull_request events are supported
-func (bot *Bot) ListenForHooks() {
-	for {
-		select {
-		case event := <-bot.hookServer.Events:
-			pretty.Log(event)
-			switch event.Type {
-			case "push":
-				bot.HandlePushHook(event)
-			case "pull_request":
-				bot.HandlePullHook(event)
-			default:
-				// do nothing for now
-			}
-		default:
-			time.Sleep(100 * time.Millisecond)
-		}
+// Delegates GitHub webhook events to handlers, such as `HandlePushHook`,
+// returning the messages they sent. Currently only push and pull_request
+// events are supported
+func (bot *Bot) HandleHook(event hookserve.Event,
+	rooms []string) []HookMessage {
+	bot.Logger(LogHooks).Info("webhook", "type", event.Type, "repo",
+		event.Repo, "action", event.Action, "by", event.By)
+	bot.Logger(LogHooks).Debug("webhook event", "event", fmt.Sprintf("%+v",
+		event))
+	switch event.Type {
+	case "push":
+		return bot.HandlePushHook(event, rooms)
+	case "pull_request":
+		return bot.HandlePullHook(event, rooms)
+	default:
+		// do nothing for now
+		return nil
 	}
 }
 
 // Sends messages to all relevant rooms updating them when a push event
 // is received. Tells how many commits were pushed, and gives a description
 // of each individual commit, as given in the commit message
-func (bot *Bot) HandlePushHook(event hookserve.Event) {
+func (bot *Bot) HandlePushHook(event hookserve.Event,
+	rooms []string) []HookMessage {
 	// we don't care about 0 commit pushes
 	if event.Size == 0 {
-		return
+		return nil
 	}
 
-	// attempt to shorten the URL using git.io
-	shortURL, err := ShortenURL(event.URL)
-	if err != nil {
-		shortURL = event.URL
-	}
-
-	plural := ""
-	if event.Size > 1 {
-		plural = "s"
-	}
-
-	msg := fmt.Sprintf(PushTemplate, FormatRepo(event.Repo),
-		FormatName(event.By), FormatSize(event.Size), plural,
-		FormatBranch(event.Branch), FormatURL(shortURL))
-	// send to all githook rooms
-	// for _, r := range bot.config.HookRooms {
-	// 	bot.QueueMessage(msg, r)
-	// }
-
-	// add messages for individual commits too
-	for i := 0; i < event.Size; i++ {
-		msgParts := strings.Split(event.Commits[i].Message, "\n")
-
-		msg += "<br />" + fmt.Sprintf(CommitTemplate, FormatRepo(event.Repo),
-			FormatBranch(event.Branch), FormatSHA(event.Commits[i].SHA[:7]),
-			FormatName(event.Commits[i].By), msgParts[0])
-	}
-
-	msg = "!htmlbox " + msg
-	for _, r := range bot.config.HookRooms {
-		bot.QueueMessage(msg, r)
-	}
+	data := HookData{Event: event, ShortURL: bot.ShortenURL(event.URL)}
+	return bot.Announce(data, rooms, (*HookTemplates).RenderPush)
 }
 
 // Sends messages to all relevant rooms updating them when a pull_request
 // event is received. Still in beta
-func (bot *Bot) HandlePullHook(event hookserve.Event) {
-	// attempt to shorten the URL using git.io
-	shortURL, err := ShortenURL(event.URL)
-	if err != nil {
-		shortURL = event.URL
-	}
-
-	msgParts := strings.Split(event.Message, "\n")
-
+func (bot *Bot) HandlePullHook(event hookserve.Event,
+	rooms []string) []HookMessage {
 	if event.Action == "synchronize" {
 		event.Action = "synchronized"
 	}
 
-	msg := fmt.Sprintf(PullReqTemplate, FormatRepo(event.BaseRepo),
-		FormatName(event.By), event.Action, event.Number, msgParts[0],
-		FormatBranch(event.BaseBranch), FormatBranch(event.Branch),
-		FormatURL(shortURL))
+	data := HookData{Event: event, ShortURL: bot.ShortenURL(event.URL)}
+	return bot.Announce(data, rooms, (*HookTemplates).RenderPullRequest)
+}
 
-	for _, r := range bot.config.HookRooms {
-		bot.QueueMessage("!htmlbox "+msg, r)
+// Announces a webhook event in the given rooms, using render to render each
+// room's templates, and returns the messages sent. HTML is only used in rooms
+// where the bot has a high enough rank to use !htmlbox; elsewhere the text
+// templates are used.
+func (bot *Bot) Announce(data HookData, rooms []string,
+	render func(*HookTemplates, HookData, bool) ([]string,
+		error)) []HookMessage {
+	sent := []HookMessage{}
+	for _, r := range rooms {
+		data.Room = r
+		templates := bot.TemplatesFor(r)
+		html := templates.HTML() && bot.CanUseHTML(r)
+
+		msgs, err := render(templates, data, html)
+		if err != nil {
+			bot.Logger(LogHooks).Error("could not announce webhook", "type",
+				data.Type, "room", r, "error", err)
+			continue
+		}
+
+		if html {
+			// in case the server refuses the !htmlbox after all
+			fallback, err := render(templates, data, false)
+			if err == nil {
+				bot.setHTMLFallback(r, fallback)
+			}
+		}
+		for _, msg := range msgs {
+			bot.QueueMessage(msg, r)
+			sent = append(sent, HookMessage{r, msg})
+		}
 	}
+	return sent
 }
 
 // FormatRepo formats a repo name for !htmlbox using #FF00FF.
@@ -182,27 +145,13 @@ func FormatSHA(sha string) string {
 	return fmt.Sprintf("<font color=\"#7F7F7F\">%s</font>", html.EscapeString(sha))
 }
 
+// FormatColour formats any text for !htmlbox using the given colour.
+func FormatColour(colour, text string) string {
+	return fmt.Sprintf("<font color=\"%s\">%s</font>", html.EscapeString(colour),
+		html.EscapeString(text))
+}
+
 // FormatSize formats an event size for !htmlbox using <strong>.
 func FormatSize(size int) string {
 	return fmt.Sprintf("<strong>%d</strong>", size)
 }
-
-// Utility to shorten a URL using http://git.io/
-// Returns an empty string and ErrShortenURL if something goes wrong,
-// otherwise returns the shortened URL and nil
-func ShortenURL(longURL string) (string, error) {
-	response, err := http.PostForm(GitIOCreate, url.Values{
-		"url": []string{longURL},
-	})
-	if err != nil {
-		return "", &ShortURLError{longURL, ErrShortenURL}
-	}
-
-	extension, err := ioutil.ReadAll(response.Body)
-	response.Body.Close()
-	if err != nil {
-		return "", &ShortURLError{longURL, ErrShortenURL}
-	}
-
-	return GitIOBase + string(extension), nil
-}
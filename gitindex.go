@@ -0,0 +1,535 @@
+/*
+ * A local index of git repositories, used by .git to check that branches,
+ * commits, files and lines exist without asking GitHub every time.
+ *
+ * Repositories are looked up through a RepoProvider. The bot uses a
+ * CloneProvider, which keeps bare clones of the configured repositories (the
+ * values of config.GitAliases and config.GitRepos) in config.GitRepoDir, if
+ * config.IndexRepos is set. Otherwise it uses an empty MemoryProvider, and
+ * .git links to repositories without checking anything. A MemoryProvider can
+ * also be filled in by hand, which is useful for testing.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the remote repositories are cloned from if config.GitRemote isn't given
+	DefaultGitRemote = "https://github.com/"
+	// how often, in minutes, clones are updated if config.GitRefresh isn't
+	// given
+	DefaultGitRefresh = 60
+
+	// the longest a single git command may take. Cloning is allowed longer
+	gitTimeout   = 30 * time.Second
+	cloneTimeout = 10 * time.Minute
+)
+
+var (
+	ErrUnknownRepo   = errors.New("unknown repository")
+	ErrUnknownRef    = errors.New("unknown branch or commit")
+	ErrUnknownFile   = errors.New("unknown file")
+	ErrAmbiguousRef  = errors.New("ambiguous commit")
+	ErrNotIndexedYet = errors.New("repository not indexed yet")
+)
+
+// A RepoProvider knows about the contents of some git repositories, which
+// are named in the form user/repo.
+type RepoProvider interface {
+	// Returns the repositories the provider knows about
+	Repos() []string
+	// Returns true if the provider knows about the given repository
+	HasRepo(repo string) bool
+	// Returns the repository's default branch, usually master
+	DefaultBranch(repo string) (string, error)
+	// Returns the names of the repository's branches
+	Branches(repo string) ([]string, error)
+	// Resolves a commit SHA, which may be abbreviated, to its full form.
+	// Returns ErrAmbiguousRef if more than one commit matches
+	ResolveCommit(repo, sha string) (string, error)
+	// Returns the paths of every file in the repository at the given branch
+	// or commit
+	Files(repo, ref string) ([]string, error)
+	// Returns the number of lines in a file at the given branch or commit
+	LineCount(repo, ref, path string) (int, error)
+}
+
+// A repository known to a MemoryProvider.
+type MemoryRepo struct {
+	DefaultBranch string
+	// the branches, mapping their names to the SHA of their head commit
+	Branches map[string]string
+	// the files at each commit, mapping their paths to their line counts
+	Files map[string]map[string]int
+}
+
+// A MemoryProvider is a RepoProvider whose repositories are all given up
+// front. It is safe to read from several goroutines, but the Repositories map
+// shouldn't be changed once it is in use.
+type MemoryProvider struct {
+	Repositories map[string]*MemoryRepo
+}
+
+func (p *MemoryProvider) Repos() []string {
+	repos := make([]string, 0, len(p.Repositories))
+	for repo := range p.Repositories {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func (p *MemoryProvider) HasRepo(repo string) bool {
+	_, ok := p.Repositories[repo]
+	return ok
+}
+
+func (p *MemoryProvider) repo(repo string) (*MemoryRepo, error) {
+	r, ok := p.Repositories[repo]
+	if !ok {
+		return nil, ErrUnknownRepo
+	}
+	return r, nil
+}
+
+func (p *MemoryProvider) DefaultBranch(repo string) (string, error) {
+	r, err := p.repo(repo)
+	if err != nil {
+		return "", err
+	}
+	return r.DefaultBranch, nil
+}
+
+func (p *MemoryProvider) Branches(repo string) ([]string, error) {
+	r, err := p.repo(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := make([]string, 0, len(r.Branches))
+	for branch := range r.Branches {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+func (p *MemoryProvider) ResolveCommit(repo, sha string) (string, error) {
+	r, err := p.repo(repo)
+	if err != nil {
+		return "", err
+	}
+
+	match := ""
+	for commit := range r.Files {
+		if strings.HasPrefix(commit, sha) {
+			if match != "" {
+				return "", ErrAmbiguousRef
+			}
+			match = commit
+		}
+	}
+	if match == "" {
+		return "", ErrUnknownRef
+	}
+	return match, nil
+}
+
+// Finds the files at a branch or commit.
+func (p *MemoryProvider) files(repo, ref string) (map[string]int, error) {
+	r, err := p.repo(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if head, ok := r.Branches[ref]; ok {
+		ref = head
+	} else if ref, err = p.ResolveCommit(repo, ref); err != nil {
+		return nil, err
+	}
+	return r.Files[ref], nil
+}
+
+func (p *MemoryProvider) Files(repo, ref string) ([]string, error) {
+	files, err := p.files(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (p *MemoryProvider) LineCount(repo, ref, path string) (int, error) {
+	files, err := p.files(repo, ref)
+	if err != nil {
+		return 0, err
+	}
+
+	lines, ok := files[path]
+	if !ok {
+		return 0, ErrUnknownFile
+	}
+	return lines, nil
+}
+
+// A CloneProvider keeps bare clones of a set of repositories and answers
+// questions about them using git, which must be installed. Repositories
+// aren't known about until they have been cloned.
+type CloneProvider struct {
+	dir     string
+	remote  string
+	refresh time.Duration
+	log     *slog.Logger
+
+	// held while syncing, so that a repository isn't cloned twice at once
+	syncMu sync.Mutex
+
+	mu     sync.RWMutex
+	repos  []string
+	cloned map[string]bool
+	// file lists, keyed by repo and then by commit SHA. Since a commit's
+	// files never change these never need to be thrown away, but the cache
+	// is reset whenever the clones are updated to stop it growing forever
+	files map[string]map[string][]string
+}
+
+// Creates a CloneProvider that keeps clones of the given repositories in dir,
+// cloning them from remote and updating them every refresh. Nothing is cloned
+// until Start is called. Repositories that can't be updated are reported to
+// logger.
+func NewCloneProvider(dir, remote string, repos []string,
+	refresh time.Duration, logger *slog.Logger) *CloneProvider {
+	if !strings.HasSuffix(remote, "/") {
+		remote += "/"
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &CloneProvider{
+		dir:     dir,
+		remote:  remote,
+		repos:   repos,
+		refresh: refresh,
+		log:     logger,
+		cloned:  make(map[string]bool),
+		files:   make(map[string]map[string][]string),
+	}
+}
+
+// Clones or updates every repository, then keeps updating them every so
+// often. Use as a goroutine.
+func (p *CloneProvider) Start() {
+	for {
+		p.Sync()
+		time.Sleep(p.refresh)
+	}
+}
+
+// Changes the repositories to keep clones of. New ones are cloned by the next
+// Sync, and those no longer given are forgotten straight away, though their
+// clones are left on disk.
+func (p *CloneProvider) SetRepos(repos []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.repos = repos
+	for repo := range p.cloned {
+		if !contains(repos, repo) {
+			delete(p.cloned, repo)
+			delete(p.files, repo)
+		}
+	}
+}
+
+// Clones any repositories that haven't been cloned yet, and fetches the
+// latest changes to the rest.
+func (p *CloneProvider) Sync() {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+
+	p.mu.RLock()
+	repos := p.repos
+	p.mu.RUnlock()
+	for _, repo := range repos {
+		path := p.path(repo)
+
+		var err error
+		if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+			err = p.clone(repo)
+		} else {
+			_, err = p.git(repo, gitTimeout, "fetch", "--quiet", "--prune",
+				"origin", "+refs/heads/*:refs/heads/*")
+		}
+		if err != nil {
+			p.log.Warn("could not update repository", "repo", repo,
+				"error", err)
+		}
+
+		p.mu.Lock()
+		// a failed fetch still leaves a usable clone behind, but the
+		// repository may have been dropped while it was being fetched
+		if _, statErr := os.Stat(path); statErr == nil &&
+			contains(p.repos, repo) {
+			p.cloned[repo] = true
+		}
+		delete(p.files, repo)
+		p.mu.Unlock()
+	}
+}
+
+// Makes a bare clone of the given repository.
+func (p *CloneProvider) clone(repo string) error {
+	path := p.path(repo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloneTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "clone", "--bare", "--quiet",
+		p.remote+repo+".git", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(path)
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Returns the directory the given repository is cloned into.
+func (p *CloneProvider) path(repo string) string {
+	return filepath.Join(p.dir, filepath.FromSlash(repo)+".git")
+}
+
+// Runs a git command in the clone of the given repository, returning its
+// output.
+func (p *CloneProvider) git(repo string, timeout time.Duration,
+	args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = p.path(repo)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// Returns the lines output by a git command, without any blank ones.
+func (p *CloneProvider) gitLines(repo string, args ...string) ([]string,
+	error) {
+	out, err := p.git(repo, gitTimeout, args...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (p *CloneProvider) Repos() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	repos := make([]string, 0, len(p.cloned))
+	for repo := range p.cloned {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func (p *CloneProvider) HasRepo(repo string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cloned[repo]
+}
+
+// Returns ErrNotIndexedYet if the repository hasn't been cloned yet.
+func (p *CloneProvider) check(repo string) error {
+	if !p.HasRepo(repo) {
+		return ErrNotIndexedYet
+	}
+	return nil
+}
+
+func (p *CloneProvider) DefaultBranch(repo string) (string, error) {
+	if err := p.check(repo); err != nil {
+		return "", err
+	}
+
+	out, err := p.git(repo, gitTimeout, "symbolic-ref", "--short", "HEAD")
+	return strings.TrimSpace(string(out)), err
+}
+
+func (p *CloneProvider) Branches(repo string) ([]string, error) {
+	if err := p.check(repo); err != nil {
+		return nil, err
+	}
+	return p.gitLines(repo, "for-each-ref", "--format=%(refname:short)",
+		"refs/heads")
+}
+
+func (p *CloneProvider) ResolveCommit(repo, sha string) (string, error) {
+	if err := p.check(repo); err != nil {
+		return "", err
+	}
+
+	// rev-parse doesn't say which commits an abbreviation could mean, so
+	// ask for the candidates instead
+	matches, err := p.gitLines(repo, "rev-parse", "--disambiguate="+sha)
+	if err != nil || len(matches) == 0 {
+		return "", ErrUnknownRef
+	}
+
+	commits := []string{}
+	for _, match := range matches {
+		kind, err := p.git(repo, gitTimeout, "cat-file", "-t", match)
+		if err == nil && strings.TrimSpace(string(kind)) == "commit" {
+			commits = append(commits, match)
+		}
+	}
+	switch len(commits) {
+	case 0:
+		return "", ErrUnknownRef
+	case 1:
+		return commits[0], nil
+	default:
+		return "", ErrAmbiguousRef
+	}
+}
+
+// Resolves a branch or commit to the full SHA of a commit.
+func (p *CloneProvider) resolve(repo, ref string) (string, error) {
+	out, err := p.git(repo, gitTimeout, "rev-parse", "--verify", "--quiet",
+		ref+"^{commit}")
+	if err != nil {
+		return "", ErrUnknownRef
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (p *CloneProvider) Files(repo, ref string) ([]string, error) {
+	if err := p.check(repo); err != nil {
+		return nil, err
+	}
+	sha, err := p.resolve(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	files, ok := p.files[repo][sha]
+	p.mu.RUnlock()
+	if ok {
+		return files, nil
+	}
+
+	out, err := p.git(repo, gitTimeout, "ls-tree", "-r", "--name-only", "-z",
+		sha)
+	if err != nil {
+		return nil, err
+	}
+	files = strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+
+	p.mu.Lock()
+	if p.files[repo] == nil {
+		p.files[repo] = make(map[string][]string)
+	}
+	p.files[repo][sha] = files
+	p.mu.Unlock()
+
+	return files, nil
+}
+
+func (p *CloneProvider) LineCount(repo, ref, path string) (int, error) {
+	if err := p.check(repo); err != nil {
+		return 0, err
+	}
+
+	contents, err := p.git(repo, gitTimeout, "cat-file", "blob",
+		ref+":"+path)
+	if err != nil {
+		return 0, ErrUnknownFile
+	}
+
+	lines := bytes.Count(contents, []byte("\n"))
+	if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
+// Creates the RepoProvider described by the bot's config.
+func (bot *Bot) CreateRepoProvider() RepoProvider {
+	if !bot.config.IndexRepos {
+		return &MemoryProvider{}
+	}
+
+	dir := bot.config.GitRepoDir
+	if dir == "" {
+		dir = filepath.Join(bot.store.dir, "repos")
+	}
+	remote := bot.config.GitRemote
+	if remote == "" {
+		remote = DefaultGitRemote
+	}
+	refresh := bot.config.GitRefresh
+	if refresh <= 0 {
+		refresh = DefaultGitRefresh
+	}
+
+	return NewCloneProvider(dir, remote, bot.indexedRepos(),
+		time.Duration(refresh)*time.Minute, bot.Logger(LogGit))
+}
+
+// Updates the repositories in the bot's index after its aliases or
+// config.GitRepos have changed, cloning any new ones in the background.
+func (bot *Bot) ReindexRepos() {
+	if clones, ok := bot.repos.(*CloneProvider); ok {
+		clones.SetRepos(bot.indexedRepos())
+		go clones.Sync()
+	}
+}
+
+// Returns the repositories the bot should index: every repository that has
+// an alias, as well as any others given in config.GitRepos.
+func (bot *Bot) indexedRepos() []string {
+	seen := make(map[string]bool)
+	repos := []string{}
+	for _, repo := range bot.config.GitAliases {
+		if !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	for _, repo := range bot.config.GitRepos {
+		if !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
@@ -0,0 +1,200 @@
+/*
+ * Health checks for running the bot under something like Kubernetes, served
+ * by the bot's HTTP server when config.EnableHealth is set:
+ *   GET /healthz  whether the bot is connected to PS! and has heard from it
+ *                 recently, for liveness probes
+ *   GET /readyz   whether the bot is also logged in and has joined its
+ *                 rooms, for readiness probes
+ *
+ * Both reply 200 if the check passes and 503 if it doesn't, along with the
+ * state of the connection as JSON. Since anyone can use them, hidden rooms
+ * (see Bot.HiddenRoom) aren't listed, though they still count towards
+ * whether the bot is ready.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthPath = "/healthz"
+	ReadyPath  = "/readyz"
+
+	// how long the bot can go without hearing from the server if
+	// config.HealthTimeout isn't given, in seconds. Pings are sent every
+	// minute, so this allows a few to go missing
+	DefaultHealthTimeout = 180
+)
+
+// The state of the bot's connection to PS!. It is updated by several
+// goroutines, so is guarded by Bot.connMu.
+type connState struct {
+	// whether the websocket is open
+	connected   bool
+	connectedAt time.Time
+	// when the last message and pong were received from the server
+	lastMessage time.Time
+	lastPong    time.Time
+	// whether the bot has logged in, and the name it has
+	loggedIn bool
+	name     string
+}
+
+// The state of the bot as reported by /healthz and /readyz.
+type HealthReport struct {
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+
+	// times are nil until they have happened
+	Connected   bool       `json:"connected"`
+	ConnectedAt *time.Time `json:"connectedAt"`
+	LastMessage *time.Time `json:"lastMessage"`
+	// seconds since the last message was received
+	SinceLastMessage float64    `json:"sinceLastMessage"`
+	LastPong         *time.Time `json:"lastPong"`
+	LoggedIn         bool       `json:"loggedIn"`
+	Name             string     `json:"name,omitempty"`
+	// the rooms the bot is in, and those it is still trying to join, apart
+	// from hidden ones
+	Rooms   []string `json:"rooms"`
+	Joining []string `json:"joining"`
+}
+
+// Records that the websocket has been opened or closed.
+func (bot *Bot) setConnected(connected bool) {
+	bot.connMu.Lock()
+	defer bot.connMu.Unlock()
+	bot.conn.connected = connected
+	if connected {
+		bot.conn.connectedAt = time.Now()
+		bot.conn.lastMessage = time.Now()
+	}
+	bot.conn.loggedIn = false
+	bot.conn.name = ""
+}
+
+// Records that a message has been received from the server.
+func (bot *Bot) messageReceived() {
+	bot.connMu.Lock()
+	bot.conn.lastMessage = time.Now()
+	bot.connMu.Unlock()
+}
+
+// Records that a pong has been received from the server.
+func (bot *Bot) pongReceived() {
+	bot.connMu.Lock()
+	bot.conn.lastPong = time.Now()
+	bot.connMu.Unlock()
+}
+
+// Records the bot's name and whether it is logged in, from an |updateuser|
+// message.
+func (bot *Bot) setLoggedIn(loggedIn bool, name string) {
+	bot.connMu.Lock()
+	bot.conn.loggedIn = loggedIn
+	bot.conn.name = name
+	bot.connMu.Unlock()
+}
+
+// Checks the bot's health. If ready is set, the bot must also be logged in
+// and in all of its rooms to pass.
+func (bot *Bot) Health(ready bool) HealthReport {
+	bot.connMu.Lock()
+	conn := bot.conn
+	bot.connMu.Unlock()
+	report := HealthReport{
+		Connected:   conn.connected,
+		ConnectedAt: timeOrNil(conn.connectedAt),
+		LastMessage: timeOrNil(conn.lastMessage),
+		LastPong:    timeOrNil(conn.lastPong),
+		LoggedIn:    conn.loggedIn,
+		Name:        conn.name,
+		Rooms:       []string{},
+		Joining:     []string{},
+	}
+
+	joining := 0
+	for _, room := range bot.RoomList() {
+		_, joined := bot.Room(room)
+		if !joined {
+			joining++
+		}
+		if bot.HiddenRoom(room) {
+			continue
+		}
+		if joined {
+			report.Rooms = append(report.Rooms, room)
+		} else {
+			report.Joining = append(report.Joining, room)
+		}
+	}
+
+	timeout := time.Duration(bot.Config().HealthTimeout) * time.Second
+	if timeout == 0 {
+		timeout = DefaultHealthTimeout * time.Second
+	}
+	// a pong counts as hearing from the server, even if nothing is said
+	lastHeard := conn.lastMessage
+	if conn.lastPong.After(lastHeard) {
+		lastHeard = conn.lastPong
+	}
+	if !conn.lastMessage.IsZero() {
+		report.SinceLastMessage = time.Since(conn.lastMessage).Seconds()
+	}
+
+	if !report.Connected {
+		report.Problems = append(report.Problems, "not connected")
+	} else if time.Since(lastHeard) > timeout {
+		report.Problems = append(report.Problems, "nothing received from "+
+			"the server since "+lastHeard.Format(time.RFC3339))
+	}
+	if ready {
+		if !report.LoggedIn {
+			report.Problems = append(report.Problems, "not logged in")
+		}
+		if joining > 0 {
+			report.Problems = append(report.Problems, "still joining rooms")
+		}
+	}
+	report.OK = len(report.Problems) == 0
+	return report
+}
+
+// Serves the bot's health, for liveness probes.
+func (bot *Bot) ServeHealth(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, bot.Health(false))
+}
+
+// Serves whether the bot is ready, for readiness probes.
+func (bot *Bot) ServeReady(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, bot.Health(true))
+}
+
+// Returns a pointer to t, or nil if t is the zero time.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Adds /healthz and /readyz to the bot's HTTP server.
+func (bot *Bot) CreateHealthChecks() {
+	bot.HandleHTTP(HealthPath, http.HandlerFunc(bot.ServeHealth))
+	bot.HandleHTTP(ReadyPath, http.HandlerFunc(bot.ServeReady))
+}
@@ -0,0 +1,117 @@
+/*
+ * The bot's HTTP server. GitHub webhooks, short links and anything else the
+ * bot serves over HTTP share a single server listening on `config.HookPort`.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long requests being handled by an old server are given to finish
+	// when the port changes
+	httpShutdownTimeout = 5 * time.Second
+)
+
+// Adds a handler for the given pattern to the bot's HTTP server. Handlers
+// should be added before the server is started by `Bot.StartHTTP`.
+func (bot *Bot) HandleHTTP(pattern string, handler http.Handler) {
+	bot.httpMux.Handle(pattern, handler)
+}
+
+// Wraps a handler so that it can only be used with config.AdminToken, given
+// either as a bearer token in the Authorization header or as ?token=.
+func (bot *Bot) RequireToken(handler http.Handler) http.Handler {
+	return requireToken(func() string {
+		return bot.Config().AdminToken
+	}, handler)
+}
+
+// Returns the URL the bot's HTTP handlers can be reached at, without a
+// trailing slash, or "" if config.PublicURL isn't set. When a Manager serves
+// them, they are under the bot's name, which is added to config.PublicURL.
+func (bot *Bot) PublicURL() string {
+	conf := bot.Config()
+	if conf.PublicURL == "" {
+		return ""
+	}
+	url := strings.TrimSuffix(conf.PublicURL, "/")
+	if bot.sharedHTTP {
+		url += "/" + conf.Name
+	}
+	return url
+}
+
+// Wraps a handler so that it can only be used with the token returned by
+// expected, which is looked up for each request so that it can change when
+// the config is reloaded. Nothing is allowed if the token is blank.
+func requireToken(expected func() string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"),
+			"Bearer ")
+		if token == "" {
+			token = req.URL.Query().Get("token")
+		}
+
+		want := expected()
+		if want == "" || subtle.ConstantTimeCompare([]byte(token),
+			[]byte(want)) != 1 {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Starts the bot's HTTP server in a new goroutine. Returns an error if the
+// port is already in use.
+func (bot *Bot) StartHTTP() error {
+	return bot.listenHTTP(bot.config.HookPort)
+}
+
+// Starts serving the bot's HTTP handlers on the given port in a new
+// goroutine, replacing the server that is already running if there is one.
+// The old server is only shut down once the new one is listening, so nothing
+// changes if the port can't be used. Should only be used from the main loop.
+func (bot *Bot) listenHTTP(port int) error {
+	addr := ":" + strconv.Itoa(port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	bot.Logger(LogHTTP).Info("listening", "addr", addr)
+
+	old := bot.httpServer
+	bot.httpServer = &http.Server{Addr: addr, Handler: bot.httpMux}
+	go func(server *http.Server) {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			bot.Stop(fmt.Errorf("HTTP server stopped: %s", err))
+		}
+	}(bot.httpServer)
+
+	if old != nil {
+		// let requests that are already being handled finish
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				httpShutdownTimeout)
+			defer cancel()
+			if err := old.Shutdown(ctx); err != nil {
+				bot.Logger(LogHTTP).Warn("could not shut down old server",
+					"addr", old.Addr, "error", err)
+			}
+		}()
+	}
+	return nil
+}
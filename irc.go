@@ -0,0 +1,619 @@
+/*
+ * A bridge between PS! rooms and IRC channels. When config.EnableIRC is set,
+ * the bot connects to config.IRCServer as well as PS!, joins the channels in
+ * config.IRCChannels, and relays what is said in each channel to its room
+ * and what is said in each room to its channel, as
+ *   <Name> message
+ * Names are shown as they are on the other side unless config.IRCNicks maps
+ * them, e.g. so that ttt on IRC is shown as TalkTakesTime on PS! and the
+ * other way around.
+ *
+ * The bot's own messages in bridged rooms, such as webhook announcements,
+ * are relayed as well, with !htmlbox HTML converted to IRC formatting as
+ * closely as IRC allows. FormatRepo etc. (see githook.go) use the standard
+ * IRC colours, so announcements keep their colours. Anything the bridge
+ * itself says in a room is not relayed back, so messages don't loop.
+ *
+ * Lines are sent to IRC from a queue, a few at once and then one every two
+ * seconds, so that the bridge isn't disconnected for flooding and a slow
+ * server never holds up the bot. If the queue fills up, further lines are
+ * dropped until it has room again.
+ *
+ * If the connection to IRC is lost, the bridge reconnects after a while.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// how long to wait before reconnecting after losing the connection
+	ircReconnect = 30 * time.Second
+	// how long the server can go without sending anything before the
+	// connection is assumed to be dead. Servers ping every few minutes
+	ircTimeout = 5 * time.Minute
+	// the longest message relayed to IRC, in bytes. IRC allows 512 bytes
+	// per line, including the command and channel
+	ircMaxMessage = 400
+	// the longest message relayed to PS!, in characters
+	psMaxMessage = 300
+	// how many of the messages the bridge has said in each room are
+	// remembered, so that they aren't relayed back to IRC
+	ircSaidSize = 20
+	// how many lines can be waiting to be sent to IRC
+	ircQueueSize = 50
+	// how many lines can be sent to IRC at once, and how often another can
+	// be sent after that
+	ircBurst        = 5
+	ircSendInterval = 2 * time.Second
+	// how long a line can take to send before the connection is assumed to
+	// be dead
+	ircWriteTimeout = 30 * time.Second
+
+	// IRC formatting codes
+	ircBold      = "\x02"
+	ircColour    = "\x03"
+	ircItalic    = "\x1D"
+	ircUnderline = "\x1F"
+	ircStrike    = "\x1E"
+)
+
+var (
+	// the standard IRC colours, in order
+	ircColours = []struct{ r, g, b int }{
+		{0xFF, 0xFF, 0xFF}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x7F},
+		{0x00, 0x93, 0x00}, {0xFF, 0x00, 0x00}, {0x7F, 0x00, 0x00},
+		{0x9C, 0x00, 0x9C}, {0xFC, 0x7F, 0x00}, {0xFF, 0xFF, 0x00},
+		{0x00, 0xFC, 0x00}, {0x00, 0x93, 0x93}, {0x00, 0xFF, 0xFF},
+		{0x00, 0x00, 0xFC}, {0xFF, 0x00, 0xFF}, {0x7F, 0x7F, 0x7F},
+		{0xD2, 0xD2, 0xD2},
+	}
+
+	ircFormattingRegex = regexp.MustCompile(
+		"\x03([0-9]{1,2}(,[0-9]{1,2})?)?|[\x02\x0F\x11\x16\x1D\x1E\x1F]")
+	htmlTagRegex  = regexp.MustCompile(`<(/?)([a-zA-Z0-9]+)([^>]*)>`)
+	htmlAttrRegex = regexp.MustCompile(
+		`([a-zA-Z-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	hexColourRegex = regexp.MustCompile(`^#?([0-9a-fA-F]{6}|[0-9a-fA-F]{3})$`)
+	spaceRegex     = regexp.MustCompile(`\s+`)
+	// PS!'s chat formatting: **bold**, __italics__ and ~~strikethrough~~
+	psFormattingRegex = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__|~~(.+?)~~`)
+)
+
+// A bridge between PS! rooms and IRC channels.
+type IRCBridge struct {
+	server   string
+	useTLS   bool
+	pass     string
+	nick     string
+	psNick   string
+	channels map[string]string // room -> channel
+	rooms    map[string]string // channel, in lower case -> room
+	nicks    map[string]string // IRC nick, in lower case -> PS! name
+	names    map[string]string // PS! id -> IRC nick
+	say      func(text, room string)
+	log      *slog.Logger
+
+	// the send rate and write timeout, which are the ircBurst etc.
+	// constants except in tests
+	burst        int
+	sendInterval time.Duration
+	writeTimeout time.Duration
+
+	mu sync.Mutex
+	// the lines waiting to be sent, or nil when not connected
+	queue chan string
+	// the nick actually in use, which may have had _ added if the
+	// configured one was taken
+	currentNick string
+	// what the bridge has said recently in each room
+	said map[string][]string
+}
+
+// A line received from IRC.
+type ircMessage struct {
+	// the nick, or server name, it came from
+	from    string
+	command string
+	params  []string
+}
+
+// Creates a bridge using the IRC settings in conf. say is used to say
+// things in PS! rooms, and is usually Bot.QueueMessage.
+func NewIRCBridge(conf Config, say func(text, room string),
+	logger *slog.Logger) *IRCBridge {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	b := &IRCBridge{
+		server:   conf.IRCServer,
+		useTLS:   conf.IRCTLS,
+		pass:     conf.IRCPass,
+		nick:     conf.IRCNick,
+		psNick:   conf.Nick,
+		channels: make(map[string]string),
+		rooms:    make(map[string]string),
+		nicks:    make(map[string]string),
+		names:    make(map[string]string),
+		say:      say,
+		log:      logger,
+		said:     make(map[string][]string),
+
+		burst:        ircBurst,
+		sendInterval: ircSendInterval,
+		writeTimeout: ircWriteTimeout,
+	}
+	if b.nick == "" {
+		b.nick = strings.Replace(conf.Nick, " ", "", -1)
+	}
+	for room, channel := range conf.IRCChannels {
+		b.channels[room] = channel
+		b.rooms[strings.ToLower(channel)] = room
+	}
+	for nick, name := range conf.IRCNicks {
+		b.nicks[strings.ToLower(nick)] = name
+		b.names[toId(name)] = nick
+	}
+	return b
+}
+
+// Creates the bot's IRC bridge, or returns nil if it is disabled.
+func (bot *Bot) CreateIRCBridge() *IRCBridge {
+	if !bot.config.EnableIRC {
+		return nil
+	}
+	return NewIRCBridge(bot.config, bot.QueueMessage, bot.Logger(LogIRC))
+}
+
+// Connects to IRC and relays messages until the connection is lost, then
+// reconnects. Never returns.
+func (b *IRCBridge) Run() {
+	for {
+		err := b.serve()
+		b.log.Warn("lost connection to IRC", "server", b.server,
+			"error", err, "retry", ircReconnect)
+		time.Sleep(ircReconnect)
+	}
+}
+
+// Connects to IRC and handles what it sends until the connection is lost.
+func (b *IRCBridge) serve() error {
+	var conn net.Conn
+	var err error
+	if b.useTLS {
+		conn, err = tls.Dial("tcp", b.server, nil)
+	} else {
+		conn, err = net.DialTimeout("tcp", b.server, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	return b.serveConn(conn)
+}
+
+// Registers with IRC over conn and handles what it sends until the
+// connection is lost. Closes conn before returning.
+func (b *IRCBridge) serveConn(conn net.Conn) error {
+	defer conn.Close()
+
+	queue := make(chan string, ircQueueSize)
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.write(conn, queue, stop)
+
+	b.mu.Lock()
+	b.queue = queue
+	b.currentNick = b.nick
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.queue = nil
+		b.mu.Unlock()
+	}()
+
+	b.log.Info("connecting to IRC", "server", b.server, "nick", b.nick)
+	if b.pass != "" {
+		b.send("PASS " + b.pass)
+	}
+	b.send("NICK " + b.nick)
+	b.send("USER " + b.nick + " 0 * :gobot")
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		b.log.Debug("received from IRC", "line", line)
+		b.handle(parseIRC(line))
+	}
+}
+
+// Parses a line received from IRC, such as ":nick!user@host PRIVMSG
+// #channel :hello there".
+func parseIRC(line string) ircMessage {
+	var msg ircMessage
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i == -1 {
+			return msg
+		}
+		msg.from = line[1:i]
+		if j := strings.IndexAny(msg.from, "!@"); j != -1 {
+			msg.from = msg.from[:j]
+		}
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+
+	trailing := ""
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i != -1 {
+		trailing, hasTrailing = line[i+2:], true
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return msg
+	}
+	msg.command = strings.ToUpper(fields[0])
+	msg.params = fields[1:]
+	if hasTrailing {
+		msg.params = append(msg.params, trailing)
+	}
+	return msg
+}
+
+// Queues a line to be sent to IRC, without waiting for it to be sent. Line
+// breaks are removed so that nothing can be smuggled in as a separate
+// command.
+func (b *IRCBridge) send(line string) error {
+	line = strings.NewReplacer("\r", "", "\n", " ").Replace(line)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.queue == nil {
+		return fmt.Errorf("not connected to IRC")
+	}
+	select {
+	case b.queue <- line:
+		return nil
+	default:
+		return fmt.Errorf("too many lines waiting to be sent to IRC")
+	}
+}
+
+// Sends the lines queued by send to conn, no faster than b.burst and
+// b.sendInterval allow, until stop is closed. If a line can't be sent, conn
+// is closed so that the connection is made again.
+func (b *IRCBridge) write(conn net.Conn, queue <-chan string,
+	stop <-chan struct{}) {
+	ticker := time.NewTicker(b.sendInterval)
+	defer ticker.Stop()
+
+	tokens := b.burst
+	for {
+		if tokens == 0 {
+			// wait until another line can be sent
+			select {
+			case <-ticker.C:
+				tokens++
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+			if tokens < b.burst {
+				tokens++
+			}
+		case line := <-queue:
+			tokens--
+			b.log.Debug("sending to IRC", "line", line)
+			conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+			if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+				b.log.Warn("could not send to IRC", "error", err)
+				conn.Close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Responds to a line received from IRC.
+func (b *IRCBridge) handle(msg ircMessage) {
+	switch msg.command {
+	case "PING":
+		b.send("PONG :" + strings.Join(msg.params, " "))
+	case "001": // registered
+		b.log.Info("connected to IRC", "server", b.server)
+		for _, channel := range b.channels {
+			b.send("JOIN " + channel)
+		}
+	case "433": // nick in use
+		b.mu.Lock()
+		b.currentNick += "_"
+		nick := b.currentNick
+		b.mu.Unlock()
+		b.log.Warn("IRC nick in use, trying another", "nick", nick)
+		b.send("NICK " + nick)
+	case "PRIVMSG":
+		if len(msg.params) < 2 {
+			return
+		}
+		b.relayToPS(msg.from, msg.params[0], msg.params[1])
+	}
+}
+
+// Relays a message said in an IRC channel to its room.
+func (b *IRCBridge) relayToPS(nick, channel, text string) {
+	room, ok := b.rooms[strings.ToLower(channel)]
+	b.mu.Lock()
+	self := strings.EqualFold(nick, b.currentNick)
+	b.mu.Unlock()
+	if !ok || self {
+		return
+	}
+
+	name := nick
+	if mapped, ok := b.nicks[strings.ToLower(nick)]; ok {
+		name = mapped
+	}
+	var line string
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		line = "* " + name + " " + strings.TrimSuffix(
+			strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		return // other CTCP requests aren't chat
+	} else {
+		line = "<" + name + "> " + text
+	}
+	line = truncate(psMaxMessage, strings.TrimSpace(
+		StripIRCFormatting(line)))
+
+	b.mu.Lock()
+	said := append(b.said[room], line)
+	if len(said) > ircSaidSize {
+		said = said[len(said)-ircSaidSize:]
+	}
+	b.said[room] = said
+	b.mu.Unlock()
+	b.say(line, room)
+}
+
+// Returns true if the bridge said the given text in room, forgetting it so
+// that it is only matched once.
+func (b *IRCBridge) saidInRoom(room, text string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, said := range b.said[room] {
+		if said == text {
+			b.said[room] = append(b.said[room][:i:i], b.said[room][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if room is relayed to IRC.
+func (b *IRCBridge) Bridged(room string) bool {
+	_, ok := b.channels[room]
+	return ok
+}
+
+// Relays a chat message received from PS! to IRC, if it was said in a
+// bridged room. Messages that the bridge relayed from IRC itself are
+// ignored.
+func (b *IRCBridge) RelayToIRC(msg Message) {
+	switch msg.msgType {
+	case "c", "c:", "chat":
+	default:
+		return
+	}
+	channel, ok := b.channels[msg.room]
+	if !ok || len(msg.args) < 2 {
+		return
+	}
+
+	_, name := splitUser(msg.args[0])
+	text := msg.args[1]
+	self := toId(name) == toId(b.psNick)
+	if self && b.saidInRoom(msg.room, text) {
+		return
+	}
+
+	var lines []string
+	// whether the lines need the name adding
+	named := self
+	switch {
+	case strings.HasPrefix(text, "!htmlbox "), strings.HasPrefix(text,
+		"/addhtmlbox "):
+		lines = IRCFromHTML(text[strings.Index(text, " ")+1:])
+	case strings.HasPrefix(text, "/me "):
+		lines = []string{"* " + name + " " + IRCFromPS(text[4:])}
+		named = true
+	case strings.HasPrefix(text, "/"):
+		return // other commands aren't chat
+	default:
+		lines = []string{IRCFromPS(text)}
+	}
+
+	if nick, ok := b.names[toId(name)]; ok {
+		name = nick
+	}
+	for _, line := range lines {
+		if !named {
+			line = "<" + name + "> " + line
+		}
+		if err := b.send("PRIVMSG " + channel + " :" + truncateBytes(line,
+			ircMaxMessage)); err != nil {
+			b.log.Debug("could not relay to IRC", "room", msg.room,
+				"error", err)
+			return
+		}
+	}
+}
+
+// Removes IRC formatting codes from text.
+func StripIRCFormatting(text string) string {
+	return ircFormattingRegex.ReplaceAllString(text, "")
+}
+
+// Converts PS!'s chat formatting, such as **bold**, to IRC formatting.
+func IRCFromPS(text string) string {
+	return psFormattingRegex.ReplaceAllStringFunc(text, func(s string) string {
+		code := map[string]string{"**": ircBold, "__": ircItalic,
+			"~~": ircStrike}[s[:2]]
+		return code + s[2:len(s)-2] + code
+	})
+}
+
+// Converts HTML, such as that given to !htmlbox, to lines of IRC formatted
+// text. Bold, italics, underlines and font colours are kept; links are given
+// as their text followed by the URL; and anything else is reduced to its
+// text.
+func IRCFromHTML(s string) []string {
+	var out strings.Builder
+	var colours []string
+	// where the text of each open link starts, and where it goes
+	type link struct {
+		start int
+		href  string
+	}
+	var links []link
+
+	text := func(s string) {
+		out.WriteString(spaceRegex.ReplaceAllString(html.UnescapeString(s),
+			" "))
+	}
+	last := 0
+	for _, match := range htmlTagRegex.FindAllStringSubmatchIndex(s, -1) {
+		text(s[last:match[0]])
+		last = match[1]
+
+		closing := match[3] > match[2]
+		tag := strings.ToLower(s[match[4]:match[5]])
+		attrs := htmlAttrs(s[match[6]:match[7]])
+		switch tag {
+		case "b", "strong":
+			out.WriteString(ircBold)
+		case "i", "em":
+			out.WriteString(ircItalic)
+		case "u":
+			out.WriteString(ircUnderline)
+		case "s", "strike", "del":
+			out.WriteString(ircStrike)
+		case "font":
+			if closing {
+				if len(colours) > 0 {
+					colours = colours[:len(colours)-1]
+				}
+				out.WriteString(ircColour)
+				if len(colours) > 0 {
+					out.WriteString(colours[len(colours)-1])
+				}
+			} else {
+				colour := ircColourCode(attrs["color"])
+				colours = append(colours, colour)
+				if colour != "" {
+					out.WriteString(ircColour + colour)
+				}
+			}
+		case "a":
+			if !closing {
+				links = append(links, link{out.Len(), attrs["href"]})
+			} else if len(links) > 0 {
+				l := links[len(links)-1]
+				links = links[:len(links)-1]
+				shown := StripIRCFormatting(out.String()[l.start:])
+				if l.href != "" && strings.TrimSpace(shown) != l.href {
+					out.WriteString(" (" + l.href + ")")
+				}
+			}
+		case "br", "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "h5",
+			"h6", "table", "ul", "ol":
+			out.WriteString("\n")
+		case "td", "th":
+			if closing {
+				out.WriteString(" ")
+			}
+		}
+	}
+	text(s[last:])
+
+	lines := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.TrimSpace(StripIRCFormatting(line)) != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	return lines
+}
+
+// Returns the attributes of an HTML tag, given what follows its name.
+func htmlAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range htmlAttrRegex.FindAllStringSubmatch(s, -1) {
+		attrs[strings.ToLower(match[1])] = html.UnescapeString(
+			strings.Trim(match[2], `"'`))
+	}
+	return attrs
+}
+
+// Returns the IRC colour closest to an HTML colour such as #FF00FF, as a
+// two digit code, or "" if the colour isn't understood.
+func ircColourCode(colour string) string {
+	match := hexColourRegex.FindStringSubmatch(strings.TrimSpace(colour))
+	if match == nil {
+		return ""
+	}
+	hex := match[1]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, _ := strconv.ParseUint(hex, 16, 32)
+	r, g, b := int(rgb>>16), int(rgb>>8&0xFF), int(rgb&0xFF)
+
+	best, bestDist := 0, -1
+	for i, c := range ircColours {
+		dist := (c.r-r)*(c.r-r) + (c.g-g)*(c.g-g) + (c.b-b)*(c.b-b)
+		if bestDist == -1 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return fmt.Sprintf("%02d", best)
+}
+
+// Cuts text down to at most max bytes, without splitting a character.
+func truncateBytes(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	text = text[:max-3]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text + "..."
+}
@@ -0,0 +1,249 @@
+package gobot
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A logger for bridges in tests, which throws away what they log.
+var discardLogger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+// A stand-in for an IRC server, with a single client connected to it.
+type fakeIRC struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Returns the next line the client sends, failing the test if it doesn't
+// send one soon.
+func (f *fakeIRC) expect(want string) {
+	f.t.Helper()
+	f.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := f.reader.ReadString('\n')
+	if err != nil {
+		f.t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if got := strings.TrimRight(line, "\r\n"); got != want {
+		f.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// Sends a line to the client.
+func (f *fakeIRC) send(line string) {
+	f.t.Helper()
+	if _, err := f.conn.Write([]byte(line + "\r\n")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// Records what a bridge says in PS! rooms.
+type psRooms struct {
+	mu   sync.Mutex
+	said []string
+}
+
+func (p *psRooms) say(text, room string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.said = append(p.said, room+"|"+text)
+}
+
+// Waits for the bridge to have said n things, and returns them.
+func (p *psRooms) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		said := append([]string{}, p.said...)
+		p.mu.Unlock()
+		if len(said) >= n {
+			return said
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("waited for %d messages in PS! rooms", n)
+	return nil
+}
+
+// Starts a bridge connected to a fake IRC server, and waits for it to
+// register and join its channel.
+func startIRCBridge(t *testing.T) (*IRCBridge, *fakeIRC, *psRooms) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ps := &psRooms{}
+	b := NewIRCBridge(Config{
+		Nick:        "gobot",
+		IRCServer:   listener.Addr().String(),
+		IRCPass:     "secret",
+		IRCChannels: map[string]string{"techcode": "#TechCode"},
+		IRCNicks:    map[string]string{"ttt": "TalkTakesTime"},
+	}, ps.say, discardLogger)
+	// quickly enough for the tests, but still rate limited
+	b.sendInterval = 10 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- b.serve()
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Error("the bridge didn't notice the connection closing")
+		}
+	})
+	server := &fakeIRC{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	server.expect("PASS secret")
+	server.expect("NICK gobot")
+	server.expect("USER gobot 0 * :gobot")
+	server.send(":irc.example.com 433 * gobot :Nickname is already in use")
+	server.expect("NICK gobot_")
+	server.send(":irc.example.com 001 gobot_ :Welcome")
+	server.expect("JOIN #TechCode")
+	server.send("PING :irc.example.com")
+	server.expect("PONG :irc.example.com")
+	return b, server, ps
+}
+
+func TestIRCRegistration(t *testing.T) {
+	startIRCBridge(t)
+}
+
+func TestIRCRelay(t *testing.T) {
+	b, server, ps := startIRCBridge(t)
+
+	server.send(":ttt!ttt@example.com PRIVMSG #techcode :hello \x02there\x02")
+	server.send(":someone!s@example.com PRIVMSG #TechCode " +
+		":\x01ACTION waves\x01")
+	// the bridge's own messages, and channels that aren't bridged, are
+	// ignored
+	server.send(":gobot_!g@example.com PRIVMSG #TechCode :<ttt> hello")
+	server.send(":ttt!ttt@example.com PRIVMSG #other :elsewhere")
+	server.send(":ttt!ttt@example.com PRIVMSG #TechCode :last")
+	said := ps.wait(t, 3)
+	want := []string{
+		"techcode|<TalkTakesTime> hello there",
+		"techcode|* someone waves",
+		"techcode|<TalkTakesTime> last",
+	}
+	if strings.Join(said, "\n") != strings.Join(want, "\n") {
+		t.Errorf("said %q in PS! rooms, want %q", said, want)
+	}
+
+	chat := func(user, text string) {
+		b.RelayToIRC(Message{msgType: "c:", room: "techcode",
+			args: []string{user, text}})
+	}
+	// what the bridge relayed from IRC comes back from PS! as the bot's
+	// own message, and mustn't be relayed to IRC again
+	chat(" gobot", "<TalkTakesTime> hello there")
+	chat("+ttt", "hi **all**")
+	chat(" gobot", "<TalkTakesTime> hello there")
+	chat(" Someone", "/me waves back")
+	chat(" gobot", `!htmlbox <b>New</b> commit <a href="https://x.io">x</a>`)
+	server.expect("PRIVMSG #TechCode :<ttt> hi \x02all\x02")
+	// the same text again isn't something the bridge said, so it is
+	// relayed this time
+	server.expect("PRIVMSG #TechCode :<TalkTakesTime> hello there")
+	server.expect("PRIVMSG #TechCode :* Someone waves back")
+	server.expect("PRIVMSG #TechCode :\x02New\x02 commit x (https://x.io)")
+}
+
+func TestIRCSaidInRoom(t *testing.T) {
+	b := NewIRCBridge(Config{Nick: "gobot",
+		IRCChannels: map[string]string{"techcode": "#techcode"}},
+		func(text, room string) {}, discardLogger)
+	for i := 0; i < ircSaidSize+5; i++ {
+		b.relayToPS("ttt", "#techcode", strings.Repeat("a", i+1))
+	}
+
+	if b.saidInRoom("techcode", "<ttt> a") {
+		t.Error("the oldest messages should have been forgotten")
+	}
+	last := "<ttt> " + strings.Repeat("a", ircSaidSize+5)
+	if !b.saidInRoom("techcode", last) {
+		t.Errorf("%q should have been remembered", last)
+	}
+	if b.saidInRoom("techcode", last) {
+		t.Errorf("%q should only match once", last)
+	}
+	if b.saidInRoom("lobby", last) {
+		t.Error("messages should only match in the room they were said in")
+	}
+}
+
+func TestIRCSendRate(t *testing.T) {
+	b := NewIRCBridge(Config{Nick: "gobot"}, func(text, room string) {},
+		discardLogger)
+	b.burst, b.sendInterval = 2, 100*time.Millisecond
+	client, conn := net.Pipe()
+	defer conn.Close()
+	go b.serveConn(client)
+	server := &fakeIRC{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	server.expect("NICK gobot")
+	server.expect("USER gobot 0 * :gobot")
+
+	start := time.Now()
+	for _, line := range []string{"one", "two", "three"} {
+		if err := b.send("PRIVMSG #techcode :" + line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.expect("PRIVMSG #techcode :one")
+	server.expect("PRIVMSG #techcode :two")
+	server.expect("PRIVMSG #techcode :three")
+	// the registration used up the burst, so each line has to wait
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("sent three lines in %v, want them rate limited", elapsed)
+	}
+}
+
+func TestIRCStalledServer(t *testing.T) {
+	b := NewIRCBridge(Config{Nick: "gobot",
+		IRCChannels: map[string]string{"techcode": "#techcode"}},
+		func(text, room string) {}, discardLogger)
+	b.writeTimeout = 50 * time.Millisecond
+	// nothing is ever read from the other end
+	client, conn := net.Pipe()
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- b.serveConn(client)
+	}()
+
+	relayed := make(chan bool)
+	go func() {
+		for i := 0; i < 2*ircQueueSize; i++ {
+			b.RelayToIRC(Message{msgType: "c:", room: "techcode",
+				args: []string{" ttt", "hello"}})
+		}
+		close(relayed)
+	}()
+	select {
+	case <-relayed:
+	case <-time.After(time.Second):
+		t.Fatal("relaying was held up by the server")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection wasn't dropped after the write timed out")
+	}
+}
@@ -0,0 +1,292 @@
+/*
+ * Looks up GitHub issues and pull requests, for the .issue and .pr commands
+ * and for expanding mentions like server#123 in chat.
+ *
+ * Lookups go through an IssueProvider. The bot uses GitHubIssues, which talks
+ * to the GitHub REST API at config.GitHubAPI, so pointing that at a local
+ * stand-in of the API is enough to test it.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGitHubAPI = "https://api.github.com"
+
+	// how long looked up issues are remembered for
+	issueCacheTime = 5 * time.Minute
+	// the most mentions expanded from a single chat message
+	maxIssueMentions = 3
+)
+
+var (
+	ErrIssueNotFound = errors.New("issue not found")
+
+	// matches mentions of issues, such as server#123 or user/repo#123
+	IssueMentionRegex = regexp.MustCompile(
+		`(?:^|\s)([A-Za-z0-9_.-]+(?:/[A-Za-z0-9_.-]+)?)#([0-9]+)\b`)
+)
+
+// An issue or pull request.
+type Issue struct {
+	Repo        string
+	Number      int
+	Title       string
+	State       string // open, closed or merged
+	Author      string
+	URL         string
+	PullRequest bool
+}
+
+// An IssueProvider looks up issues and pull requests in repositories given
+// in the form user/repo.
+type IssueProvider interface {
+	// Looks up an issue, which may turn out to be a pull request. Returns
+	// ErrIssueNotFound if there is no such issue
+	Issue(repo string, number int) (*Issue, error)
+	// Looks up a pull request. Returns ErrIssueNotFound if there is no such
+	// pull request
+	PullRequest(repo string, number int) (*Issue, error)
+}
+
+// GitHubIssues looks up issues using the GitHub REST API, remembering them
+// for a few minutes to avoid running into GitHub's rate limits.
+type GitHubIssues struct {
+	// the base URL of the API, e.g. https://api.github.com
+	BaseURL string
+	// an optional access token, which gives a much higher rate limit
+	Token  string
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedIssue
+}
+
+type cachedIssue struct {
+	issue   *Issue
+	expires time.Time
+}
+
+// the parts of GitHub's responses that are used
+type gitHubIssue struct {
+	Number  int
+	Title   string
+	State   string
+	HTMLURL string `json:"html_url"`
+	User    struct {
+		Login string
+	}
+	PullRequest *struct{} `json:"pull_request"`
+	Merged      bool
+}
+
+// Fetches an issue or pull request from the given API path, e.g. issues or
+// pulls.
+func (g *GitHubIssues) fetch(kind, repo string, number int) (*Issue, error) {
+	key := kind + " " + repo + " " + strconv.Itoa(number)
+	g.mu.Lock()
+	cached, ok := g.cache[key]
+	g.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.issue, nil
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/%s/%d",
+		strings.TrimSuffix(g.BaseURL, "/"), repo, kind, number), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+
+	client := g.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrIssueNotFound
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub replied %s", res.Status)
+	}
+
+	var data gitHubIssue
+	if err = json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	issue := &Issue{
+		Repo:        repo,
+		Number:      data.Number,
+		Title:       data.Title,
+		State:       data.State,
+		Author:      data.User.Login,
+		URL:         data.HTMLURL,
+		PullRequest: data.PullRequest != nil || kind == "pulls",
+	}
+	if data.Merged {
+		issue.State = "merged"
+	}
+
+	g.mu.Lock()
+	if g.cache == nil {
+		g.cache = make(map[string]cachedIssue)
+	}
+	for k, c := range g.cache {
+		if time.Now().After(c.expires) {
+			delete(g.cache, k)
+		}
+	}
+	g.cache[key] = cachedIssue{issue, time.Now().Add(issueCacheTime)}
+	g.mu.Unlock()
+
+	return issue, nil
+}
+
+func (g *GitHubIssues) Issue(repo string, number int) (*Issue, error) {
+	return g.fetch("issues", repo, number)
+}
+
+func (g *GitHubIssues) PullRequest(repo string, number int) (*Issue, error) {
+	return g.fetch("pulls", repo, number)
+}
+
+// Describes an issue in a single line.
+func (issue *Issue) Summary() string {
+	kind := "Issue"
+	if issue.PullRequest {
+		kind = "PR"
+	}
+	return fmt.Sprintf("[%s] %s #%d: %s (%s, by %s) %s", issue.Repo, kind,
+		issue.Number, truncate(100, issue.Title), issue.State, issue.Author,
+		issue.URL)
+}
+
+// Creates the IssueProvider described by the bot's config.
+func (bot *Bot) CreateIssueProvider() IssueProvider {
+	api := bot.config.GitHubAPI
+	if api == "" {
+		api = DefaultGitHubAPI
+	}
+	return &GitHubIssues{BaseURL: api, Token: bot.config.GitHubToken}
+}
+
+// Resolves a repository given to .issue, .pr or in a mention, which can be
+// an alias or a literal user/repo. Returns "" if it is neither.
+func (bot *Bot) resolveRepo(name string) string {
+	if repo, ok := bot.config.GitAliases[name]; ok {
+		return repo
+	}
+	if GitRepoRegex.MatchString(name) {
+		return name
+	}
+	return ""
+}
+
+// Looks up an issue or pull request and says what it is in the given room.
+// If quiet is set, nothing is said if it can't be found. Lookups can be slow,
+// so this should be used as a goroutine.
+func (bot *Bot) sayIssue(repo string, number int, pull, quiet bool,
+	room string) {
+	bot.configMu.RLock()
+	issues := bot.issues
+	bot.configMu.RUnlock()
+
+	var issue *Issue
+	var err error
+	if pull {
+		issue, err = issues.PullRequest(repo, number)
+	} else {
+		issue, err = issues.Issue(repo, number)
+	}
+
+	switch {
+	case err != nil && quiet:
+		return
+	case err == ErrIssueNotFound:
+		bot.QueueMessage(fmt.Sprintf("%s #%d doesn't exist.", repo, number),
+			room)
+	case err != nil:
+		bot.QueueMessage(fmt.Sprintf("Could not look up %s #%d: %s", repo,
+			number, err), room)
+	default:
+		bot.QueueMessage(issue.Summary(), room)
+	}
+}
+
+// Returns a command handler for .issue or .pr.
+//
+// Syntax: .issue (user/repo|alias) number, or .pr (user/repo|alias) number
+// The number may be given with or without a leading #
+func (bot *Bot) IssueCommand(pull bool) func(Message) {
+	return func(msg Message) {
+		args := strings.Fields(msg.args[1])
+		if len(args) != 2 {
+			bot.QueueMessage(bot.config.CommandChar+msg.args[2]+
+				" (user/repo|alias) number", msg.room)
+			return
+		}
+
+		repo := bot.resolveRepo(args[0])
+		if repo == "" {
+			if suggestion := bot.suggestRepo(args[0]); suggestion != "" {
+				bot.QueueMessage("Did you mean "+suggestion+"?", msg.room)
+			} else {
+				bot.QueueMessage("Unknown repository: "+args[0], msg.room)
+			}
+			return
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil || number <= 0 {
+			bot.QueueMessage("Invalid number: "+args[1], msg.room)
+			return
+		}
+
+		go bot.sayIssue(repo, number, pull, false, msg.room)
+	}
+}
+
+// Looks for mentions of issues such as server#123 in a chat message and says
+// what each one is. Only repositories with aliases and those in the bot's
+// index are expanded, so that things like "room#1" aren't mistaken for
+// issues.
+func (bot *Bot) ExpandIssues(msg Message) {
+	mentions := IssueMentionRegex.FindAllStringSubmatch(msg.args[1], -1)
+	seen := make(map[string]bool)
+	for _, mention := range mentions {
+		repo, ok := bot.config.GitAliases[mention[1]]
+		if !ok && bot.repos.HasRepo(mention[1]) {
+			repo, ok = mention[1], true
+		}
+		number, err := strconv.Atoi(mention[2])
+		if !ok || err != nil || seen[repo+"#"+mention[2]] {
+			continue
+		}
+
+		seen[repo+"#"+mention[2]] = true
+		if len(seen) > maxIssueMentions {
+			return
+		}
+		go bot.sayIssue(repo, number, false, true, msg.room)
+	}
+}
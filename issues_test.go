@@ -0,0 +1,223 @@
+package gobot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in for the parts of the GitHub REST API that GitHubIssues uses,
+// which counts the requests made to it.
+type fakeGitHub struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req.URL.Path)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/repos/Zarel/Pokemon-Showdown/issues/1":
+		fmt.Fprint(w, `{"number": 1, "title": "Crash on login",
+			"state": "open", "html_url": "https://github.com/Zarel/`+
+			`Pokemon-Showdown/issues/1", "user": {"login": "someone"}}`)
+	case "/repos/Zarel/Pokemon-Showdown/issues/2":
+		// GitHub gives pull requests from the issues API too
+		fmt.Fprint(w, `{"number": 2, "title": "Fix the crash",
+			"state": "closed", "html_url": "https://github.com/Zarel/`+
+			`Pokemon-Showdown/pull/2", "user": {"login": "other"},
+			"pull_request": {}}`)
+	case "/repos/Zarel/Pokemon-Showdown/pulls/2":
+		fmt.Fprint(w, `{"number": 2, "title": "Fix the crash",
+			"state": "closed", "html_url": "https://github.com/Zarel/`+
+			`Pokemon-Showdown/pull/2", "user": {"login": "other"},
+			"merged": true}`)
+	default:
+		// including /pulls/1, since issue 1 isn't a pull request
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+	}
+}
+
+// Returns the requests made so far.
+func (f *fakeGitHub) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func TestGitHubIssues(t *testing.T) {
+	github := &fakeGitHub{}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	issues := &GitHubIssues{BaseURL: server.URL}
+
+	issue, err := issues.Issue("Zarel/Pokemon-Showdown", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.Title != "Crash on login" || issue.State != "open" ||
+		issue.Author != "someone" || issue.PullRequest {
+		t.Errorf("got issue %+v", issue)
+	}
+
+	// an issue number that is really a pull request
+	issue, err = issues.Issue("Zarel/Pokemon-Showdown", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issue.PullRequest || issue.State != "closed" {
+		t.Errorf("got %+v, want a closed pull request", issue)
+	}
+	issue, err = issues.PullRequest("Zarel/Pokemon-Showdown", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issue.PullRequest || issue.State != "merged" {
+		t.Errorf("got %+v, want a merged pull request", issue)
+	}
+
+	// an issue number used for a pull request
+	if _, err = issues.PullRequest("Zarel/Pokemon-Showdown", 1); err !=
+		ErrIssueNotFound {
+		t.Errorf("got error %v looking up an issue as a PR, want %v", err,
+			ErrIssueNotFound)
+	}
+	if _, err = issues.Issue("Zarel/Pokemon-Showdown", 999); err !=
+		ErrIssueNotFound {
+		t.Errorf("got error %v for a missing issue, want %v", err,
+			ErrIssueNotFound)
+	}
+
+	// looked up issues are cached, but missing ones aren't
+	before := len(github.Requests())
+	for i := 0; i < 3; i++ {
+		if _, err = issues.Issue("Zarel/Pokemon-Showdown", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = issues.PullRequest("Zarel/Pokemon-Showdown", 2); err !=
+			nil {
+			t.Fatal(err)
+		}
+	}
+	if after := len(github.Requests()); after != before {
+		t.Errorf("cached issues were fetched again: %v",
+			github.Requests()[before:])
+	}
+	issues.Issue("Zarel/Pokemon-Showdown", 999)
+	if after := len(github.Requests()); after != before+1 {
+		t.Errorf("made %d requests for a missing issue, want 1",
+			after-before)
+	}
+}
+
+// An IssueProvider that knows about every issue, and records the ones it is
+// asked for.
+type recordingIssues struct {
+	mu     sync.Mutex
+	looked []string
+}
+
+func (r *recordingIssues) Issue(repo string, number int) (*Issue, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.looked = append(r.looked, fmt.Sprintf("%s#%d", repo, number))
+	return &Issue{Repo: repo, Number: number, Title: "Title",
+		State: "open", Author: "someone"}, nil
+}
+
+func (r *recordingIssues) PullRequest(repo string,
+	number int) (*Issue, error) {
+	return r.Issue(repo, number)
+}
+
+// Waits for the bot to queue n messages, and then a little longer in case it
+// queues more than it should. Returns what was queued.
+func waitForMessages(bot *Bot, n int) []string {
+	sent := []string{}
+	deadline := time.After(time.Second)
+	for len(sent) < n {
+		select {
+		case msg := <-bot.outQueue:
+			sent = append(sent, msg.data)
+		case <-deadline:
+			return sent
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return append(sent, sentMessages(bot)...)
+}
+
+func TestExpandIssues(t *testing.T) {
+	if maxIssueMentions != 3 {
+		t.Fatalf("the tests expect maxIssueMentions to be 3, not %d",
+			maxIssueMentions)
+	}
+	tests := []struct {
+		text   string
+		looked []string
+	}{
+		{
+			text:   "see server#12, it's bad",
+			looked: []string{"Zarel/Pokemon-Showdown#12"},
+		},
+		{
+			// repositories in the index are expanded as well as aliases
+			text:   "TalkTakesTime/gobot#3",
+			looked: []string{"TalkTakesTime/gobot#3"},
+		},
+		{
+			// but other repositories and rooms aren't
+			text:   "someone/else#4 and techcode#1",
+			looked: []string{},
+		},
+		{
+			text: "server#1 server#1 client#1",
+			looked: []string{"Zarel/Pokemon-Showdown#1",
+				"Zarel/Pokemon-Showdown-Client#1"},
+		},
+		{
+			// only the first maxIssueMentions are expanded
+			text: "server#1 server#2 server#3 server#4 server#5",
+			looked: []string{"Zarel/Pokemon-Showdown#1",
+				"Zarel/Pokemon-Showdown#2", "Zarel/Pokemon-Showdown#3"},
+		},
+	}
+
+	for _, test := range tests {
+		bot := newTestBot(t, Config{GitAliases: map[string]string{
+			"server": "Zarel/Pokemon-Showdown",
+			"client": "Zarel/Pokemon-Showdown-Client",
+		}})
+		bot.repos = &MemoryProvider{Repositories: map[string]*MemoryRepo{
+			"TalkTakesTime/gobot": {DefaultBranch: "master"},
+		}}
+		issues := &recordingIssues{}
+		bot.issues = issues
+
+		bot.ExpandIssues(Message{room: "techcode",
+			args: []string{" user", test.text}})
+		sent := waitForMessages(bot, len(test.looked))
+
+		issues.mu.Lock()
+		looked := append([]string{}, issues.looked...)
+		issues.mu.Unlock()
+		sort.Strings(looked)
+		if strings.Join(looked, " ") != strings.Join(test.looked, " ") {
+			t.Errorf("%q: looked up %v, want %v", test.text, looked,
+				test.looked)
+		}
+		if len(sent) != len(test.looked) {
+			t.Errorf("%q: sent %q, want %d messages", test.text, sent,
+				len(test.looked))
+		}
+	}
+}
@@ -0,0 +1,353 @@
+/*
+ * The bot's logging. Everything is logged through log/slog, with a logger for
+ * each part of the bot so that, for example, every message from PS! can be
+ * logged without also logging every webhook. Each subsystem can have its own
+ * level, given by config.LogLevels, and otherwise uses config.LogLevel.
+ *
+ * Logs are written as JSON, for feeding to other tools, or as text, which is
+ * coloured when written to a terminal.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The subsystems the bot logs for.
+const (
+	// anything that doesn't belong elsewhere, such as starting up
+	LogBot = "bot"
+	// the connection to PS!, including every message sent and received
+	LogTransport = "transport"
+	// the messages received from PS!, once parsed
+	LogParser = "parser"
+	// commands, and the things they do such as joining rooms
+	LogCommands = "commands"
+	// webhooks, and the templates and shortener used to announce them
+	LogHooks = "hooks"
+	// the HTTP server
+	LogHTTP = "http"
+	// the index of git repositories
+	LogGit = "git"
+	// the IRC bridge
+	LogIRC = "irc"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	LogColourAuto   = "auto"
+	LogColourAlways = "always"
+	LogColourNever  = "never"
+)
+
+var (
+	// Where the bot's logs are written. main sets this to the file given by
+	// -log, if any
+	LogOutput io.Writer = os.Stderr
+
+	// every subsystem, for checking config.LogLevels
+	LogSubsystems = []string{LogBot, LogTransport, LogParser, LogCommands,
+		LogHooks, LogHTTP, LogGit, LogIRC}
+
+	// ANSI colours for each level when colour is enabled
+	levelColours = map[slog.Level]string{
+		slog.LevelDebug: "90", // grey
+		slog.LevelInfo:  "36", // cyan
+		slog.LevelWarn:  "33", // yellow
+		slog.LevelError: "31", // red
+	}
+)
+
+// The loggers for each of the bot's subsystems. Their levels can be changed
+// while they are in use, e.g. when the config is reloaded.
+type Logging struct {
+	handler slog.Handler
+	level   *slog.LevelVar
+	levels  map[string]*slog.LevelVar
+	loggers map[string]*slog.Logger
+	// called for every warning and error logged, if set
+	onError func(subsystem string, r slog.Record)
+}
+
+// Creates the loggers described by the given config, writing to w.
+func NewLogging(conf Config, w io.Writer) *Logging {
+	l := &Logging{
+		level:   new(slog.LevelVar),
+		levels:  make(map[string]*slog.LevelVar),
+		loggers: make(map[string]*slog.Logger),
+	}
+
+	if strings.ToLower(conf.LogFormat) == LogFormatJSON {
+		// levels are filtered by levelHandler, so nothing is filtered here
+		l.handler = slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})
+	} else {
+		l.handler = &textHandler{
+			mu:     new(sync.Mutex),
+			w:      w,
+			colour: useColour(conf.LogColour, w),
+		}
+	}
+
+	if conf.Instance != "" {
+		// several bots share the output, so say which one logged what
+		l.handler = l.handler.WithAttrs([]slog.Attr{
+			slog.String("bot", conf.Instance)})
+	}
+
+	for _, subsystem := range LogSubsystems {
+		level := new(slog.LevelVar)
+		l.levels[subsystem] = level
+		l.loggers[subsystem] = slog.New(&levelHandler{
+			level:     level,
+			handler:   l.handler,
+			logging:   l,
+			subsystem: subsystem,
+		}).With("subsystem", subsystem)
+	}
+	l.SetLevels(conf)
+	return l
+}
+
+// Sets the level of each subsystem's logger to the one given in config.
+func (l *Logging) SetLevels(conf Config) {
+	defaultLevel, _ := ParseLogLevel(conf.LogLevel)
+	l.level.Set(defaultLevel)
+	for subsystem, level := range l.levels {
+		if name, ok := conf.LogLevels[subsystem]; ok {
+			if parsed, err := ParseLogLevel(name); err == nil {
+				level.Set(parsed)
+				continue
+			}
+		}
+		level.Set(defaultLevel)
+	}
+}
+
+// Returns the logger for the given subsystem.
+func (l *Logging) Logger(subsystem string) *slog.Logger {
+	if logger, ok := l.loggers[subsystem]; ok {
+		return logger
+	}
+	return slog.New(&levelHandler{
+		level:     l.level,
+		handler:   l.handler,
+		logging:   l,
+		subsystem: subsystem,
+	}).With("subsystem", subsystem)
+}
+
+// Sets a function to be called for every warning and error logged. Should
+// be used before anything is logged.
+func (l *Logging) OnError(f func(subsystem string, r slog.Record)) {
+	l.onError = f
+}
+
+// Records a warning or error that has been logged, for the metrics and the
+// dashboard.
+func (bot *Bot) errorLogged(subsystem string, r slog.Record) {
+	level := strings.ToLower(r.Level.String())
+	bot.metrics.Errors.Inc(subsystem, level)
+
+	var message strings.Builder
+	message.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&message, "", a)
+		return true
+	})
+	bot.recent.addError(recentError{
+		Time:      r.Time,
+		Subsystem: subsystem,
+		Level:     level,
+		Message:   message.String(),
+	})
+}
+
+// Returns the bot's logger for the given subsystem.
+func (bot *Bot) Logger(subsystem string) *slog.Logger {
+	return bot.logging.Logger(subsystem)
+}
+
+// Parses a level as given in config: debug, info, warn or error. The empty
+// string is info.
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("%q should be debug, info, warn or "+
+		"error", name)
+}
+
+// Works out whether to colour logs written to w, given config.LogColour.
+// When it is auto, logs are coloured if w is a terminal.
+func useColour(setting string, w io.Writer) bool {
+	switch strings.ToLower(setting) {
+	case LogColourAlways:
+		return true
+	case LogColourNever:
+		return false
+	}
+
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A handler that drops records below a level that can be changed at any
+// time, before passing the rest on to another handler.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+	// for counting warnings and errors
+	logging   *Logging
+	subsystem string
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn && h.logging.onError != nil {
+		h.logging.onError(h.subsystem, r)
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.handler = h.handler.WithAttrs(attrs)
+	return &h2
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.handler = h.handler.WithGroup(name)
+	return &h2
+}
+
+// A handler that writes records as lines of human readable text, in the
+// form:
+//
+//	2015/06/01 12:00:00 INFO  transport: connecting url=ws://...
+//
+// The level is coloured if colour is set.
+type textHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	colour bool
+
+	subsystem string
+	// attributes from WithAttrs, already formatted
+	attrs string
+	// the prefix for attribute keys, from WithGroup
+	group string
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *textHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	if !r.Time.IsZero() {
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+
+	level := fmt.Sprintf("%-5s", r.Level.String())
+	if colour, ok := levelColours[r.Level]; ok && h.colour {
+		level = "\x1b[" + colour + "m" + level + "\x1b[0m"
+	}
+	b.WriteString(level + " ")
+	if h.subsystem != "" {
+		b.WriteString(h.subsystem + ": ")
+	}
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.group, a)
+		return true
+	})
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var b strings.Builder
+	for _, a := range attrs {
+		if a.Key == "subsystem" && h.group == "" {
+			h2.subsystem = a.Value.String()
+			continue
+		}
+		writeAttr(&b, h.group, a)
+	}
+	h2.attrs += b.String()
+	return &h2
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+// Writes an attribute as " key=value", quoting the value if needed.
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, attr := range a.Value.Group() {
+			writeAttr(b, prefix, attr)
+		}
+		return
+	}
+
+	var value string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		value = a.Value.Time().Format(time.RFC3339)
+	default:
+		value = a.Value.String()
+	}
+	if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(" " + prefix + a.Key + "=" + value)
+}
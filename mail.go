@@ -0,0 +1,244 @@
+/*
+ * Messages left for users who aren't around, with .tell. Each message is
+ * PMed to its recipient the next time the bot sees them join one of its
+ * rooms, change their name to theirs or say something, whether in a room or
+ * in a PM to the bot.
+ *
+ * Each user can only have config.TellLimit messages waiting at once, and
+ * messages that haven't been delivered after config.TellDays are dropped.
+ * Waiting messages are saved in the bot's store, so they survive restarts.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// how many messages each user can have waiting if config.TellLimit
+	// isn't given
+	DefaultTellLimit = 5
+	// how long messages wait to be delivered if config.TellDays isn't given
+	DefaultTellDays = 30
+	// the longest message that can be left, in characters
+	MaxTellLength = 250
+
+	// the name waiting messages are saved under in the store
+	mailStore = "mail"
+)
+
+// A message left for a user with .tell.
+type Mail struct {
+	// the names of the sender and recipient, as given
+	From string
+	To   string
+	Text string
+	Sent time.Time
+}
+
+// The messages waiting to be delivered, keyed by the recipient's id, oldest
+// first.
+type savedMail struct {
+	Mail map[string][]Mail
+}
+
+// Loads the messages waiting to be delivered from the store. Should be used
+// before the bot connects.
+func (bot *Bot) LoadMail() error {
+	var saved savedMail
+	if err := bot.store.Load(mailStore, &saved); err != nil {
+		return err
+	}
+	bot.mail = saved.Mail
+	if bot.mail == nil {
+		bot.mail = make(map[string][]Mail)
+	}
+	return nil
+}
+
+// Saves the messages waiting to be delivered. Failures are only logged,
+// since the messages are still delivered unless the bot restarts.
+func (bot *Bot) saveMail() {
+	if err := bot.store.Save(mailStore, savedMail{bot.mail}); err != nil {
+		bot.Logger(LogCommands).Error("could not save mail", "error", err)
+	}
+}
+
+// Drops messages that have waited too long. Returns true if any were
+// dropped.
+func (bot *Bot) expireMail() bool {
+	days := bot.config.TellDays
+	if days <= 0 {
+		days = DefaultTellDays
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+
+	expired := false
+	for to, mail := range bot.mail {
+		kept := mail[:0]
+		for _, m := range mail {
+			if m.Sent.After(cutoff) {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) != len(mail) {
+			expired = true
+		}
+		if len(kept) == 0 {
+			delete(bot.mail, to)
+		} else {
+			bot.mail[to] = kept
+		}
+	}
+	return expired
+}
+
+// Returns the messages waiting that were left by the given user, by id.
+func (bot *Bot) mailFrom(userId string) []Mail {
+	sent := []Mail{}
+	for _, mail := range bot.mail {
+		for _, m := range mail {
+			if toId(m.From) == userId {
+				sent = append(sent, m)
+			}
+		}
+	}
+	return sent
+}
+
+// PMs any messages waiting for the user who sent, joined with or changed
+// their name to the one in the message.
+func (bot *Bot) DeliverMail(msg Message) {
+	if len(msg.args) == 0 {
+		return
+	}
+	switch msg.msgType {
+	case "c", "c:", "chat", "pm", "j", "J", "join", "n", "N", "name":
+	default:
+		return
+	}
+
+	_, name := splitUser(msg.args[0])
+	userId := toId(name)
+	mail, ok := bot.mail[userId]
+	if !ok || userId == toId(bot.config.Nick) {
+		return
+	}
+
+	delete(bot.mail, userId)
+	bot.expireMail()
+	bot.saveMail()
+	for _, m := range mail {
+		bot.QueueMessage(fmt.Sprintf("%s left you a message %s: %s",
+			m.From, formatAgo(time.Since(m.Sent)), m.Text), "user:"+userId)
+	}
+}
+
+// Leaves a message for a user, to be PMed to them the next time the bot sees
+// them.
+//
+// Syntax: .tell user, message
+func (bot *Bot) TellCommand(msg Message) {
+	_, from := splitUser(msg.args[0])
+	parts := strings.SplitN(msg.args[1], ",", 2)
+	if len(parts) < 2 || toId(parts[0]) == "" ||
+		strings.TrimSpace(parts[1]) == "" {
+		bot.QueueMessage(bot.config.CommandChar+"tell user, message",
+			msg.room)
+		return
+	}
+	to, text := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	limit := bot.config.TellLimit
+	if limit <= 0 {
+		limit = DefaultTellLimit
+	}
+	if bot.expireMail() {
+		bot.saveMail()
+	}
+	switch {
+	case toId(to) == toId(bot.config.Nick):
+		bot.QueueMessage("I'm right here.", msg.room)
+	case toId(to) == toId(from):
+		bot.QueueMessage("You can't leave a message for yourself.", msg.room)
+	case len([]rune(text)) > MaxTellLength:
+		bot.QueueMessage(fmt.Sprintf("Messages can be at most %d "+
+			"characters long.", MaxTellLength), msg.room)
+	case len(bot.mailFrom(toId(from))) >= limit:
+		bot.QueueMessage(fmt.Sprintf("You already have %d message%s "+
+			"waiting to be delivered. See %smailbox.", limit, plural(limit),
+			bot.config.CommandChar), msg.room)
+	default:
+		bot.mail[toId(to)] = append(bot.mail[toId(to)], Mail{
+			From: from,
+			To:   to,
+			Text: text,
+			Sent: time.Now(),
+		})
+		bot.saveMail()
+		bot.QueueMessage("I'll tell "+to+" when I next see them.", msg.room)
+	}
+}
+
+// Lists the messages the user has left that are still waiting to be
+// delivered, or cancels those left for a particular user. The list is PMed
+// so that the messages stay private.
+//
+// Syntax: .mailbox [cancel user]
+func (bot *Bot) MailboxCommand(msg Message) {
+	_, name := splitUser(msg.args[0])
+	userId := toId(name)
+	if bot.expireMail() {
+		bot.saveMail()
+	}
+
+	args := strings.Fields(msg.args[1])
+	if len(args) > 0 && args[0] == "cancel" {
+		to := toId(strings.Join(args[1:], ""))
+		if to == "" {
+			bot.QueueMessage(bot.config.CommandChar+"mailbox cancel user",
+				msg.room)
+			return
+		}
+		kept := []Mail{}
+		for _, m := range bot.mail[to] {
+			if toId(m.From) != userId {
+				kept = append(kept, m)
+			}
+		}
+		cancelled := len(bot.mail[to]) - len(kept)
+		if len(kept) == 0 {
+			delete(bot.mail, to)
+		} else {
+			bot.mail[to] = kept
+		}
+		if cancelled > 0 {
+			bot.saveMail()
+		}
+		bot.QueueMessage(fmt.Sprintf("Cancelled %d message%s to %s.",
+			cancelled, plural(cancelled), to), msg.room)
+		return
+	} else if len(args) > 0 {
+		bot.QueueMessage(bot.config.CommandChar+"mailbox [cancel user]",
+			msg.room)
+		return
+	}
+
+	sent := bot.mailFrom(userId)
+	if len(sent) == 0 {
+		bot.QueueMessage("You have no messages waiting to be delivered.",
+			"user:"+userId)
+		return
+	}
+	bot.QueueMessage(fmt.Sprintf("You have %d message%s waiting to be "+
+		"delivered:", len(sent), plural(len(sent))), "user:"+userId)
+	for _, m := range sent {
+		bot.QueueMessage(fmt.Sprintf("To %s, %s: %s", m.To,
+			formatAgo(time.Since(m.Sent)), m.Text), "user:"+userId)
+	}
+}
@@ -3,7 +3,19 @@
  *
  * Usage:
  *   go build [-o output]
- *   ./main [-log=filename] (or ./output, if -o was used)
+ *   ./main [-config=filename] [-init-config] [-log=filename] [-check-config]
+ *          [-console]
+ *   (or ./output, if -o was used)
+ *
+ * -console reads commands from the terminal while the bot runs, e.g. to
+ * make it say something. Type help at its prompt for a list, or see
+ * console.go.
+ *
+ * Settings can also be given as GOBOT_* environment variables, which take
+ * precedence over the config file. See configenv.go for details.
+ *
+ * If the config file lists several bots under bots, they are all run, and
+ * -console controls the first of them. See manager.go.
  *
  * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
  */
@@ -12,29 +24,156 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/TalkTakesTime/gobot"
+	"golang.org/x/term"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+const (
+	ExampleConfig = "./config-example.yaml"
 )
 
 var (
-	logFile = flag.String("log", "", "the file to store the output logs in")
+	configFile = flag.String("config", "./config.yaml",
+		"the config file to use")
+	initConfig = flag.Bool("init-config", false,
+		"create the config file from config-example.yaml, then exit")
+	logFile     = flag.String("log", "", "the file to store the output logs in")
+	checkConfig = flag.Bool("check-config", false,
+		"check the config file for problems, then exit")
+	useConsole = flag.Bool("console", false,
+		"read commands from the terminal while the bot runs")
 )
 
 func main() {
 	flag.Parse()
 
+	if *initConfig {
+		InitConfig(*configFile)
+	}
+	if *checkConfig {
+		CheckConfig(*configFile)
+	}
+
 	// if a logfile is given, send output there instead of stdout
 	if *logFile != "" {
 		file := ChangeLogFile(*logFile)
 		defer file.Close()
 	}
 
-	config := gobot.GetConfig()
-	config.GenerateURL()
+	configs := gobot.GetConfigs(*configFile)
+	for i := range configs {
+		configs[i].GenerateURL()
+	}
+
+	var console *gobot.Console
+	if *useConsole {
+		console = StartConsole()
+	}
 
-	psBot := gobot.CreateBot(config)
-	psBot.Start()
+	var err error
+	if len(configs) == 1 {
+		psBot := gobot.CreateBot(configs[0])
+		StartBot(psBot, console)
+		err = psBot.Run()
+	} else {
+		manager := gobot.NewManager(configs)
+		StartBot(manager.Bots()[0], console)
+		err = manager.Start()
+	}
+	slog.Error("stopped", "error", err)
+	Exit(1)
+}
+
+// Sets up the given bot as the one that logs for the rest of the program,
+// and attaches the console to it if there is one.
+func StartBot(psBot *gobot.Bot, console *gobot.Console) {
+	// anything else that logs, such as the standard log package, goes
+	// through the bot's logger too
+	slog.SetDefault(psBot.Logger(gobot.LogBot))
+	if console != nil {
+		psBot.AttachConsole(console)
+		// only once the bots have been created, since anything fatal
+		// while creating them exits without restoring the terminal
+		MakeTerminalRaw()
+		go RunConsole(console)
+	}
+}
+
+// The state of the terminal before the console put it into raw mode, so
+// that it can be restored, and to make sure it is only restored once.
+var (
+	terminalState   *term.State
+	terminalRestore sync.Once
+)
+
+// Puts the terminal into raw mode for the console, if stdin is a terminal.
+// From then on the program should only exit through Exit, which restores it.
+func MakeTerminalRaw() {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Fatalf("could not start the console: %s", err)
+	}
+	terminalState = state
+
+	// the terminal has to be restored if the process is killed, too
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		Exit(1)
+	}()
+}
+
+// Restores the terminal if the console put it into raw mode.
+func RestoreTerminal() {
+	terminalRestore.Do(func() {
+		if terminalState != nil {
+			term.Restore(int(os.Stdin.Fd()), terminalState)
+		}
+	})
+}
+
+// Restores the terminal, then exits with the given status.
+func Exit(code int) {
+	RestoreTerminal()
+	os.Exit(code)
+}
+
+// Creates the operator console on stdin and stdout. Logs are shown in the
+// console unless -log was given. The terminal is put into raw mode later,
+// by MakeTerminalRaw.
+func StartConsole() *gobot.Console {
+	console := gobot.NewConsole(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout})
+	if *logFile == "" {
+		gobot.LogOutput = console
+	}
+	return console
+}
+
+// Runs the console until it is closed or quit is used, then stops the bot.
+func RunConsole(console *gobot.Console) {
+	err := console.Run()
+	RestoreTerminal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "console: %s\n", err)
+		Exit(1)
+	}
+	Exit(0)
 }
 
 // Changes logging from stdout to the given file. If the file doesn't
@@ -48,6 +187,43 @@ func ChangeLogFile(filename string) *os.File {
 	}
 
 	log.SetOutput(file)
+	gobot.LogOutput = file
 	log.Println(">>> BEGIN LOGGING <<<")
 	return file
 }
+
+// Checks the given config file for problems and exits, with a non-zero
+// status if any were found.
+func CheckConfig(filename string) {
+	configs, err := gobot.ReadConfigs(filename)
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		// GOBOT_ variables shared by several bots are warned about by each
+		for _, p := range config.Warnings {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				fmt.Fprintf(os.Stderr, "%s: warning: %s\n", filename, p)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: OK\n", filename)
+	os.Exit(0)
+}
+
+// Creates the given config file from the example config and exits. Nothing
+// is done if the file already exists.
+func InitConfig(filename string) {
+	if err := gobot.InitConfig(filename, ExampleConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Created %s from %s. Edit it to suit your needs, then run "+
+		"the bot again.\n", filename, ExampleConfig)
+	os.Exit(0)
+}
@@ -0,0 +1,136 @@
+/*
+ * Running several bots in one process, e.g. one on main and another on a
+ * test server, from a config file that lists them under bots (see
+ * ParseConfigs and config-example.yaml). Each bot has its own connection,
+ * rooms, store, commands and so on, exactly as if it were run on its own.
+ *
+ * What the bots share is the HTTP server, which listens on the hookport
+ * given outside bots. Each bot's pages are served under its name, e.g.
+ *   /main/admin/   /test/api/rooms   /main/metrics
+ * so links to them, such as chat log links, have the name added to the
+ * bot's publicurl (see Bot.PublicURL).
+ * and GitHub webhooks sent to /postreceive are handed to every bot with
+ * enablehooks set, each of which checks them against its own hooksecret and
+ * announces them in its own hookrooms. A webhook can also be sent to a
+ * single bot, e.g. at /test/postreceive.
+ *
+ * If one bot stops, e.g. because its connection was lost, the reason is
+ * logged and it reconnects (see Bot.Run) while the others keep running.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Runs several bots at once, sharing an HTTP server.
+type Manager struct {
+	bots    []*Bot
+	httpMux *http.ServeMux
+	// the port the shared HTTP server listens on
+	port int
+}
+
+// Creates a bot for each of the given configs, as CreateBot does, and a
+// manager to run them.
+func NewManager(configs []Config) *Manager {
+	m := &Manager{httpMux: http.NewServeMux()}
+	for _, conf := range configs {
+		bot := createBot(conf, true)
+		m.bots = append(m.bots, bot)
+		m.port = conf.HookPort
+
+		prefix := "/" + conf.Name
+		m.httpMux.Handle(prefix+"/", http.StripPrefix(prefix, bot.httpMux))
+	}
+	m.httpMux.HandleFunc(HookPath, m.ReceiveHook)
+	return m
+}
+
+// Returns the bots being run, in the order they were given.
+func (m *Manager) Bots() []*Bot {
+	return m.bots
+}
+
+// Returns the bot with the given name, or nil if there isn't one.
+func (m *Manager) Bot(name string) *Bot {
+	for _, bot := range m.bots {
+		if bot.Config().Name == name {
+			return bot
+		}
+	}
+	return nil
+}
+
+// Starts every bot, along with the shared HTTP server if any of them need
+// it. Runs until the process exits, or returns an error straight away if a
+// bot or the HTTP server can't be set up.
+func (m *Manager) Start() error {
+	needsHTTP := false
+	for _, bot := range m.bots {
+		conf := bot.Config()
+		needsHTTP = needsHTTP || conf.NeedsHTTP()
+		bot.Logger(LogBot).Info("starting", "server", conf.Server,
+			"nick", conf.Nick)
+		if err := bot.SetUp(); err != nil {
+			return fmt.Errorf("%s: %s", conf.Name, err)
+		}
+	}
+	if needsHTTP {
+		addr := ":" + strconv.Itoa(m.port)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		m.bots[0].Logger(LogHTTP).Info("listening for every bot",
+			"addr", addr)
+		go func() {
+			err := http.Serve(listener, m.httpMux)
+			m.bots[0].Logger(LogHTTP).Error("shared HTTP server stopped",
+				"error", err)
+		}()
+	}
+
+	for _, bot := range m.bots {
+		// each bot has already been set up, so this never returns
+		go bot.Run()
+	}
+	select {}
+}
+
+// Hands a GitHub webhook to every bot with webhooks enabled. The reply is
+// that of the first bot to accept the webhook, or of the last to reject it
+// if none do.
+func (m *Manager) ReceiveHook(w http.ResponseWriter, req *http.Request) {
+	payload, ok := readPayload(w, req)
+	if !ok {
+		return
+	}
+
+	var reply *responseRecorder
+	for _, bot := range m.bots {
+		if !bot.Config().EnableHooks {
+			continue
+		}
+		rec := bot.receiveDelivery(req.Header, payload)
+		if reply == nil || !accepted(reply) {
+			reply = rec
+		}
+	}
+	if reply == nil {
+		http.Error(w, "no bot receives webhooks", http.StatusNotFound)
+		return
+	}
+	reply.writeTo(w)
+}
+
+// Returns true if the response to a webhook says it was accepted.
+func accepted(rec *responseRecorder) bool {
+	return rec.status >= 200 && rec.status < 300
+}
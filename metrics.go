@@ -0,0 +1,384 @@
+/*
+ * Metrics about the running bot, served at /metrics in the Prometheus text
+ * format when config.EnableMetrics is set. They're served by the bot's HTTP
+ * server, or by a server of their own if config.MetricsPort is given.
+ *
+ * The metrics are kept by hand rather than with the Prometheus client
+ * library, since the bot only needs counters, histograms and a couple of
+ * gauges and the format is simple.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the path metrics are served at
+	MetricsPath = "/metrics"
+
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var (
+	// buckets for things that normally take well under a second, such as
+	// commands, in seconds
+	latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1,
+		2.5, 5, 10}
+	// buckets for how long messages wait to be sent. Messages are sent every
+	// 0.5s, so a busy queue means waits of several seconds
+	queueBuckets = []float64{.01, .1, .5, 1, 2.5, 5, 10, 30, 60}
+	// buckets for logging in, which involves a request to the login server
+	loginBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// The bot's metrics.
+type Metrics struct {
+	// messages received from PS!, by room
+	MessagesReceived *MetricVec
+	// messages sent to PS!, by room
+	MessagesSent *MetricVec
+	// how long messages waited in the out queue before being sent
+	QueueWait *MetricVec
+	// commands used, by command
+	Commands *MetricVec
+	// how long commands took to run, by command
+	CommandDuration *MetricVec
+	// warnings and errors logged, by subsystem and level
+	Errors *MetricVec
+	// how long logging in took, from the challenge to the bot's name being
+	// set
+	LoginDuration *MetricVec
+	// GitHub webhook deliveries, by event and the status they were given
+	WebhookDeliveries *MetricVec
+	// events sent to outgoing webhooks, by event and whether they were
+	// delivered, failed or dropped
+	OutHookDeliveries *MetricVec
+
+	// everything to be served, in order
+	metrics []metricWriter
+}
+
+// A metric that can be written in the Prometheus text format.
+type metricWriter interface {
+	writeMetric(w io.Writer)
+}
+
+// Creates the bot's metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.MessagesReceived = m.add(NewMetricVec(metricCounter,
+		"gobot_messages_received_total",
+		"Messages received from the server, by room.", nil, "room"))
+	m.MessagesSent = m.add(NewMetricVec(metricCounter,
+		"gobot_messages_sent_total",
+		"Messages sent to the server, by room.", nil, "room"))
+	m.QueueWait = m.add(NewMetricVec(metricHistogram,
+		"gobot_queue_wait_seconds",
+		"How long messages waited in the out queue before being sent.",
+		queueBuckets))
+	m.Commands = m.add(NewMetricVec(metricCounter,
+		"gobot_commands_total", "Commands used, by command.", nil,
+		"command"))
+	m.CommandDuration = m.add(NewMetricVec(metricHistogram,
+		"gobot_command_duration_seconds",
+		"How long commands took to run, by command.", latencyBuckets,
+		"command"))
+	m.Errors = m.add(NewMetricVec(metricCounter, "gobot_errors_total",
+		"Warnings and errors logged, by subsystem and level.", nil,
+		"subsystem", "level"))
+	m.LoginDuration = m.add(NewMetricVec(metricHistogram,
+		"gobot_login_duration_seconds",
+		"How long logging in to the server took.", loginBuckets))
+	m.WebhookDeliveries = m.add(NewMetricVec(metricCounter,
+		"gobot_webhook_deliveries_total",
+		"GitHub webhook deliveries, by event and response status.", nil,
+		"event", "status"))
+	m.OutHookDeliveries = m.add(NewMetricVec(metricCounter,
+		"gobot_outhook_deliveries_total",
+		"Events sent to outgoing webhooks, by event and result.", nil,
+		"event", "result"))
+	return m
+}
+
+// Adds a metric to those served, returning it.
+func (m *Metrics) add(metric *MetricVec) *MetricVec {
+	m.metrics = append(m.metrics, metric)
+	return metric
+}
+
+// Adds a gauge whose value is found by calling f whenever the metrics are
+// served.
+func (m *Metrics) AddGaugeFunc(name, help string, f func() float64) {
+	m.metrics = append(m.metrics, &gaugeFunc{name, help, f})
+}
+
+// Writes every metric in the Prometheus text format.
+func (m *Metrics) WriteMetrics(w io.Writer) {
+	for _, metric := range m.metrics {
+		metric.writeMetric(w)
+	}
+}
+
+// Serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteMetrics(w)
+}
+
+// A metric with a value for each combination of its labels: a counter, a
+// gauge or a histogram.
+type MetricVec struct {
+	kind    string
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// The value of a metric for one combination of labels.
+type metricSeries struct {
+	labels []string
+	// the value of a counter or gauge, or the sum of a histogram
+	value float64
+	// for histograms, the number of observations, and the number in each
+	// bucket (not including those in smaller buckets)
+	count   uint64
+	buckets []uint64
+}
+
+// Creates a metric of the given kind with the given labels. buckets are the
+// upper bounds of a histogram's buckets, in increasing order, and are
+// ignored for other kinds.
+func NewMetricVec(kind, name, help string, buckets []float64,
+	labels ...string) *MetricVec {
+	return &MetricVec{
+		kind:    kind,
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+// Returns the series for the given label values, creating it if needed.
+// Should be used with m.mu held.
+func (m *MetricVec) get(values []string) *metricSeries {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s has %d labels, not %d", m.name, len(m.labels),
+			len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), values...)}
+		if m.kind == metricHistogram {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Adds 1 to a counter or gauge.
+func (m *MetricVec) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+// Adds v to a counter or gauge.
+func (m *MetricVec) Add(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value += v
+}
+
+// Sets a gauge to v.
+func (m *MetricVec) Set(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value = v
+}
+
+// Records an observation in a histogram.
+func (m *MetricVec) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	s.value += v
+	s.count++
+	if i := sort.SearchFloat64s(m.buckets, v); i < len(m.buckets) {
+		s.buckets[i]++
+	}
+}
+
+// Records the time since start in a histogram, in seconds.
+func (m *MetricVec) Since(start time.Time, values ...string) {
+	m.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (m *MetricVec) writeMetric(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name,
+		escapeHelp(m.help), m.name, m.kind)
+	if len(m.labels) == 0 && len(m.series) == 0 && m.kind != metricHistogram {
+		// a metric without labels is always there, even before it's used
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labels)
+		if m.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels,
+				formatValue(s.value))
+			continue
+		}
+
+		// buckets have an extra label, le, for their upper bound
+		names := append(append([]string(nil), m.labels...), "le")
+		values := append(append([]string(nil), s.labels...), "")
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.buckets[i]
+			values[len(values)-1] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values),
+			s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+// A gauge whose value is found when it is served.
+type gaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+func (g *gaugeFunc) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name,
+		escapeHelp(g.help), g.name, g.name, formatValue(g.f()))
+}
+
+// Formats labels as {name="value",...}, or "" if there are none.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n",
+			`\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Formats a value as Prometheus expects.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// Returns the label used for a room in metrics. PMs are counted together so
+// that there isn't a series for every user who PMs the bot, and so are
+// hidden rooms, which also keeps battles and groupchats from adding a series
+// each and the names of hidden rooms off the unauthenticated /metrics.
+func (bot *Bot) metricRoom(room string) string {
+	switch {
+	case room == "":
+		return "global"
+	case strings.HasPrefix(room, "user:"):
+		return "pm"
+	case bot.HiddenRoom(room):
+		return "hidden"
+	}
+	return room
+}
+
+// Sets up the bot's metrics, including gauges for its queues. Warnings and
+// errors are counted by `Bot.errorLogged`.
+func (bot *Bot) CreateMetrics() {
+	bot.metrics = NewMetrics()
+	bot.metrics.AddGaugeFunc("gobot_out_queue_length",
+		"Messages waiting to be sent.", func() float64 {
+			return float64(len(bot.outQueue))
+		})
+	bot.metrics.AddGaugeFunc("gobot_in_queue_length",
+		"Messages received but not yet handled.", func() float64 {
+			return float64(len(bot.inQueue))
+		})
+	bot.metrics.AddGaugeFunc("gobot_connected",
+		"Whether the bot is connected to the server.", func() float64 {
+			bot.connMu.Lock()
+			defer bot.connMu.Unlock()
+			if bot.conn.connected {
+				return 1
+			}
+			return 0
+		})
+}
+
+// Serves the bot's metrics, either from its HTTP server or, if
+// config.MetricsPort is set, from a server of their own. Should be used
+// before the HTTP server is started. Returns an error if config.MetricsPort
+// is already in use.
+func (bot *Bot) StartMetrics() error {
+	if bot.config.MetricsPort == 0 {
+		bot.HandleHTTP(MetricsPath, bot.metrics)
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, bot.metrics)
+	addr := ":" + strconv.Itoa(bot.config.MetricsPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	bot.Logger(LogHTTP).Info("serving metrics", "addr", addr)
+	go func() {
+		err := http.Serve(listener, mux)
+		bot.Stop(fmt.Errorf("metrics server stopped: %s", err))
+	}()
+	return nil
+}
@@ -0,0 +1,332 @@
+/*
+ * Outgoing webhooks, which forward things that happen in chat to other
+ * services as JSON, so that they can react to the bot without being written
+ * in Go. Each hook in config.OutHooks has a URL and the events it wants:
+ *   mention  a message that mentions the bot
+ *   message  any message, or those matching the hook's regular expression
+ *   join     a user joining a room
+ *   command  a command being used
+ * along with optional filters on the rooms, users and commands involved.
+ *
+ * Events are POSTed as JSON, e.g.
+ *   {"event": "mention", "time": "2015-06-01T12:00:00Z", "room": "techcode",
+ *    "user": "Name", "message": "hi gobot"}
+ * with the headers X-Gobot-Event, X-Gobot-Delivery (a number that is unique
+ * until the bot restarts) and, if the hook has a secret, X-Gobot-Signature,
+ * which is sha256= followed by the hex HMAC-SHA256 of the body, as GitHub
+ * does for its webhooks.
+ *
+ * Deliveries that fail because of a network error or a 5xx or 429 response
+ * are retried a few times, waiting twice as long each time. Each hook sends
+ * its events in order, and drops new ones if it falls too far behind.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OutHookMention = "mention"
+	OutHookMessage = "message"
+	OutHookJoin    = "join"
+	OutHookCommand = "command"
+
+	// how many times a failed delivery is retried if the hook doesn't say
+	DefaultOutHookRetries = 3
+
+	// how many events can wait for each hook before new ones are dropped
+	outHookQueueSize = 100
+	// how long a hook's URL is given to respond
+	outHookTimeout = 10 * time.Second
+	// how long to wait before the first retry. Each retry waits twice as
+	// long as the last
+	outHookBackoff = time.Second
+)
+
+var (
+	OutHookEvents = []string{OutHookMention, OutHookMessage, OutHookJoin,
+		OutHookCommand}
+)
+
+// The settings for an outgoing webhook, as given in config.yaml.
+type OutHookConfig struct {
+	// The URL events are POSTed to
+	URL string
+	// The events to send: mention, message, join and command. Defaults to
+	// all of them
+	Events []string
+	// Only send events from these rooms, as ids. Defaults to all rooms. PMs
+	// are in the room user:name
+	Rooms []string
+	// Only send events involving these users, as ids
+	Users []string
+	// For message events, only send messages matching this regular
+	// expression
+	Match string
+	// For command events, only send these commands
+	Commands []string
+	// The secret used to sign events, if any
+	Secret string
+	// How many times to retry failed deliveries. Defaults to 3; use -1 to
+	// never retry
+	Retries int
+}
+
+// An event as sent to outgoing webhooks.
+type OutHookEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Command string    `json:"command,omitempty"`
+	Args    string    `json:"args,omitempty"`
+}
+
+// The bot's outgoing webhooks.
+type OutHooks struct {
+	hooks   []*outHook
+	mention *regexp.Regexp
+}
+
+// A single outgoing webhook, with the queue of events waiting to be sent to
+// it.
+type outHook struct {
+	conf    OutHookConfig
+	match   *regexp.Regexp
+	queue   chan OutHookEvent
+	client  *http.Client
+	log     *slog.Logger
+	metrics *Metrics
+}
+
+// for numbering deliveries
+var outHookSeq int64
+
+// Creates the outgoing webhooks given in config. nick is the bot's nick,
+// for spotting mentions. Problems sending events are reported to logger, and
+// deliveries are counted in metrics.
+func NewOutHooks(confs []OutHookConfig, nick string, logger *slog.Logger,
+	metrics *Metrics) (*OutHooks, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+	mention, err := regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(nick) +
+		`($|\W)`)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &OutHooks{mention: mention}
+	for i, conf := range confs {
+		hook := &outHook{
+			conf:    conf,
+			queue:   make(chan OutHookEvent, outHookQueueSize),
+			client:  &http.Client{Timeout: outHookTimeout},
+			log:     logger.With("hook", i, "url", conf.URL),
+			metrics: metrics,
+		}
+		if conf.Match != "" {
+			if hook.match, err = regexp.Compile(conf.Match); err != nil {
+				return nil, fmt.Errorf("outhooks.%d.match: %s", i, err)
+			}
+		}
+		if len(hook.conf.Events) == 0 {
+			hook.conf.Events = OutHookEvents
+		}
+		h.hooks = append(h.hooks, hook)
+	}
+	return h, nil
+}
+
+// Starts sending events, each hook in its own goroutine.
+func (h *OutHooks) Start() {
+	for _, hook := range h.hooks {
+		go hook.run()
+	}
+}
+
+// Queues an event for every hook that wants it.
+func (h *OutHooks) Send(e OutHookEvent) {
+	for _, hook := range h.hooks {
+		if !hook.wants(e) {
+			continue
+		}
+		select {
+		case hook.queue <- e:
+		default:
+			hook.log.Warn("dropped event, too many waiting", "event", e.Event)
+			hook.metrics.OutHookDeliveries.Inc(e.Event, "dropped")
+		}
+	}
+}
+
+// Returns true if the hook should be sent the given event.
+func (hook *outHook) wants(e OutHookEvent) bool {
+	conf := hook.conf
+	switch {
+	case !contains(conf.Events, e.Event):
+		return false
+	case len(conf.Rooms) > 0 && !contains(conf.Rooms, e.Room):
+		return false
+	case len(conf.Users) > 0 && !contains(conf.Users, toId(e.User)):
+		return false
+	case e.Event == OutHookMessage && hook.match != nil &&
+		!hook.match.MatchString(e.Message):
+		return false
+	case e.Event == OutHookCommand && len(conf.Commands) > 0 &&
+		!contains(conf.Commands, e.Command):
+		return false
+	}
+	return true
+}
+
+// Sends the hook's events as they are queued. Never returns.
+func (hook *outHook) run() {
+	for e := range hook.queue {
+		if err := hook.deliver(e); err != nil {
+			hook.log.Error("could not deliver event", "event", e.Event,
+				"error", err)
+			hook.metrics.OutHookDeliveries.Inc(e.Event, "failed")
+		} else {
+			hook.metrics.OutHookDeliveries.Inc(e.Event, "ok")
+		}
+	}
+}
+
+// Delivers an event, retrying if it fails in a way that might not happen
+// next time.
+func (hook *outHook) deliver(e OutHookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	id := strconv.FormatInt(atomic.AddInt64(&outHookSeq, 1), 10)
+
+	retries := hook.conf.Retries
+	if retries == 0 {
+		retries = DefaultOutHookRetries
+	}
+	wait := outHookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := hook.post(e.Event, id, body)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+		hook.log.Warn("delivery failed, retrying", "event", e.Event,
+			"delivery", id, "error", err, "in", wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Makes a single attempt at delivering an event. Returns whether it is worth
+// trying again if it fails.
+func (hook *outHook) post(event, id string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", hook.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gobot")
+	req.Header.Set("X-Gobot-Event", event)
+	req.Header.Set("X-Gobot-Delivery", id)
+	if hook.conf.Secret != "" {
+		req.Header.Set("X-Gobot-Signature", SignOutHook(hook.conf.Secret,
+			body))
+	}
+
+	res, err := hook.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// the body is read so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("got %s", res.Status)
+	}
+	return false, fmt.Errorf("got %s", res.Status)
+}
+
+// Returns the signature for an event's body, as given in X-Gobot-Signature.
+func SignOutHook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Creates the bot's outgoing webhooks, if any are given in the config.
+func (bot *Bot) CreateOutHooks() (*OutHooks, error) {
+	if len(bot.config.OutHooks) == 0 {
+		return nil, nil
+	}
+	return NewOutHooks(bot.config.OutHooks, bot.config.Nick,
+		bot.Logger(LogHooks), bot.metrics)
+}
+
+// Sends a message received from PS! to the outgoing webhooks, if it is one
+// they might want: a chat message, a PM or a join.
+func (bot *Bot) SendToOutHooks(msg Message) {
+	if len(msg.args) == 0 {
+		return
+	}
+	e := OutHookEvent{Time: time.Now(), Room: targetId(msg.room)}
+	_, e.User = splitUser(msg.args[0])
+	switch msg.msgType {
+	case "c", "c:", "chat", "pm":
+		if len(msg.args) < 2 || toId(e.User) == toId(bot.config.Nick) {
+			return
+		}
+		e.Message = msg.args[1]
+		if bot.outhooks.mention.MatchString(e.Message) {
+			e.Event = OutHookMention
+			bot.outhooks.Send(e)
+		}
+		e.Event = OutHookMessage
+	case "j", "J", "join":
+		e.Event = OutHookJoin
+	default:
+		return
+	}
+	bot.outhooks.Send(e)
+}
+
+// Sends a command that has been used to the outgoing webhooks. msg should be
+// as given to the command.
+func (bot *Bot) SendCommandToOutHooks(msg Message) {
+	_, user := splitUser(msg.args[0])
+	bot.outhooks.Send(OutHookEvent{
+		Event:   OutHookCommand,
+		Time:    time.Now(),
+		Room:    targetId(msg.room),
+		User:    user,
+		Command: msg.args[2],
+		Args:    strings.TrimSpace(msg.args[1]),
+	})
+}
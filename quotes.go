@@ -0,0 +1,462 @@
+/*
+ * A quote database for the bot's rooms. Each room has its own quotes,
+ * numbered in the order they were added, and remembers who added each one.
+ * Quotes are saved in the bot's store.
+ *   .addquote text         add a quote. Needs config.QuoteRank in the room
+ *   .quote                 say a random quote
+ *   .quote id              say the quote with that number
+ *   .quote words           say a random quote containing all of the words
+ *   .delquote id           remove a quote. Only its adder, owners and users
+ *                          of at least config.QuoteDeleteRank can
+ *   .quotes                say how many quotes the room has, with a link to
+ *                          them if the quote page is enabled
+ * In PMs, the room is given first, e.g. ".quote techcode, words".
+ *
+ * The quotes of rooms that are hidden (see HiddenRoom) can only be read by
+ * users in them, and aren't shown on the quote page.
+ *
+ * When config.EnableQuotePage is set, each room's quotes are served as an
+ * HTML page at /quotes/room, with a list of the rooms at /quotes/.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"html/template"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QuotePath = "/quotes/"
+
+	// the rank needed to add quotes if config.QuoteRank isn't given
+	DefaultQuoteRank = "+"
+	// the rank needed to remove other users' quotes if
+	// config.QuoteDeleteRank isn't given
+	DefaultQuoteDeleteRank = "%"
+	// the longest quote that can be added, in characters
+	MaxQuoteLength = 250
+
+	// the name quotes are saved under in the store
+	quoteStore = "quotes"
+)
+
+// A quote, as added with .addquote.
+type Quote struct {
+	ID   int
+	Text string
+	// the name of the user who added it
+	AddedBy string
+	Added   time.Time
+}
+
+// The quotes of every room, keyed by room id. Safe to use from several
+// goroutines.
+type QuoteBook struct {
+	mu    sync.Mutex
+	rooms map[string]*quoteRoom
+	store *Store
+}
+
+// A single room's quotes.
+type quoteRoom struct {
+	// the id the next quote added is given, so that the ids of removed
+	// quotes aren't reused
+	NextID int
+	Quotes []Quote
+}
+
+// The quotes as they are saved.
+type savedQuotes struct {
+	Rooms map[string]*quoteRoom
+}
+
+// Creates a quote book, loading any quotes saved in store.
+func NewQuoteBook(store *Store) (*QuoteBook, error) {
+	var saved savedQuotes
+	if err := store.Load(quoteStore, &saved); err != nil {
+		return nil, err
+	}
+	if saved.Rooms == nil {
+		saved.Rooms = make(map[string]*quoteRoom)
+	}
+	return &QuoteBook{rooms: saved.Rooms, store: store}, nil
+}
+
+// Creates the bot's quote book, and serves the quote page on the bot's HTTP
+// server if it is enabled.
+func (bot *Bot) CreateQuoteBook() (*QuoteBook, error) {
+	if bot.config.EnableQuotePage {
+		bot.HandleHTTP(QuotePath, http.HandlerFunc(bot.ServeQuotes))
+	}
+	return NewQuoteBook(bot.store)
+}
+
+// Saves the quotes. The lock must be held.
+func (b *QuoteBook) save() error {
+	return b.store.Save(quoteStore, savedQuotes{Rooms: b.rooms})
+}
+
+// Adds a quote to a room, returning it with its id.
+func (b *QuoteBook) Add(room, text, addedBy string) (Quote, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[room]
+	if !ok {
+		r = &quoteRoom{NextID: 1}
+		b.rooms[room] = r
+	}
+	q := Quote{ID: r.NextID, Text: text, AddedBy: addedBy, Added: time.Now()}
+	r.NextID++
+	r.Quotes = append(r.Quotes, q)
+	return q, b.save()
+}
+
+// Returns the quote in a room with the given id, if there is one.
+func (b *QuoteBook) Get(room string, id int) (Quote, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.rooms[room]; ok {
+		for _, q := range r.Quotes {
+			if q.ID == id {
+				return q, true
+			}
+		}
+	}
+	return Quote{}, false
+}
+
+// Returns the quotes in a room that contain every word of the query,
+// ignoring case, in the order they were added. An empty query matches every
+// quote.
+func (b *QuoteBook) Search(room, query string) []Quote {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	words := strings.Fields(strings.ToLower(query))
+	matches := []Quote{}
+	r, ok := b.rooms[room]
+	if !ok {
+		return matches
+	}
+	for _, q := range r.Quotes {
+		text := strings.ToLower(q.Text)
+		match := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				match = false
+				break
+			}
+		}
+		if match {
+			matches = append(matches, q)
+		}
+	}
+	return matches
+}
+
+// Removes the quote in a room with the given id, returning it. Returns false
+// if there is no such quote.
+func (b *QuoteBook) Delete(room string, id int) (Quote, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[room]
+	if !ok {
+		return Quote{}, false, nil
+	}
+	for i, q := range r.Quotes {
+		if q.ID == id {
+			r.Quotes = append(r.Quotes[:i], r.Quotes[i+1:]...)
+			return q, true, b.save()
+		}
+	}
+	return Quote{}, false, nil
+}
+
+// Returns the rooms that have quotes, sorted.
+func (b *QuoteBook) Rooms() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rooms := []string{}
+	for room, r := range b.rooms {
+		if len(r.Quotes) > 0 {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Returns the room whose quotes a message is about, and the rest of its
+// args. In PMs the room is given first, followed by a comma. Replies and
+// returns false if the room isn't given, or if it is hidden from the user.
+func (bot *Bot) quoteRoom(msg Message, usage string) (string, string, bool) {
+	room, args := msg.room, msg.args[1]
+	if strings.HasPrefix(room, "user:") {
+		parts := strings.SplitN(args, ",", 2)
+		room, args = toId(parts[0]), ""
+		if len(parts) == 2 {
+			args = parts[1]
+		}
+		if room == "" {
+			bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+			return "", "", false
+		}
+	} else if room == "" {
+		// messages without a room are from the lobby
+		room = "lobby"
+	}
+	if !bot.canUseQuotes(msg, room) {
+		return "", "", false
+	}
+	return room, strings.TrimSpace(args), true
+}
+
+// Returns true if the user who sent a message can use the quotes of the
+// given room, which they can't if it is hidden and they aren't in it.
+// Replies if not.
+func (bot *Bot) canUseQuotes(msg Message, room string) bool {
+	_, user := splitUser(msg.args[0])
+	if bot.HiddenRoom(room) && room != msg.room &&
+		!bot.UserInRoom(toId(user), room) {
+		bot.QueueMessage("You need to be in "+room+" to use its quotes.",
+			msg.room)
+		return false
+	}
+	return true
+}
+
+// Returns true if the user, as given in a message, is one of the bot's
+// owners or has at least the given rank in the room.
+func (bot *Bot) hasQuoteRank(user, room, minRank string) bool {
+	_, name := splitUser(user)
+	r, _ := bot.Room(room)
+	return bot.IsOwner(name) || RankAtLeast(r.Rank(toId(name)), minRank[0])
+}
+
+// Formats a quote for chat. The # at the start means that quotes can't be
+// used to make the bot run commands.
+func formatQuote(q Quote) string {
+	return fmt.Sprintf("#%d: %s (added by %s)", q.ID, q.Text, q.AddedBy)
+}
+
+// Adds a quote to a room.
+//
+// Syntax: .addquote [room,] text
+func (bot *Bot) AddQuoteCommand(msg Message) {
+	usage := "addquote text"
+	if strings.HasPrefix(msg.room, "user:") {
+		usage = "addquote room, text"
+	}
+	room, text, ok := bot.quoteRoom(msg, usage)
+	if !ok {
+		return
+	}
+	minRank := bot.config.QuoteRank
+	if minRank == "" {
+		minRank = DefaultQuoteRank
+	}
+	switch {
+	case text == "":
+		bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+		return
+	case !bot.hasQuoteRank(msg.args[0], room, minRank):
+		bot.QueueMessage("Only "+minRank+" and above can add quotes to "+
+			room+".", msg.room)
+		return
+	case len([]rune(text)) > MaxQuoteLength:
+		bot.QueueMessage(fmt.Sprintf("Quotes can be at most %d characters "+
+			"long.", MaxQuoteLength), msg.room)
+		return
+	}
+
+	_, user := splitUser(msg.args[0])
+	q, err := bot.quotes.Add(room, text, user)
+	if err != nil {
+		bot.Logger(LogCommands).Error("could not save quotes", "error", err)
+	}
+	bot.QueueMessage(fmt.Sprintf("Added quote #%d to %s.", q.ID, room),
+		msg.room)
+}
+
+// Says a quote: the one with the given id, a random one containing all of
+// the given words, or a random one if neither is given.
+//
+// Syntax: .quote [room,] [id|words]
+func (bot *Bot) QuoteCommand(msg Message) {
+	room, query, ok := bot.quoteRoom(msg, "quote room, [id|words]")
+	if !ok {
+		return
+	}
+
+	if id, err := strconv.Atoi(strings.TrimPrefix(query, "#")); err == nil {
+		if q, ok := bot.quotes.Get(room, id); ok {
+			bot.QueueMessage(formatQuote(q), msg.room)
+		} else {
+			bot.QueueMessage(fmt.Sprintf("%s has no quote #%d.", room, id),
+				msg.room)
+		}
+		return
+	}
+
+	matches := bot.quotes.Search(room, query)
+	switch {
+	case len(matches) == 0 && query == "":
+		bot.QueueMessage(room+" has no quotes yet.", msg.room)
+	case len(matches) == 0:
+		bot.QueueMessage("No quotes in "+room+" match "+query+".", msg.room)
+	case query != "" && len(matches) > 1:
+		bot.QueueMessage(fmt.Sprintf("%d matches; %s", len(matches),
+			formatQuote(matches[rand.Intn(len(matches))])), msg.room)
+	default:
+		bot.QueueMessage(formatQuote(matches[rand.Intn(len(matches))]),
+			msg.room)
+	}
+}
+
+// Removes a quote from a room. Users can remove the quotes they added, and
+// staff can remove any.
+//
+// Syntax: .delquote [room,] id
+func (bot *Bot) DeleteQuoteCommand(msg Message) {
+	usage := "delquote id"
+	if strings.HasPrefix(msg.room, "user:") {
+		usage = "delquote room, id"
+	}
+	room, arg, ok := bot.quoteRoom(msg, usage)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+	if err != nil {
+		bot.QueueMessage(bot.config.CommandChar+usage, msg.room)
+		return
+	}
+
+	q, ok := bot.quotes.Get(room, id)
+	if !ok {
+		bot.QueueMessage(fmt.Sprintf("%s has no quote #%d.", room, id),
+			msg.room)
+		return
+	}
+	_, user := splitUser(msg.args[0])
+	minRank := bot.config.QuoteDeleteRank
+	if minRank == "" {
+		minRank = DefaultQuoteDeleteRank
+	}
+	if toId(q.AddedBy) != toId(user) &&
+		!bot.hasQuoteRank(msg.args[0], room, minRank) {
+		bot.QueueMessage("Only the user who added a quote, and "+minRank+
+			" and above, can remove it.", msg.room)
+		return
+	}
+
+	if _, _, err := bot.quotes.Delete(room, id); err != nil {
+		bot.Logger(LogCommands).Error("could not save quotes", "error", err)
+	}
+	bot.QueueMessage(fmt.Sprintf("Removed quote #%d from %s.", id, room),
+		msg.room)
+}
+
+// Says how many quotes a room has, with a link to the quote page if there is
+// one.
+//
+// Syntax: .quotes [room]
+func (bot *Bot) QuotesCommand(msg Message) {
+	room := toId(msg.args[1])
+	switch {
+	case room == "" && strings.HasPrefix(msg.room, "user:"):
+		bot.QueueMessage(bot.config.CommandChar+"quotes room", msg.room)
+		return
+	case room == "" && msg.room == "":
+		room = "lobby"
+	case room == "":
+		room = msg.room
+	}
+	if !bot.canUseQuotes(msg, room) {
+		return
+	}
+
+	n := len(bot.quotes.Search(room, ""))
+	text := fmt.Sprintf("%s has %d quote%s.", room, n, plural(n))
+	if n > 0 && bot.config.EnableQuotePage && bot.config.PublicURL != "" &&
+		!bot.HiddenRoom(room) {
+		text += " See " + bot.PublicURL() + QuotePath + room
+	}
+	bot.QueueMessage(text, msg.room)
+}
+
+// Serves a room's quotes as an HTML page, or the list of rooms with quotes.
+// Hidden rooms aren't shown.
+func (bot *Bot) ServeQuotes(w http.ResponseWriter, req *http.Request) {
+	room := strings.TrimPrefix(req.URL.Path, QuotePath)
+	data := struct {
+		Room   string
+		Rooms  []string
+		Quotes []Quote
+	}{Room: room}
+
+	if room == "" {
+		for _, r := range bot.quotes.Rooms() {
+			if !bot.HiddenRoom(r) {
+				data.Rooms = append(data.Rooms, r)
+			}
+		}
+	} else {
+		data.Quotes = bot.quotes.Search(room, "")
+		if room != toId(room) || bot.HiddenRoom(room) ||
+			len(data.Quotes) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := quotesTemplate.Execute(w, data); err != nil {
+		bot.Logger(LogHTTP).Error("could not render quotes", "room", room,
+			"error", err)
+	}
+}
+
+var quotesTemplate = template.Must(template.New("quotes").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{with .Room}}{{.}} {{end}}quotes</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left;
+	vertical-align: top; }
+.meta { color: #7f7f7f; white-space: nowrap; }
+</style>
+</head>
+<body>
+{{if .Room}}<h1>Quotes from {{.Room}}</h1>
+<p><a href="./">All rooms</a></p>
+<table>
+<tr><th>#</th><th>Quote</th><th>Added by</th></tr>
+{{range .Quotes}}<tr><td>{{.ID}}</td><td>{{.Text}}</td>
+<td class="meta">{{.AddedBy}}, {{.Added.Format "2006-01-02"}}</td></tr>
+{{end}}</table>
+{{else}}<h1>Quotes</h1>
+<ul>
+{{range .Rooms}}<li><a href="{{.}}">{{.}}</a></li>
+{{else}}<li>No rooms have quotes yet.</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
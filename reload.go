@@ -0,0 +1,281 @@
+/*
+ * Reloading the bot's config while it is running, without reconnecting. The
+ * config is reloaded when the bot receives SIGHUP or an owner uses .reload.
+ *
+ * The new config is compared against the running one and only what has
+ * changed is applied: rooms are joined or left, templates are parsed again
+ * and the HTTP server is moved if its port changed. Settings that are only
+ * used when the bot starts, such as the server or the nick, are left as they
+ * are and reported as needing a restart.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Settings that can't be changed while the bot is running.
+var restartSettings = map[string]bool{
+	"nick":              true,
+	"pass":              true,
+	"passfile":          true,
+	"server":            true,
+	"port":              true,
+	"datadir":           true,
+	"chatlogs":          true,
+	"chatlogdir":        true,
+	"chatlogjson":       true,
+	"chatlogdays":       true,
+	"enablehooks":       true,
+	"enablehttp":        true,
+	"hooklogsize":       true,
+	"indexrepos":        true,
+	"gitrepodir":        true,
+	"gitremote":         true,
+	"gitrefresh":        true,
+	"shortener":         true,
+	"shortenerurl":      true,
+	"shortenerbase":     true,
+	"shortenerfallback": true,
+	"enablemetrics":     true,
+	"metricsport":       true,
+	"enablehealth":      true,
+	"enabledashboard":   true,
+	"enableapi":         true,
+	"seendays":          true,
+	"enablequotepage":   true,
+	"outhooks":          true,
+	"enableirc":         true,
+	"ircserver":         true,
+	"irctls":            true,
+	"ircnick":           true,
+	"ircpass":           true,
+	"ircpassfile":       true,
+	"ircchannels":       true,
+	"ircnicks":          true,
+	"name":              true,
+	"bots":              true,
+	"logformat":         true,
+	"logcolour":         true,
+}
+
+// Returns the names of the settings that differ between two configs, as they
+// are given in config.yaml. Rooms only count as changed if different rooms
+// are given, since the values are replaced with join times once the bot is
+// running.
+func (conf *Config) Diff(other *Config) []string {
+	a, b := reflect.ValueOf(conf).Elem(), reflect.ValueOf(other).Elem()
+	changed := []string{}
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Tag.Get("yaml") == "-" {
+			continue
+		}
+
+		var same bool
+		if field.Name == "Rooms" {
+			same = sameKeys(conf.Rooms, other.Rooms)
+		} else {
+			same = reflect.DeepEqual(a.Field(i).Interface(),
+				b.Field(i).Interface())
+		}
+		if !same {
+			changed = append(changed, strings.ToLower(field.Name))
+		}
+	}
+	return changed
+}
+
+// Returns true if both maps have the same keys.
+func sameKeys(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the setting with the given name in dst to its value in src.
+func copySetting(dst, src *Config, name string) {
+	match := func(field string) bool {
+		return strings.ToLower(field) == name
+	}
+	reflect.ValueOf(dst).Elem().FieldByNameFunc(match).Set(
+		reflect.ValueOf(src).Elem().FieldByNameFunc(match))
+}
+
+// Reads the config again from the file it was loaded from and applies it.
+// Returns a description of what changed. Nothing is applied if the new
+// config has any problems. Should only be used from the main loop.
+func (bot *Bot) Reload() (string, error) {
+	conf, err := ReadBotConfig(bot.config.File, bot.config.Instance)
+	if err != nil {
+		return "", err
+	}
+	bot.logConfigWarnings(conf)
+	conf.GenerateURL()
+	return bot.ApplyConfig(conf), nil
+}
+
+// Replaces the running config with the given one, applying whatever has
+// changed that can be changed without restarting. Returns a description of
+// what changed. Should only be used from the main loop.
+func (bot *Bot) ApplyConfig(conf Config) string {
+	old := bot.config
+	// rooms are compared with those in the file rather than those the bot is
+	// in, so that rooms joined or left with .join and .leave stay that way
+	old.Rooms = bot.configRooms
+	if bot.aliasesSaved {
+		// aliases changed while running take precedence over the file
+		conf.GitAliases = old.GitAliases
+	}
+	changed := old.Diff(&conf)
+	if len(changed) == 0 {
+		return "Nothing has changed."
+	}
+
+	applied, needRestart := []string{}, []string{}
+	for _, name := range changed {
+		// without a server of its own, the bot can only listen on a new
+		// port when it starts again
+		if restartSettings[name] ||
+			(name == "hookport" && bot.httpServer == nil) {
+			copySetting(&conf, &old, name)
+			needRestart = append(needRestart, name)
+		} else {
+			applied = append(applied, name)
+		}
+	}
+	conf.URL = old.URL
+
+	// rooms are joined and left below, which updates the config as it goes
+	joined, left := []string{}, []string{}
+	for room := range conf.Rooms {
+		if _, ok := old.Rooms[room]; !ok && !bot.InRoom(room) {
+			joined = append(joined, room)
+		}
+	}
+	for room := range old.Rooms {
+		if _, ok := conf.Rooms[room]; !ok && bot.InRoom(room) {
+			left = append(left, room)
+		}
+	}
+	sort.Strings(joined)
+	sort.Strings(left)
+	bot.configRooms = conf.Rooms
+	conf.Rooms = make(map[string]int64, len(bot.config.Rooms))
+	for room, joinTime := range bot.config.Rooms {
+		conf.Rooms[room] = joinTime
+	}
+
+	var problems []string
+	bot.configMu.Lock()
+	bot.config = conf
+	if contains(changed, "hooktemplates") || contains(changed,
+		"roomtemplates") {
+		oldTemplates := bot.templates
+		if err := bot.LoadTemplates(); err != nil {
+			bot.templates = oldTemplates
+			problems = append(problems, "could not load templates: "+
+				err.Error())
+		}
+	}
+	if contains(changed, "githubapi") || contains(changed, "githubtoken") {
+		bot.issues = bot.CreateIssueProvider()
+	}
+	bot.configMu.Unlock()
+	if contains(changed, "gitaliases") || contains(changed, "gitrepos") {
+		bot.ReindexRepos()
+	}
+	if contains(changed, "loglevel") || contains(changed, "loglevels") {
+		bot.logging.SetLevels(conf)
+	}
+
+	for _, room := range left {
+		bot.LeaveRoom(room)
+	}
+	for _, room := range joined {
+		bot.JoinRoom(room)
+	}
+	if len(joined) > 0 || len(left) > 0 {
+		bot.SaveRooms()
+	}
+
+	if contains(changed, "hookport") && bot.httpServer != nil {
+		if err := bot.listenHTTP(conf.HookPort); err != nil {
+			bot.configMu.Lock()
+			bot.config.HookPort = old.HookPort
+			bot.configMu.Unlock()
+			problems = append(problems, fmt.Sprintf("could not move the "+
+				"HTTP server to port %d: %s", conf.HookPort, err))
+			for i, name := range applied {
+				if name == "hookport" {
+					applied = append(applied[:i], applied[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	report := []string{}
+	if len(applied) > 0 {
+		report = append(report, "Applied: "+strings.Join(applied, ", ")+".")
+	}
+	if len(joined) > 0 {
+		report = append(report, "Joined: "+strings.Join(joined, ", ")+".")
+	}
+	if len(left) > 0 {
+		report = append(report, "Left: "+strings.Join(left, ", ")+".")
+	}
+	if len(needRestart) > 0 {
+		report = append(report, "Needs a restart: "+
+			strings.Join(needRestart, ", ")+".")
+	}
+	if len(problems) > 0 {
+		report = append(report, "Problems: "+strings.Join(problems, "; ")+
+			".")
+	}
+	return strings.Join(report, " ")
+}
+
+// Reloads the config and logs what happened. If room isn't "", the outcome
+// is also said there.
+func (bot *Bot) ReloadAndReport(room string) {
+	report, err := bot.Reload()
+	if err != nil {
+		bot.Logger(LogBot).Error("could not reload config", "error", err)
+		if configErr, ok := err.(*ConfigError); ok {
+			report = fmt.Sprintf("Could not reload the config: %d "+
+				"problem(s), see the log or use -check-config.",
+				len(configErr.Problems))
+		} else {
+			report = "Could not reload the config: " + err.Error()
+		}
+	} else {
+		bot.Logger(LogBot).Info("reloaded config", "changes", report)
+	}
+
+	if room != "" {
+		bot.QueueMessage(report, room)
+	}
+}
+
+// Reloads the bot's config. Owner only
+//
+// Syntax: .reload
+func (bot *Bot) ReloadCommand(msg Message) {
+	if !bot.IsOwner(msg.args[0]) {
+		return
+	}
+	bot.ReloadAndReport(msg.room)
+}
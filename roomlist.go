@@ -0,0 +1,220 @@
+/*
+ * Keeps track of which rooms the bot should be in. Owners can make the bot
+ * join and leave rooms with .join and .leave, and the rooms it is in are
+ * saved in the bot's store, so that it rejoins the same rooms after a
+ * restart. Once rooms have been saved they take precedence over the rooms in
+ * config.yaml.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// the name the room list is saved under in the store
+	roomStore = "rooms"
+)
+
+// The room list as it is saved.
+type savedRooms struct {
+	Rooms []string
+}
+
+// Replaces the rooms from the config with those saved in the store, if any
+// have been saved. Should be used before the bot connects.
+func (bot *Bot) LoadRooms() error {
+	var saved savedRooms
+	if err := bot.store.Load(roomStore, &saved); err != nil {
+		return err
+	}
+	if saved.Rooms == nil {
+		// nothing saved yet, so the config's rooms are used
+		return nil
+	}
+
+	rooms := make(map[string]int64, len(saved.Rooms))
+	for _, room := range saved.Rooms {
+		rooms[room] = 1
+	}
+	bot.configMu.Lock()
+	bot.config.Rooms = rooms
+	bot.configMu.Unlock()
+	return nil
+}
+
+// Saves the rooms the bot is in to the store. Failures are only logged, since
+// the bot is still in the right rooms until it restarts.
+func (bot *Bot) SaveRooms() {
+	if err := bot.store.Save(roomStore, savedRooms{
+		Rooms: bot.RoomList(),
+	}); err != nil {
+		bot.Logger(LogCommands).Error("could not save rooms", "error", err)
+	}
+}
+
+// Returns the ids of the rooms the bot is in, or is trying to join, in
+// alphabetical order.
+func (bot *Bot) RoomList() []string {
+	bot.configMu.RLock()
+	rooms := make([]string, 0, len(bot.config.Rooms))
+	for room := range bot.config.Rooms {
+		rooms = append(rooms, room)
+	}
+	bot.configMu.RUnlock()
+
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Returns true if the bot is in the given room, or is trying to join it.
+func (bot *Bot) InRoom(room string) bool {
+	bot.configMu.RLock()
+	defer bot.configMu.RUnlock()
+	_, ok := bot.config.Rooms[room]
+	return ok
+}
+
+// Handles the bot having joined a room, telling whoever asked it to join.
+func (bot *Bot) roomJoined(room string) {
+	if replyTo, ok := bot.pendingJoins[room]; ok {
+		delete(bot.pendingJoins, room)
+		bot.QueueMessage("Joined "+room+".", replyTo)
+	}
+}
+
+// Handles the bot having left a room without being asked to, e.g. because
+// the room was deleted. The room is forgotten, so that the bot doesn't try
+// to rejoin it.
+func (bot *Bot) roomLeft(room string) {
+	if !bot.InRoom(room) {
+		// left using LeaveRoom, so it has already been forgotten
+		return
+	}
+	bot.Logger(LogParser).Info("left room", "room", room)
+
+	bot.configMu.Lock()
+	delete(bot.config.Rooms, room)
+	bot.configMu.Unlock()
+	bot.SaveRooms()
+}
+
+// Handles a |noinit| message, which PS! sends when the bot can't join a room,
+// either because it doesn't exist or because the bot isn't allowed in. Rooms
+// that don't exist are forgotten, so that the bot doesn't keep trying to join
+// them, unless they are in config.yaml. Other failures, such as the room
+// needing the bot to log in first, may not last, so those rooms are kept.
+//
+// Syntax: |noinit|TYPE|MESSAGE, where TYPE is e.g. nonexistent or joinfailed
+func (bot *Bot) JoinFailed(msg Message) {
+	kind, reason := "", "the server refused"
+	if len(msg.args) > 0 {
+		kind = msg.args[0]
+	}
+	if len(msg.args) > 1 && msg.args[1] != "" {
+		reason = msg.args[1]
+	} else if kind != "" {
+		reason = kind
+	}
+	_, inConfig := bot.configRooms[msg.room]
+	forget := kind == "nonexistent" && !inConfig
+	bot.Logger(LogParser).Warn("could not join room", "room", msg.room,
+		"type", kind, "reason", reason, "forgotten", forget)
+
+	if replyTo, ok := bot.pendingJoins[msg.room]; ok {
+		delete(bot.pendingJoins, msg.room)
+		bot.QueueMessage("Could not join "+msg.room+": "+reason, replyTo)
+	}
+
+	if forget && bot.InRoom(msg.room) {
+		bot.configMu.Lock()
+		delete(bot.config.Rooms, msg.room)
+		bot.configMu.Unlock()
+		bot.SaveRooms()
+	}
+}
+
+// Makes the bot join a room, and remembers it for next time. Owner only
+//
+// Syntax: .join room
+func (bot *Bot) JoinCommand(msg Message) {
+	if !bot.IsOwner(msg.args[0]) {
+		return
+	}
+
+	room := toId(msg.args[1])
+	switch {
+	case room == "":
+		bot.QueueMessage(bot.config.CommandChar+"join room", msg.room)
+	case bot.InRoom(room):
+		bot.QueueMessage("Already in "+room+".", msg.room)
+	default:
+		bot.pendingJoins[room] = msg.room
+		bot.JoinRoom(room)
+		bot.SaveRooms()
+	}
+}
+
+// Makes the bot leave a room, and forgets it. If no room is given, the room
+// the command was used in is left. Owner only
+//
+// Syntax: .leave [room]
+func (bot *Bot) LeaveCommand(msg Message) {
+	if !bot.IsOwner(msg.args[0]) {
+		return
+	}
+
+	room := toId(msg.args[1])
+	if room == "" && !strings.HasPrefix(msg.room, "user:") {
+		room = msg.room
+	}
+	switch {
+	case room == "":
+		bot.QueueMessage(bot.config.CommandChar+"leave room", msg.room)
+	case !bot.InRoom(room):
+		bot.QueueMessage("Not in "+room+".", msg.room)
+	default:
+		if room != msg.room {
+			bot.QueueMessage("Left "+room+".", msg.room)
+		}
+		bot.LeaveRoom(room)
+		bot.SaveRooms()
+	}
+}
+
+// Lists the rooms the bot is in, along with their titles and how many users
+// are in them. Owner only
+//
+// Syntax: .rooms
+func (bot *Bot) RoomsCommand(msg Message) {
+	if !bot.IsOwner(msg.args[0]) {
+		return
+	}
+
+	rooms := bot.RoomList()
+	if len(rooms) == 0 {
+		bot.QueueMessage("Not in any rooms.", msg.room)
+		return
+	}
+
+	descriptions := make([]string, len(rooms))
+	for i, id := range rooms {
+		room, ok := bot.Room(id)
+		switch {
+		case !ok:
+			descriptions[i] = id + " (joining)"
+		case room.Title != "" && room.Title != id:
+			descriptions[i] = fmt.Sprintf("%s (%s, %d users)", id,
+				room.Title, len(room.Users))
+		default:
+			descriptions[i] = fmt.Sprintf("%s (%d users)", id,
+				len(room.Users))
+		}
+	}
+	bot.QueueMessage("Rooms: "+strings.Join(descriptions, ", "), msg.room)
+}
@@ -0,0 +1,214 @@
+/*
+ * Keeps track of the rooms the bot is in: their titles, the users in them and
+ * their ranks, including the bot's own rank, which determines whether it can
+ * use commands such as !htmlbox.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"strings"
+)
+
+const (
+	// room ranks on PS!, from lowest to highest
+	Ranks = " +%@*#&~"
+
+	// the rank the bot needs to use !htmlbox if config.HTMLRank isn't given
+	DefaultHTMLRank = "*"
+)
+
+// The state of a room the bot is in, as far as the bot can tell from the
+// messages PS! sends.
+type Room struct {
+	ID    string
+	Title string
+	// the users in the room, mapping their ids to their names, prefixed by
+	// their rank in the room, e.g. "@Name" or " Name"
+	Users map[string]string
+
+	// whether the server has told the bot it can't use !htmlbox in the room
+	// since its rank last changed
+	htmlDenied bool
+	// the plain text version of the last !htmlbox announcement, to send
+	// instead if the server refuses it
+	fallback []string
+}
+
+// Returns the rank of the user with the given id in the room, or ' ' if
+// they have no rank or aren't in the room.
+func (room *Room) Rank(userId string) byte {
+	if name, ok := room.Users[userId]; ok && name != "" {
+		return name[0]
+	}
+	return ' '
+}
+
+// Returns true if the first rank is at least as high as the second.
+func RankAtLeast(rank, min byte) bool {
+	return strings.IndexByte(Ranks, rank) >= strings.IndexByte(Ranks, min)
+}
+
+// Splits a user as given by PS!, such as "@Name" or "+Name@!", into their
+// rank and their name.
+func splitUser(user string) (byte, string) {
+	if user == "" {
+		return ' ', ""
+	}
+
+	rank, name := user[0], user[1:]
+	if strings.IndexByte(Ranks, rank) == -1 {
+		// not actually a rank, so it's part of the name
+		rank, name = ' ', user
+	}
+	// newer servers add the user's status after an @
+	if i := strings.Index(name, "@"); i != -1 {
+		name = name[:i]
+	}
+	return rank, name
+}
+
+// Updates the bot's record of the room the message was received in if the
+// message is one that changes it, such as a join or a leave.
+func (bot *Bot) UpdateRoom(msg Message) {
+	if strings.HasPrefix(msg.room, "user:") {
+		// PMs have no room to track
+		return
+	}
+
+	bot.roomsMu.Lock()
+	defer bot.roomsMu.Unlock()
+
+	room, ok := bot.rooms[msg.room]
+	if msg.msgType == "init" {
+		room = &Room{ID: msg.room, Users: make(map[string]string)}
+		bot.rooms[msg.room] = room
+		return
+	} else if !ok {
+		return
+	}
+
+	botId := toId(bot.config.Nick)
+	oldRank := room.Rank(botId)
+	switch msg.msgType {
+	case "deinit":
+		delete(bot.rooms, msg.room)
+	case "title":
+		room.Title = msg.args[0]
+	case "users":
+		// of the form "count,user1,user2,..."
+		users := strings.Split(msg.args[0], ",")
+		room.Users = make(map[string]string)
+		for _, user := range users[1:] {
+			rank, name := splitUser(user)
+			room.Users[toId(name)] = string(rank) + name
+		}
+	case "j", "J", "join":
+		rank, name := splitUser(msg.args[0])
+		room.Users[toId(name)] = string(rank) + name
+	case "l", "L", "leave":
+		_, name := splitUser(msg.args[0])
+		delete(room.Users, toId(name))
+	case "n", "N", "name":
+		// of the form "newname|oldid"
+		rank, name := splitUser(msg.args[0])
+		if len(msg.args) > 1 {
+			delete(room.Users, toId(msg.args[1]))
+		}
+		room.Users[toId(name)] = string(rank) + name
+	}
+
+	if room.Rank(botId) != oldRank {
+		// the bot's rank changed, so it's worth trying HTML again
+		room.htmlDenied = false
+	}
+}
+
+// Forgets the bot's record of every room, e.g. when it reconnects, since it
+// has to join them all again.
+func (bot *Bot) clearRooms() {
+	bot.roomsMu.Lock()
+	defer bot.roomsMu.Unlock()
+	bot.rooms = make(map[string]*Room)
+}
+
+// Returns a copy of the bot's record of the given room, and whether the bot
+// is in it.
+func (bot *Bot) Room(id string) (Room, bool) {
+	bot.roomsMu.RLock()
+	defer bot.roomsMu.RUnlock()
+
+	room, ok := bot.rooms[id]
+	if !ok {
+		return Room{}, false
+	}
+
+	roomCopy := *room
+	roomCopy.Users = make(map[string]string, len(room.Users))
+	for id, name := range room.Users {
+		roomCopy.Users[id] = name
+	}
+	roomCopy.fallback = nil
+	return roomCopy, true
+}
+
+// Returns true if the bot should be able to use !htmlbox in the given room.
+// If the bot doesn't know its rank in the room yet, it assumes it can.
+func (bot *Bot) CanUseHTML(room string) bool {
+	bot.roomsMu.RLock()
+	defer bot.roomsMu.RUnlock()
+
+	r, ok := bot.rooms[room]
+	if !ok || len(r.Users) == 0 {
+		return true
+	}
+
+	config := bot.Config()
+	minRank := config.HTMLRank
+	if minRank == "" {
+		minRank = DefaultHTMLRank
+	}
+	return !r.htmlDenied &&
+		RankAtLeast(r.Rank(toId(config.Nick)), minRank[0])
+}
+
+// Remembers the plain text version of an !htmlbox announcement, so that it
+// can be sent instead if the server refuses the !htmlbox.
+func (bot *Bot) setHTMLFallback(room string, fallback []string) {
+	bot.roomsMu.Lock()
+	defer bot.roomsMu.Unlock()
+
+	if r, ok := bot.rooms[room]; ok {
+		r.fallback = fallback
+	}
+}
+
+// Checks whether a message is the server refusing to let the bot use
+// !htmlbox. If it is, the bot stops using HTML in that room and sends the
+// plain text version of the refused announcement instead.
+func (bot *Bot) CheckHTMLDenied(msg Message) {
+	if len(msg.args) == 0 {
+		return
+	}
+	text := strings.ToLower(msg.args[0])
+	if !strings.Contains(text, "htmlbox") ||
+		!(strings.Contains(text, "access denied") ||
+			strings.Contains(text, "permission")) {
+		return
+	}
+
+	bot.roomsMu.Lock()
+	r, ok := bot.rooms[msg.room]
+	var fallback []string
+	if ok {
+		r.htmlDenied = true
+		fallback, r.fallback = r.fallback, nil
+	}
+	bot.roomsMu.Unlock()
+
+	for _, text := range fallback {
+		bot.QueueMessage(text, msg.room)
+	}
+}
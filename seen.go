@@ -0,0 +1,281 @@
+/*
+ * Tracking when users were last seen, for .seen. Every chat message, join,
+ * leave and rename in the bot's rooms is recorded as the user's latest
+ * sighting, which is saved in the bot's store every so often so that it
+ * survives restarts. Only what the user was doing is kept, not what they
+ * said, and PMs aren't tracked at all.
+ *
+ * Rooms in config.HiddenRooms, along with battles and groupchats, are kept
+ * private: if a user was last seen in one, .seen only says where, and what
+ * they were doing, to users who are in that room too. Anyone else is only
+ * told that it was in a hidden room.
+ *
+ * Sightings older than config.SeenDays are forgotten.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long sightings are kept for if config.SeenDays isn't given
+	DefaultSeenDays = 90
+
+	// the name sightings are saved under in the store
+	seenStore = "seen"
+	// how often sightings are saved, if there are new ones
+	seenSaveInterval = time.Minute
+)
+
+// What a user was doing when they were last seen.
+const (
+	SeenChat   = "chatting"
+	SeenJoin   = "joining"
+	SeenLeave  = "leaving"
+	SeenRename = "renaming"
+)
+
+// The last time a user was seen.
+type Sighting struct {
+	// the user's name, as they were last seen
+	Name   string
+	Time   time.Time
+	Room   string
+	Action string
+	// for renames, the name the user changed to or from
+	RenamedTo   string `json:",omitempty"`
+	RenamedFrom string `json:",omitempty"`
+}
+
+// Describes what the user was doing, e.g. "renaming to Name".
+func (s Sighting) Doing() string {
+	switch {
+	case s.RenamedTo != "":
+		return "renaming to " + s.RenamedTo
+	case s.RenamedFrom != "":
+		return "renaming from " + s.RenamedFrom
+	}
+	return s.Action
+}
+
+// The latest sighting of every user seen, keyed by their ids. Safe to use
+// from several goroutines.
+type SeenLog struct {
+	mu        sync.Mutex
+	sightings map[string]Sighting
+	// whether there are sightings that haven't been saved yet
+	dirty bool
+	// how long sightings are kept for
+	keep  time.Duration
+	store *Store
+	log   *slog.Logger
+}
+
+// The sightings as they are saved.
+type savedSightings struct {
+	Sightings map[string]Sighting
+}
+
+// Creates a log of sightings, loading any saved in store. Sightings are
+// forgotten after the given number of days.
+func NewSeenLog(store *Store, days int, logger *slog.Logger) (*SeenLog,
+	error) {
+	if days <= 0 {
+		days = DefaultSeenDays
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var saved savedSightings
+	if err := store.Load(seenStore, &saved); err != nil {
+		return nil, err
+	}
+	if saved.Sightings == nil {
+		saved.Sightings = make(map[string]Sighting)
+	}
+	return &SeenLog{
+		sightings: saved.Sightings,
+		keep:      time.Duration(days) * 24 * time.Hour,
+		store:     store,
+		log:       logger,
+	}, nil
+}
+
+// Creates the bot's log of sightings.
+func (bot *Bot) CreateSeenLog() (*SeenLog, error) {
+	return NewSeenLog(bot.store, bot.config.SeenDays,
+		bot.Logger(LogCommands))
+}
+
+// Saves new sightings every so often. Never returns.
+func (l *SeenLog) Start() {
+	for range time.Tick(seenSaveInterval) {
+		if err := l.Save(); err != nil {
+			l.log.Error("could not save sightings", "error", err)
+		}
+	}
+}
+
+// Records a sighting of a user.
+func (l *SeenLog) Add(s Sighting) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sightings[toId(s.Name)] = s
+	l.dirty = true
+}
+
+// Returns the latest sighting of the user with the given id, if there is
+// one.
+func (l *SeenLog) Get(userId string) (Sighting, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sightings[userId]
+	if ok && time.Since(s.Time) > l.keep {
+		return Sighting{}, false
+	}
+	return s, ok
+}
+
+// Saves the sightings if there are new ones, forgetting any that are too
+// old.
+func (l *SeenLog) Save() error {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	sightings := make(map[string]Sighting, len(l.sightings))
+	for id, s := range l.sightings {
+		if time.Since(s.Time) > l.keep {
+			delete(l.sightings, id)
+		} else {
+			sightings[id] = s
+		}
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	return l.store.Save(seenStore, savedSightings{Sightings: sightings})
+}
+
+// Records what a user was doing if the message is a chat message, join,
+// leave or rename in one of the bot's rooms.
+func (bot *Bot) RecordSighting(msg Message) {
+	if strings.HasPrefix(msg.room, "user:") || len(msg.args) == 0 {
+		return
+	}
+
+	_, name := splitUser(msg.args[0])
+	if toId(name) == "" || toId(name) == toId(bot.config.Nick) {
+		return
+	}
+	room := msg.room
+	if room == "" {
+		// messages without a room are from the lobby
+		room = "lobby"
+	}
+	s := Sighting{Name: name, Time: time.Now(), Room: room}
+	switch msg.msgType {
+	case "c", "c:", "chat":
+		s.Action = SeenChat
+	case "j", "J", "join":
+		s.Action = SeenJoin
+	case "l", "L", "leave":
+		s.Action = SeenLeave
+	case "n", "N", "name":
+		// of the form "newname|oldid". The old name is only known as an id
+		s.Action = SeenRename
+		if len(msg.args) > 1 && toId(msg.args[1]) != toId(name) {
+			old := s
+			old.Name, old.RenamedTo = msg.args[1], name
+			bot.seen.Add(old)
+			s.RenamedFrom = msg.args[1]
+		}
+	default:
+		return
+	}
+	bot.seen.Add(s)
+}
+
+// Returns true if what happens in the given room shouldn't be told to
+// anyone outside it. Safe to use from any goroutine.
+func (bot *Bot) HiddenRoom(room string) bool {
+	return strings.HasPrefix(room, "battle-") ||
+		strings.HasPrefix(room, "groupchat-") ||
+		contains(bot.Config().HiddenRooms, room)
+}
+
+// Returns true if the given user, by id, is in the given room, as far as the
+// bot can tell.
+func (bot *Bot) UserInRoom(userId, room string) bool {
+	r, ok := bot.Room(room)
+	if !ok {
+		return false
+	}
+	_, ok = r.Users[userId]
+	return ok
+}
+
+// Says when and where a user was last seen, and what they were doing. The
+// rooms given in config.HiddenRooms are only named to users in them.
+//
+// Syntax: .seen user
+func (bot *Bot) SeenCommand(msg Message) {
+	_, asker := splitUser(msg.args[0])
+	target := toId(msg.args[1])
+	switch target {
+	case "":
+		bot.QueueMessage(bot.config.CommandChar+"seen user", msg.room)
+		return
+	case toId(asker):
+		bot.QueueMessage("You're right here.", msg.room)
+		return
+	case toId(bot.config.Nick):
+		bot.QueueMessage("I'm right here.", msg.room)
+		return
+	}
+
+	s, ok := bot.seen.Get(target)
+	if !ok {
+		bot.QueueMessage(strings.TrimSpace(msg.args[1])+" hasn't been seen.",
+			msg.room)
+		return
+	}
+
+	ago := formatAgo(time.Since(s.Time))
+	if bot.HiddenRoom(s.Room) && msg.room != s.Room &&
+		!bot.UserInRoom(toId(asker), s.Room) {
+		// what they were doing could give the room away too
+		bot.QueueMessage(fmt.Sprintf("%s was last seen %s in a hidden room.",
+			s.Name, ago), msg.room)
+		return
+	}
+	bot.QueueMessage(fmt.Sprintf("%s was last seen %s in %s, %s.", s.Name,
+		ago, s.Room, s.Doing()), msg.room)
+}
+
+// Describes how long ago something happened, e.g. "3 hours ago".
+func formatAgo(d time.Duration) string {
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 48*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	default:
+		n, unit = int(d/(24*time.Hour)), "day"
+	}
+	return fmt.Sprintf("%d %s%s ago", n, unit, plural(n))
+}
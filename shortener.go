@@ -0,0 +1,324 @@
+/*
+ * URL shorteners used to keep webhook announcements short. The shortener the
+ * bot uses is chosen with `config.Shortener`:
+ *   - none: URLs are left as they are (the default)
+ *   - service: an external shortening service given by `config.ShortenerURL`
+ *   - local: the bot shortens URLs itself and serves the redirects from its
+ *       own HTTP server at /s/<code>
+ *
+ * If `config.ShortenerFallback` is set, the service shortener falls back to
+ * the local one whenever the service fails, rather than leaving URLs long.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the path the local shortener serves its redirects under
+	ShortLinkPath = "/s/"
+
+	// the name the local shortener's links are saved under in the store
+	shortLinkStore = "shortlinks"
+
+	// the most URLs a CachedShortener will remember before starting afresh
+	shortCacheSize = 1000
+	// how long a ServiceShortener gives the service to respond if it isn't
+	// given a Client
+	shortenerTimeout = 5 * time.Second
+)
+
+var (
+	ErrShortenURL = errors.New("could not shorten the URL")
+)
+
+// Error encountered when a URL can't be shortened using a URL shortener
+// such as git.io or goo.gl
+type ShortURLError struct {
+	URL string // the URL trying to be shortened
+	Err error
+}
+
+func (e *ShortURLError) Error() string {
+	return e.URL + ": " + e.Err.Error()
+}
+
+// A Shortener turns long URLs into short ones. Implementations must be safe
+// to use from several goroutines at once.
+type Shortener interface {
+	// Returns the shortened version of longURL, or a *ShortURLError if it
+	// can't be shortened
+	Shorten(longURL string) (string, error)
+}
+
+// A NoopShortener doesn't shorten anything, and just gives back the URL
+// it was given.
+type NoopShortener struct{}
+
+func (NoopShortener) Shorten(longURL string) (string, error) {
+	return longURL, nil
+}
+
+// A ServiceShortener shortens URLs using an external service. If CreateURL
+// contains the placeholder {url}, a GET request is made with the escaped long
+// URL substituted in; otherwise the long URL is POSTed to CreateURL as the
+// form field `url`. The service should reply with the short URL as plain
+// text. If the reply is only a code rather than a full URL, it is appended
+// to BaseURL.
+type ServiceShortener struct {
+	CreateURL string
+	BaseURL   string
+	// the client used to reach the service. Defaults to one that gives up
+	// after a few seconds, so that a slow service can't hold up
+	// announcements
+	Client *http.Client
+}
+
+func (s *ServiceShortener) Shorten(longURL string) (string, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: shortenerTimeout}
+	}
+
+	var response *http.Response
+	var err error
+	if strings.Contains(s.CreateURL, "{url}") {
+		response, err = client.Get(strings.Replace(s.CreateURL, "{url}",
+			url.QueryEscape(longURL), -1))
+	} else {
+		response, err = client.PostForm(s.CreateURL, url.Values{
+			"url": []string{longURL},
+		})
+	}
+	if err != nil {
+		return "", &ShortURLError{longURL, err}
+	}
+
+	// a short URL is never anywhere near this long
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<12))
+	response.Body.Close()
+	if err != nil {
+		return "", &ShortURLError{longURL, err}
+	}
+
+	short := strings.TrimSpace(string(body))
+	if response.StatusCode/100 != 2 || short == "" {
+		return "", &ShortURLError{longURL, ErrShortenURL}
+	}
+	if !strings.HasPrefix(short, "http://") &&
+		!strings.HasPrefix(short, "https://") {
+		short = s.BaseURL + short
+	}
+
+	return short, nil
+}
+
+// A LocalShortener shortens URLs without relying on anything external. Codes
+// are handed out in order and saved to the bot's store, and the redirects are
+// served by the LocalShortener itself, which should be mounted at
+// ShortLinkPath on the bot's HTTP server.
+type LocalShortener struct {
+	// the URL the bot's HTTP server can be reached at from outside, e.g.
+	// http://example.com:8080
+	base  string
+	store *Store
+	log   *slog.Logger
+
+	mu    sync.Mutex
+	links shortLinks
+	codes map[string]string // long URL -> code
+}
+
+// the form the local shortener's links are saved in
+type shortLinks struct {
+	Next  int64
+	Links map[string]string // code -> long URL
+}
+
+// Creates a LocalShortener whose links start with base, loading any links
+// that were saved by a previous run. Links that can't be saved are reported
+// to logger.
+func NewLocalShortener(base string, store *Store,
+	logger *slog.Logger) (*LocalShortener, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &LocalShortener{
+		base:  strings.TrimSuffix(base, "/"),
+		store: store,
+		log:   logger,
+		links: shortLinks{Links: make(map[string]string)},
+		codes: make(map[string]string),
+	}
+	if err := store.Load(shortLinkStore, &s.links); err != nil {
+		return s, err
+	}
+	if s.links.Links == nil {
+		s.links.Links = make(map[string]string)
+	}
+
+	for code, longURL := range s.links.Links {
+		s.codes[longURL] = code
+	}
+	return s, nil
+}
+
+func (s *LocalShortener) Shorten(longURL string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.codes[longURL]
+	if !ok {
+		code = strconv.FormatInt(s.links.Next, 36)
+		s.links.Next++
+		s.links.Links[code] = longURL
+		s.codes[longURL] = code
+
+		// the link still works until the bot restarts, so we just log the
+		// failure rather than refusing to shorten
+		if err := s.store.Save(shortLinkStore, s.links); err != nil {
+			s.log.Error("could not save short links", "error", err)
+		}
+	}
+
+	return s.base + ShortLinkPath + code, nil
+}
+
+// Redirects requests for /s/<code> to the URL the code was made for.
+func (s *LocalShortener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	code := strings.TrimPrefix(req.URL.Path, ShortLinkPath)
+
+	s.mu.Lock()
+	longURL, ok := s.links.Links[code]
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	http.Redirect(w, req, longURL, http.StatusMovedPermanently)
+}
+
+// A CachedShortener remembers the URLs its Shortener has already shortened
+// so that they don't need to be shortened again.
+type CachedShortener struct {
+	Shortener Shortener
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func (s *CachedShortener) Shorten(longURL string) (string, error) {
+	s.mu.Lock()
+	short, ok := s.cache[longURL]
+	s.mu.Unlock()
+	if ok {
+		return short, nil
+	}
+
+	short, err := s.Shortener.Shorten(longURL)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	// there's no point being clever about which URLs to forget, since the
+	// same URL is rarely shortened more than a few times in a row
+	if s.cache == nil || len(s.cache) >= shortCacheSize {
+		s.cache = make(map[string]string)
+	}
+	s.cache[longURL] = short
+	s.mu.Unlock()
+
+	return short, nil
+}
+
+// A FallbackShortener shortens URLs with Shortener, using Fallback instead
+// whenever Shortener fails, e.g. while an external service is down.
+type FallbackShortener struct {
+	Shortener Shortener
+	Fallback  Shortener
+	// where failures of Shortener are reported. Defaults to slog.Default
+	Log *slog.Logger
+}
+
+func (s *FallbackShortener) Shorten(longURL string) (string, error) {
+	short, err := s.Shortener.Shorten(longURL)
+	if err == nil {
+		return short, nil
+	}
+
+	logger := s.Log
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("could not shorten URL, using the fallback", "url", longURL,
+		"error", err)
+	return s.Fallback.Shorten(longURL)
+}
+
+// Creates the shortener described by the bot's config. If the local
+// shortener is used, including as the service shortener's fallback, its
+// redirects are added to the bot's HTTP server.
+func (bot *Bot) CreateShortener() Shortener {
+	switch strings.ToLower(bot.config.Shortener) {
+	case "service":
+		var s Shortener = &CachedShortener{Shortener: &ServiceShortener{
+			CreateURL: bot.config.ShortenerURL,
+			BaseURL:   bot.config.ShortenerBase,
+		}}
+		if bot.config.ShortenerFallback {
+			// shortenerbase is the service's, so the fallback's
+			// links start with the bot's own URL
+			local := bot.createLocalShortener(bot.PublicURL())
+			s = &FallbackShortener{Shortener: s, Fallback: local,
+				Log: bot.Logger(LogHooks)}
+		}
+		return s
+	case "local":
+		base := bot.config.ShortenerBase
+		if base == "" {
+			base = bot.PublicURL()
+		}
+		return bot.createLocalShortener(base)
+	default:
+		return NoopShortener{}
+	}
+}
+
+// Creates a LocalShortener whose links start with base, and serves its
+// redirects on the bot's HTTP server.
+func (bot *Bot) createLocalShortener(base string) *LocalShortener {
+	local, err := NewLocalShortener(base, bot.store, bot.Logger(LogHooks))
+	if err != nil {
+		bot.Logger(LogHooks).Error("could not load short links",
+			"error", err)
+	}
+	bot.HandleHTTP(ShortLinkPath, local)
+	return local
+}
+
+// Shortens the given URL using the bot's shortener. If it can't be shortened,
+// the original URL is returned instead.
+func (bot *Bot) ShortenURL(longURL string) string {
+	short, err := bot.shortener.Shorten(longURL)
+	if err != nil {
+		bot.Logger(LogHooks).Warn("could not shorten URL", "url", longURL,
+			"error", err)
+		return longURL
+	}
+	return short
+}
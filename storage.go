@@ -0,0 +1,83 @@
+/*
+ * Simple persistent storage for the bot. Anything that needs to survive a
+ * restart (short links, room lists, etc) is kept as a JSON file inside the
+ * directory given by `config.DataDir`.
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DefaultDataDir = "./data"
+)
+
+// A Store saves and loads values as JSON files in a single directory, using
+// one file per name. It does no locking of its own, so callers saving the
+// same name from several goroutines must serialise those calls themselves.
+type Store struct {
+	dir string
+}
+
+// Creates a Store that keeps its files in the given directory. The directory
+// is created the first time something is saved.
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDataDir
+	}
+	return &Store{dir: dir}
+}
+
+// Returns the path of the file used to store the given name.
+func (s *Store) Path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Loads the value stored under the given name into v. If nothing has been
+// saved under that name yet, v is left untouched and nil is returned.
+func (s *Store) Load(name string, v interface{}) error {
+	contents, err := ioutil.ReadFile(s.Path(name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(contents, v)
+}
+
+// Saves v under the given name, replacing whatever was there before. The
+// data is written to a temporary file first so that a crash part way through
+// can't leave a half-written file behind.
+func (s *Store) Save(name string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path(name))
+}
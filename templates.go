@@ -0,0 +1,388 @@
+/*
+ * Templates for the messages announcing GitHub webhooks. Each template is a
+ * Go template (see https://golang.org/pkg/text/template/) which is given a
+ * HookData, so any field of the webhook event can be used. The templates can
+ * be changed in config.yaml, either for every room using `hooktemplates` or
+ * for particular rooms using `roomtemplates`.
+ *
+ * HTML templates are announced using !htmlbox and are parsed with
+ * html/template, so values are escaped automatically. Text templates are
+ * announced as ordinary chat messages, one line per message. The text
+ * templates are also used in rooms where the bot's rank is too low to use
+ * !htmlbox, even if the room is set to use HTML.
+ *
+ * As well as the standard template functions, templates can use
+ *   - repo, branch, name, sha, url, size: format a value the same way as the
+ *       default templates do
+ *   - colour "#RRGGBB" value: colours a value. Does nothing in text templates
+ *   - short sha: the first 7 characters of a commit SHA
+ *   - firstline text: the first line of a (commit) message
+ *   - plural n: "s" if n is not 1, otherwise ""
+ *   - truncate n text: text cut down to at most n characters
+ *
+ * Copyright 2015 (c) Ben Frengley (TalkTakesTime)
+ */
+
+package gobot
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/TalkTakesTime/hookserve/hookserve"
+	htmltemplate "html/template"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// [repo] user pushed number new commits? to branch: URL
+	DefaultPushTemplate = `[{{repo .Repo}}] {{name .By}} pushed ` +
+		`{{size .Size}} new commit{{plural .Size}} to {{branch .Branch}}: ` +
+		`{{url .ShortURL}}`
+	// repo/branch SHA user: commit message
+	DefaultCommitTemplate = `{{repo .Repo}}/{{branch .Branch}} ` +
+		`{{sha (short .Commit.SHA)}} {{name .Commit.By}}: ` +
+		`{{firstline .Commit.Message}}`
+	// [repo] user action pull request #number: message (upstream...base) URL
+	DefaultPullReqTemplate = `[{{repo .BaseRepo}}] {{name .By}} {{.Action}} ` +
+		`pull request #{{.Number}}: {{firstline .Message}} ` +
+		`({{branch .BaseBranch}}...{{branch .Branch}}) {{url .ShortURL}}`
+
+	// the formats a TemplateConfig can use
+	FormatHTML = "html"
+	FormatText = "text"
+
+	// the most commits a text announcement lists before summarising the rest,
+	// to avoid flooding the room
+	maxTextCommits = 5
+)
+
+// The templates used for each kind of webhook announcement. Blank templates
+// fall back to the defaults.
+type TemplateSet struct {
+	Push        string
+	Commit      string
+	PullRequest string
+}
+
+// The templates for webhook announcements, as given in config.yaml.
+type TemplateConfig struct {
+	// Whether announcements should be made using the html templates and
+	// !htmlbox (html), or the text templates (text). Defaults to html
+	Format string
+	HTML   TemplateSet
+	Text   TemplateSet
+}
+
+// The data given to webhook templates. The event is embedded, so its fields
+// can be used directly, e.g. {{.Repo}} or {{range .Commits}}.
+type HookData struct {
+	hookserve.Event
+
+	// the URL of the event, shortened if possible
+	ShortURL string
+	// the room the announcement will be made in
+	Room string
+	// in the commit template, the element of .Commits being announced
+	Commit interface{}
+}
+
+// anything that can execute a template, so that html/template and
+// text/template can be used interchangeably
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// a parsed TemplateSet
+type compiledSet struct {
+	push, commit, pullRequest executor
+}
+
+// The parsed templates for a room, ready to render announcements.
+type HookTemplates struct {
+	// whether announcements should use the HTML templates
+	html bool
+
+	htmlSet, textSet compiledSet
+}
+
+var (
+	htmlFuncs = htmltemplate.FuncMap{
+		"repo": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatRepo(s))
+		},
+		"branch": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatBranch(s))
+		},
+		"name": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatName(s))
+		},
+		"sha": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatSHA(s))
+		},
+		"url": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatURL(s))
+		},
+		"size": func(n int) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatSize(n))
+		},
+		"colour": func(colour, s string) htmltemplate.HTML {
+			return htmltemplate.HTML(FormatColour(colour, s))
+		},
+		"short":     shortSHA,
+		"firstline": firstLine,
+		"plural":    plural,
+		"truncate":  truncate,
+	}
+	textFuncs = template.FuncMap{
+		"repo":   identity,
+		"branch": identity,
+		"name":   identity,
+		"sha":    identity,
+		"url":    identity,
+		"size":   strconv.Itoa,
+		"colour": func(colour, s string) string {
+			return s
+		},
+		"short":     shortSHA,
+		"firstline": firstLine,
+		"plural":    plural,
+		"truncate":  truncate,
+	}
+
+	// the default templates for each format
+	defaultHTMLSet = TemplateSet{
+		Push:        DefaultPushTemplate,
+		Commit:      DefaultCommitTemplate,
+		PullRequest: DefaultPullReqTemplate,
+	}
+	defaultTextSet = TemplateSet{
+		Push: `[{{.Repo}}] {{.By}} pushed {{.Size}} new ` +
+			`commit{{plural .Size}} to {{.Branch}}: {{.ShortURL}}`,
+		Commit: `{{.Repo}}/{{.Branch}} {{short .Commit.SHA}} ` +
+			`{{.Commit.By}}: {{truncate 100 (firstline .Commit.Message)}}`,
+		PullRequest: `[{{.BaseRepo}}] {{.By}} {{.Action}} pull request ` +
+			`#{{.Number}}: {{truncate 100 (firstline .Message)}} ` +
+			`({{.BaseBranch}}...{{.Branch}}) {{.ShortURL}}`,
+	}
+)
+
+func identity(s string) string {
+	return s
+}
+
+// Returns the abbreviated form of a commit SHA.
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// Returns the first line of a (usually commit) message.
+func firstLine(msg string) string {
+	return strings.SplitN(msg, "\n", 2)[0]
+}
+
+// Returns "s" if n things should be described in the plural.
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// Cuts text down to at most n characters, marking where it was cut.
+func truncate(n int, text string) string {
+	runes := []rune(text)
+	if len(runes) <= n || n < 3 {
+		return text
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+// Parses the templates in a TemplateSet, using the defaults for any that are
+// blank.
+func compileSet(set TemplateSet, html bool) (compiledSet, error) {
+	fallback := defaultTextSet
+	if html {
+		fallback = defaultHTMLSet
+	}
+
+	parse := func(name, text, fallback string) (executor, error) {
+		if text == "" {
+			text = fallback
+		}
+		if html {
+			return htmltemplate.New(name).Funcs(htmlFuncs).Parse(text)
+		}
+		return template.New(name).Funcs(textFuncs).Parse(text)
+	}
+
+	var compiled compiledSet
+	var err error
+	if compiled.push, err = parse("push", set.Push, fallback.Push); err != nil {
+		return compiled, err
+	}
+	if compiled.commit, err = parse("commit", set.Commit,
+		fallback.Commit); err != nil {
+		return compiled, err
+	}
+	compiled.pullRequest, err = parse("pullrequest", set.PullRequest,
+		fallback.PullRequest)
+	return compiled, err
+}
+
+// Merges two TemplateSets, preferring the templates in set.
+func mergeSet(set, fallback TemplateSet) TemplateSet {
+	if set.Push == "" {
+		set.Push = fallback.Push
+	}
+	if set.Commit == "" {
+		set.Commit = fallback.Commit
+	}
+	if set.PullRequest == "" {
+		set.PullRequest = fallback.PullRequest
+	}
+	return set
+}
+
+// Parses the templates given in conf, using fallback for anything that isn't
+// given, and the built in defaults if that isn't given either.
+func NewHookTemplates(conf, fallback TemplateConfig) (*HookTemplates, error) {
+	format := conf.Format
+	if format == "" {
+		format = fallback.Format
+	}
+
+	t := &HookTemplates{
+		html: strings.ToLower(format) != FormatText,
+	}
+
+	var err error
+	t.htmlSet, err = compileSet(mergeSet(conf.HTML, fallback.HTML), true)
+	if err != nil {
+		return nil, err
+	}
+	t.textSet, err = compileSet(mergeSet(conf.Text, fallback.Text), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Returns true if announcements should use HTML where the bot is allowed to.
+func (t *HookTemplates) HTML() bool {
+	return t.html
+}
+
+// Returns the parsed templates for the given format.
+func (t *HookTemplates) set(html bool) compiledSet {
+	if html {
+		return t.htmlSet
+	}
+	return t.textSet
+}
+
+// Renders a push announcement, returning the messages to send. HTML
+// announcements are a single !htmlbox, while text announcements use one
+// message per line.
+func (t *HookTemplates) RenderPush(data HookData, html bool) ([]string, error) {
+	set := t.set(html)
+
+	lines := make([]string, 0, len(data.Commits)+1)
+	line, err := render(set.push, data)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, line)
+
+	// add lines for individual commits too
+	for i := 0; i < data.Size && i < len(data.Commits); i++ {
+		if !html && i == maxTextCommits {
+			lines = append(lines, fmt.Sprintf("... and %d more",
+				data.Size-i))
+			break
+		}
+
+		data.Commit = data.Commits[i]
+		if line, err = render(set.commit, data); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return messages(lines, html), nil
+}
+
+// Renders a pull request announcement, returning the messages to send.
+func (t *HookTemplates) RenderPullRequest(data HookData,
+	html bool) ([]string, error) {
+	line, err := render(t.set(html).pullRequest, data)
+	if err != nil {
+		return nil, err
+	}
+	return messages([]string{line}, html), nil
+}
+
+// Turns rendered lines into the messages that should be sent.
+func messages(lines []string, html bool) []string {
+	if html {
+		return []string{"!htmlbox " + strings.Join(lines, "<br />")}
+	}
+
+	messages := make([]string, 0, len(lines))
+	for _, line := range lines {
+		// a text template could contain newlines of its own
+		for _, part := range strings.Split(line, "\n") {
+			if part = strings.TrimSpace(part); part != "" {
+				messages = append(messages, part)
+			}
+		}
+	}
+	return messages
+}
+
+// Executes a template, returning the result as a string.
+func render(tmpl executor, data HookData) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	return strings.TrimSpace(buf.String()), err
+}
+
+// Parses the webhook templates for every room with its own templates in
+// config, as well as the templates used by all other rooms.
+func (bot *Bot) LoadTemplates() error {
+	templates := make(map[string]*HookTemplates)
+
+	var err error
+	templates[""], err = NewHookTemplates(bot.config.HookTemplates,
+		TemplateConfig{})
+	if err != nil {
+		return fmt.Errorf("hooktemplates: %s", err)
+	}
+	for room, conf := range bot.config.RoomTemplates {
+		templates[room], err = NewHookTemplates(conf,
+			bot.config.HookTemplates)
+		if err != nil {
+			return fmt.Errorf("roomtemplates %s: %s", room, err)
+		}
+	}
+
+	bot.templates = templates
+	return nil
+}
+
+// Returns the webhook templates to use for the given room.
+func (bot *Bot) TemplatesFor(room string) *HookTemplates {
+	bot.configMu.RLock()
+	defer bot.configMu.RUnlock()
+
+	if t, ok := bot.templates[room]; ok {
+		return t
+	}
+	return bot.templates[""]
+}